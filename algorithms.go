@@ -0,0 +1,65 @@
+package sftp_server
+
+import (
+	"fmt"
+)
+
+// The algorithms supported by the SSH library, which may be configured using the KeyExchanges,
+// Ciphers and MACs settings. The library silently ignores algorithms it does not support, so
+// configured algorithms are checked against these to catch typos that would otherwise leave a
+// weaker default in place.
+var (
+	supportedKeyExchanges = map[string]bool{
+		"curve25519-sha256@libssh.org": true,
+		"ecdh-sha2-nistp256":           true,
+		"ecdh-sha2-nistp384":           true,
+		"ecdh-sha2-nistp521":           true,
+		"diffie-hellman-group14-sha1":  true,
+		"diffie-hellman-group1-sha1":   true,
+	}
+
+	supportedCiphers = map[string]bool{
+		"aes128-gcm@openssh.com":        true,
+		"chacha20-poly1305@openssh.com": true,
+		"aes128-ctr":                    true,
+		"aes192-ctr":                    true,
+		"aes256-ctr":                    true,
+		"aes128-cbc":                    true,
+		"3des-cbc":                      true,
+		"arcfour256":                    true,
+		"arcfour128":                    true,
+		"arcfour":                       true,
+	}
+
+	supportedMACs = map[string]bool{
+		"hmac-sha2-256-etm@openssh.com": true,
+		"hmac-sha2-256":                 true,
+		"hmac-sha1":                     true,
+		"hmac-sha1-96":                  true,
+	}
+)
+
+// Checks that every algorithm in the list is supported.
+func validateAlgorithms(kind string, algorithms []string, supported map[string]bool) error {
+	for _, a := range algorithms {
+		if !supported[a] {
+			return fmt.Errorf("sftp: unsupported %s algorithm \"%s\"", kind, a)
+		}
+	}
+
+	return nil
+}
+
+// Checks the configured algorithm lists, returning an error for any algorithm that is not
+// supported by the server.
+func (c Server) validateAlgorithms() error {
+	if err := validateAlgorithms("key exchange", c.Settings.KeyExchanges, supportedKeyExchanges); err != nil {
+		return err
+	}
+
+	if err := validateAlgorithms("cipher", c.Settings.Ciphers, supportedCiphers); err != nil {
+		return err
+	}
+
+	return validateAlgorithms("mac", c.Settings.MACs, supportedMACs)
+}
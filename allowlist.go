@@ -0,0 +1,35 @@
+package sftp_server
+
+import (
+	"net"
+	"strings"
+)
+
+// Determines if the IP address is within one of the networks the Panel allowed the session to
+// connect from, given as a comma separated list in the "allowed_ips" permission extension. All
+// addresses are allowed when the Panel did not return a list. Connections accepted on a unix
+// socket without ProxyProtocol enabled have no address, and are left to the gateway in front
+// of the server to restrict.
+func allowedIP(allowed string, ip string) bool {
+	if allowed == "" || ip == "" {
+		return true
+	}
+
+	networks, err := parseNetworks(strings.Split(allowed, ","))
+	if err != nil {
+		return false
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, n := range networks {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,298 @@
+package sftp_server
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validates the credentials provided by a connecting client and returns the permissions
+// that should be assigned to the resulting SSH connection.
+func (c *Server) passwordCallback(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	return c.authenticate(conn, pass, nil)
+}
+
+// Prompts the client for their password using keyboard-interactive authentication. If the
+// Panel reports that the username does not identify a single server, and interactive server
+// selection is enabled, the user is shown a numbered list of the servers they have access to
+// and asked to pick one.
+func (c *Server) keyboardInteractiveCallback(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	// Keyboard-interactive authentication is the only way to show a message to the user once
+	// they have started authenticating, so it is used to tell them which node to connect to.
+	if err := c.checkRoute(conn.User()); err != nil {
+		client("", err.Error()+"\n", nil, nil)
+		return nil, err
+	}
+
+	answers, err := client("", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(answers) != 1 {
+		return nil, &InvalidCredentialsError{}
+	}
+
+	if !c.Settings.InteractiveServerSelection {
+		return c.authenticate(conn, []byte(answers[0]), nil)
+	}
+
+	return c.authenticate(conn, []byte(answers[0]), func(servers []ServerChoice) (string, error) {
+		var b strings.Builder
+		b.WriteString("You have access to more than one server, select the one to connect to:\n")
+		for i, s := range servers {
+			fmt.Fprintf(&b, "  %d) %s (%s)\n", i+1, s.Name, s.Identifier)
+		}
+
+		answers, err := client("", b.String(), []string{"Server: "}, []bool{true})
+		if err != nil {
+			return "", err
+		}
+
+		if len(answers) != 1 {
+			return "", &InvalidCredentialsError{}
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(answers[0]))
+		if err != nil || n < 1 || n > len(servers) {
+			return "", &InvalidCredentialsError{}
+		}
+
+		return servers[n-1].Identifier, nil
+	})
+}
+
+// Authenticates a client using the given password. When selectServer is provided and the Panel
+// responds with a list of servers rather than a single one, it is called to determine which of
+// them the user wants to connect to and the credentials are validated again for that server.
+func (c *Server) authenticate(conn ssh.ConnMetadata, pass []byte, selectServer func(servers []ServerChoice) (string, error)) (perm *ssh.Permissions, err error) {
+	ip := remoteIP(conn.RemoteAddr())
+	user := conn.User()
+
+	c.metrics.Inc("auth_attempts_total")
+	defer func() {
+		if err != nil {
+			c.metrics.Inc("auth_failures_total")
+			if c.authLog != nil && IsInvalidCredentialsError(err) {
+				if err := c.authLog.failure(user, conn.RemoteAddr()); err != nil {
+					c.logger.Warnw("failed to write to auth log", zap.Error(err))
+				}
+			}
+		} else {
+			c.metrics.Inc("auth_success_total")
+		}
+	}()
+
+	if c.isHoneypotUsername(user) {
+		c.banIP(ip, c.Settings.HoneypotBanDuration)
+		c.metrics.Inc("honeypot_logins_total")
+		c.logger.Warnw("banning ip after login attempt using honeypot username", zap.String("ip", ip), zap.String("user", user))
+
+		if events := c.eventEmitter(); events != nil {
+			events(Event{Type: EventHoneypot, User: user, IP: conn.RemoteAddr().String()})
+		}
+
+		return nil, &InvalidCredentialsError{}
+	}
+
+	// Further attempts over a connection that was open when the IP was banned are rejected
+	// without asking the Panel.
+	if c.isBanned(ip) {
+		c.metrics.Inc("auth_banned_rejected_total")
+		return nil, &InvalidCredentialsError{}
+	}
+
+	if err := c.checkRoute(user); err != nil {
+		c.logger.Infow("rejecting login for a server hosted on a different node", zap.String("ip", ip), zap.String("user", user), zap.Error(err))
+		return nil, err
+	}
+
+	if c.load.isBusy() {
+		c.metrics.Inc("auth_busy_rejected_total")
+		return nil, ErrServerBusy
+	}
+
+	c.tarpit(ip)
+
+	id := newRequestID()
+	r := AuthenticationRequest{
+		User:          user,
+		Pass:          string(pass),
+		IP:            conn.RemoteAddr().String(),
+		SessionID:     conn.SessionID(),
+		ClientVersion: conn.ClientVersion(),
+		RequestID:     id,
+	}
+
+	validator := c.CredentialValidator
+	uuid, oneTime := parseOneTimeUsername(user)
+	if oneTime {
+		if c.OneTimeCredentialValidator == nil {
+			return nil, &InvalidCredentialsError{}
+		}
+
+		// One-time credentials may only ever be used for a single session, even if the Panel
+		// would otherwise accept them again.
+		if c.hasShared("one_time:" + user) {
+			c.authFailed(ip)
+			return nil, &InvalidCredentialsError{}
+		}
+
+		validator = c.OneTimeCredentialValidator
+	} else if identity, ok := ParseUsername(user); ok {
+		r.Identity = identity
+	}
+
+	resp, err := c.validateCredentials(validator, r)
+	if err == nil && resp.Server == "" && len(resp.Servers) > 0 && selectServer != nil && !oneTime {
+		var choice string
+		if choice, err = selectServer(resp.Servers); err == nil {
+			user = user + "." + choice
+			r.User = user
+			r.Identity, _ = ParseUsername(user)
+
+			resp, err = c.validateCredentials(validator, r)
+		}
+	}
+
+	if err != nil {
+		if IsInvalidCredentialsError(err) {
+			c.authFailed(ip)
+		} else if errors.Is(err, ErrPanelTokenRejected) {
+			c.logger.Errorw("panel rejected the node token while validating credentials", zap.String("request_id", id), zap.Error(err))
+		}
+
+		c.logger.Debugw("failed to validate user credentials", zap.String("request_id", id), zap.Error(err))
+		return nil, err
+	}
+
+	// A response without a server would create a session that is unable to do anything, so fail
+	// the authentication attempt entirely so the client is told why it cannot connect.
+	if resp.Server == "" {
+		c.logger.Warnw("panel returned an authentication response without a server",
+			zap.String("request_id", id),
+			zap.String("user", user),
+			zap.Strings("permissions", resp.Permissions),
+			zap.String("state", resp.State),
+		)
+		return nil, &InvalidCredentialsError{}
+	}
+
+	if err := resp.Validate(); err != nil {
+		c.logger.Warnw("panel returned a malformed authentication response", zap.String("request_id", id), zap.Error(err))
+		return nil, err
+	}
+
+	if oneTime {
+		// Never allow a one-time credential to be used to access a server other than the one
+		// it was generated for.
+		if resp.Server != uuid {
+			c.logger.Warnw("one-time credential returned for a different server", zap.String("request_id", id), zap.String("server", resp.Server))
+			return nil, &InvalidCredentialsError{}
+		}
+
+		if !c.claimShared("one_time:"+user, 24*time.Hour) {
+			c.authFailed(ip)
+			return nil, &InvalidCredentialsError{}
+		}
+	}
+
+	sshPerm := &ssh.Permissions{
+		Extensions: map[string]string{
+			"uuid":        resp.Server,
+			"user":        user,
+			"permissions": strings.Join(resp.Permissions, ","),
+			"session_id":  id,
+		},
+	}
+
+	// Servers that have been deleted but still have their data retained are only accessible
+	// in read-only mode, and only until the grace period has passed.
+	if resp.State == ServerStateDeleted {
+		if resp.DeletedAt == nil || time.Since(*resp.DeletedAt) > c.Settings.DeletedServerGracePeriod {
+			c.logger.Debugw("denying access to deleted server", zap.String("request_id", id), zap.String("server", resp.Server))
+			return nil, &InvalidCredentialsError{}
+		}
+
+		sshPerm.Extensions["read_only"] = "true"
+		sshPerm.Extensions["deleted"] = "true"
+	}
+
+	if resp.State == ServerStatePreview {
+		msg := resp.StateMessage
+		if msg == "" {
+			msg = defaultPreviewMessage
+		}
+
+		sshPerm.Extensions["preview"] = msg
+	}
+
+	if len(resp.AllowedIPs) > 0 {
+		sshPerm.Extensions["allowed_ips"] = strings.Join(resp.AllowedIPs, ",")
+	}
+
+	if resp.Priority != "" {
+		sshPerm.Extensions["priority"] = resp.Priority
+	}
+
+	if resp.Owner != nil {
+		sshPerm.Extensions["uid"] = strconv.Itoa(resp.Owner.Uid)
+		sshPerm.Extensions["gid"] = strconv.Itoa(resp.Owner.Gid)
+	}
+
+	return sshPerm, nil
+}
+
+// Calls the credential validator for the request. If the Panel is unavailable and holding is
+// enabled, the request is held in a bounded queue and retried until the Panel recovers or the
+// hold timeout is reached, smoothing over brief Panel restarts without failing the login.
+func (c *Server) validateCredentials(validator func(r AuthenticationRequest) (*AuthenticationResponse, error), r AuthenticationRequest) (*AuthenticationResponse, error) {
+	resp, err := validator(r)
+	if !errors.Is(err, ErrPanelUnavailable) || c.held == nil {
+		return resp, err
+	}
+
+	select {
+	case c.held <- struct{}{}:
+		defer func() { <-c.held }()
+	default:
+		c.metrics.Inc("auth_hold_rejected_total")
+		return nil, err
+	}
+
+	c.metrics.Inc("auth_held_total")
+	c.logger.Debugw("panel is unavailable, holding authentication request", zap.String("request_id", r.RequestID))
+
+	deadline := time.Now().Add(c.Settings.PanelHoldTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+
+		resp, err = validator(r)
+		if !errors.Is(err, ErrPanelUnavailable) {
+			return resp, err
+		}
+	}
+
+	return nil, err
+}
+
+// Determines if the username is in the format used for one-time credentials generated by the
+// Panel, "<server uuid>.<token>", returning the server UUID if so. Regular usernames use the
+// short server identifier rather than the full UUID, so the two cannot be confused.
+func parseOneTimeUsername(user string) (string, bool) {
+	parts := strings.SplitN(user, ".", 2)
+	if len(parts) != 2 || parts[1] == "" || !isUUID(parts[0]) {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// Determines if the given string is a UUID in its canonical textual form.
+func isUUID(s string) bool {
+	return len(s) == 36 && isServerIdentifier(s)
+}
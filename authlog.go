@@ -0,0 +1,83 @@
+package sftp_server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Writes failed authentication attempts to the AuthLogFile, one per line in a fixed format that
+// fail2ban and similar tools can match against:
+//
+//	2026-01-02T15:04:05Z sftp authentication failure ip=203.0.113.5 port=51234 user="admin"
+//
+// The timestamp is in UTC, and the user is quoted and escaped as a Go string so that a username
+// containing quotes or newlines cannot forge an entry for a different address.
+type authLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openAuthLog(path string) (*authLog, error) {
+	l := &authLog{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Opens the log file again, closing the previous file. This allows it to be rotated.
+func (l *authLog) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("sftp: failed to open auth log: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+
+	return nil
+}
+
+// Records a failed authentication attempt for the user from the address. Attempts from
+// connections without an address are not recorded, since there is nothing to ban.
+func (l *authLog) failure(user string, addr net.Addr) error {
+	ip, port := remoteIP(addr), "0"
+	if ip == "" {
+		return nil
+	}
+
+	if _, p, err := net.SplitHostPort(addr.String()); err == nil {
+		port = p
+	}
+
+	line := fmt.Sprintf("%s sftp authentication failure ip=%s port=%s user=%s\n",
+		time.Now().UTC().Format(time.RFC3339), ip, port, strconv.Quote(user))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := l.f.WriteString(line)
+
+	return err
+}
+
+// Reopens the AuthLogFile, which should be called after it has been rotated so that failures
+// are written to the new file. This does nothing if the auth log is not enabled.
+func (c *Server) ReopenAuthLog() error {
+	if c.authLog == nil {
+		return nil
+	}
+
+	return c.authLog.reopen()
+}
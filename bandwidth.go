@@ -0,0 +1,134 @@
+package sftp_server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A bandwidth limit that applies during a window of the day, allowing tighter limits to be
+// used while game traffic is at its peak. For example, the following limits SFTP transfers to
+// 5MB/s each evening:
+//
+//	{"from": "18:00", "to": "23:00", "limit": 5242880}
+type BandwidthWindow struct {
+	// The local time of day, in the form "15:04", between which the limit applies. The window
+	// may wrap past midnight.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// The days of the week the window applies on, such as "saturday". Empty applies every day.
+	Days []string `json:"days,omitempty"`
+	// The limit in bytes per second across all sessions. A value of 0 does not limit transfers.
+	Limit int64 `json:"limit"`
+}
+
+// Returns an error if the window is not valid.
+func (w BandwidthWindow) validate() error {
+	for _, t := range []string{w.From, w.To} {
+		if _, err := parseTimeOfDay(t); err != nil {
+			return fmt.Errorf("sftp: invalid bandwidth schedule time \"%s\"", t)
+		}
+	}
+
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("sftp: invalid bandwidth schedule day \"%s\"", d)
+		}
+	}
+
+	return nil
+}
+
+func (w BandwidthWindow) matches(now time.Time) bool {
+	if len(w.Days) > 0 {
+		matched := false
+		for _, d := range w.Days {
+			if weekdays[strings.ToLower(d)] == now.Weekday() {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return inTimeWindow(w.From, w.To, now)
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Returns the bandwidth limit that currently applies to the server, using the first window of
+// the schedule that matches the current time and falling back to the default limit. When a State
+// store is configured the limit applies to the entire cluster, and is split between instances in
+// proportion to the number of connections each of them is serving.
+func (c Server) currentBandwidthLimit() int64 {
+	limit := c.Settings.BandwidthLimit
+
+	now := time.Now()
+	for _, w := range c.Settings.BandwidthSchedule {
+		if w.matches(now) {
+			limit = w.Limit
+			break
+		}
+	}
+
+	return c.cluster.share("connections", limit)
+}
+
+// Limits the rate at which data is transferred using a token bucket that allows bursts of up
+// to one second of data. The limit is looked up each time data is transferred so that changes,
+// such as moving into a new window of a schedule, apply immediately to active sessions.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	limit  func() int64
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(limit func() int64) *bandwidthLimiter {
+	return &bandwidthLimiter{limit: limit, last: time.Now()}
+}
+
+// Waits until n bytes may be transferred without exceeding the limit.
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	limit := float64(l.limit())
+	if limit <= 0 {
+		l.tokens = 0
+		l.last = time.Now()
+		l.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * limit
+	if l.tokens > limit {
+		l.tokens = limit
+	}
+	l.last = now
+
+	// The bytes are taken from the bucket even when it does not have enough, so that callers
+	// waiting at the same time queue up behind each other rather than all waking at once.
+	l.tokens -= float64(n)
+	d := time.Duration(-l.tokens / limit * float64(time.Second))
+	l.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,57 @@
+package sftp_server
+
+import (
+	"golang.org/x/crypto/ssh"
+	"net"
+)
+
+type bannerRule struct {
+	network *net.IPNet
+	text    string
+}
+
+// Parses the CIDR to banner mapping from the server settings.
+func (c Server) parseBannerRules() ([]bannerRule, error) {
+	rules := make([]bannerRule, 0, len(c.Settings.Banners))
+	for cidr, text := range c.Settings.Banners {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, bannerRule{network: network, text: text})
+	}
+
+	return rules, nil
+}
+
+// Returns the callback used to send the pre-authentication banner to a connecting client. The
+// banner for the most specific network containing the client's address is returned, falling
+// back to the default banner when none match. A nil callback is returned if no banners have
+// been configured at all.
+func (c Server) bannerCallback() (func(conn ssh.ConnMetadata) string, error) {
+	if c.Settings.Banner == "" && len(c.Settings.Banners) == 0 {
+		return nil, nil
+	}
+
+	rules, err := c.parseBannerRules()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(conn ssh.ConnMetadata) string {
+		ip := net.ParseIP(remoteIP(conn.RemoteAddr()))
+		if ip == nil {
+			return c.Settings.Banner
+		}
+
+		banner, size := c.Settings.Banner, -1
+		for _, r := range rules {
+			if ones, _ := r.network.Mask.Size(); r.network.Contains(ip) && ones > size {
+				banner, size = r.text, ones
+			}
+		}
+
+		return banner
+	}, nil
+}
@@ -0,0 +1,289 @@
+package sftp_server
+
+import (
+	"encoding/json"
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An IP address that is banned from connecting to the server.
+type Ban struct {
+	IP string `json:"ip"`
+	// The time at which the ban expires, nil if the ban never expires.
+	Expires *time.Time `json:"expires,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+}
+
+// The file that bans are persisted to. This is shared between every profile of a server so
+// that they all write to the same file.
+type banStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// Bans the given IP address from connecting to the server for the provided duration.
+func (c Server) banIP(ip string, d time.Duration) {
+	c.BanIP(ip, d, "automatic")
+}
+
+// Bans the given IP address from connecting to the server for the provided duration, or
+// permanently if the duration is zero. Bans are persisted to the configured BanFile so that
+// they survive restarts of the server.
+func (c *Server) BanIP(ip string, d time.Duration, reason string) {
+	if ip == "" {
+		return
+	}
+
+	b := Ban{IP: ip, Reason: reason}
+	exp := cache.NoExpiration
+	if d > 0 {
+		t := time.Now().Add(d)
+		b.Expires = &t
+		exp = d
+	}
+
+	c.cache.Set("ban:"+ip, b, exp)
+	c.metrics.Inc("ip_bans_total")
+	if c.State != nil {
+		v, _ := json.Marshal(b)
+		if err := c.State.Set("ban:"+ip, string(v), d); err != nil {
+			c.logger.Warnw("failed to write ban to shared state", zap.String("ip", ip), zap.Error(err))
+		}
+	}
+	c.saveBans()
+}
+
+// Removes the ban for the given IP address, if there is one.
+func (c *Server) UnbanIP(ip string) {
+	c.cache.Delete("ban:" + ip)
+	if c.State != nil {
+		if err := c.State.Delete("ban:" + ip); err != nil {
+			c.logger.Warnw("failed to remove ban from shared state", zap.String("ip", ip), zap.Error(err))
+		}
+	}
+	c.saveBans()
+}
+
+// Returns all of the IP addresses that are currently banned, sorted by address. When a
+// shared State store is configured this includes bans made by other instances.
+func (c *Server) Bans() []Ban {
+	seen := make(map[string]bool)
+	var bans []Ban
+	for k, v := range c.cache.Items() {
+		if b, ok := v.Object.(Ban); ok && strings.HasPrefix(k, "ban:") {
+			bans = append(bans, b)
+			seen[b.IP] = true
+		}
+	}
+
+	if c.State != nil {
+		keys, err := c.State.Keys("ban:")
+		if err != nil {
+			c.logger.Warnw("failed to list bans from shared state", zap.Error(err))
+		}
+
+		for _, k := range keys {
+			if b, ok := c.sharedBan(strings.TrimPrefix(k, "ban:")); ok && !seen[b.IP] {
+				bans = append(bans, b)
+				seen[b.IP] = true
+			}
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+
+	return bans
+}
+
+// Loads any bans that were persisted by a previous run of the server, skipping those that
+// have since expired.
+func (c *Server) loadBans() error {
+	if c.bans.path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(c.bans.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var bans []Ban
+	if err := json.Unmarshal(b, &bans); err != nil {
+		return err
+	}
+
+	for _, b := range bans {
+		exp := cache.NoExpiration
+		if b.Expires != nil {
+			if exp = time.Until(*b.Expires); exp <= 0 {
+				continue
+			}
+		}
+
+		c.cache.Set("ban:"+b.IP, b, exp)
+	}
+
+	return nil
+}
+
+// Writes the current ban list to the configured BanFile. The file is replaced atomically so
+// that a crash while writing cannot leave behind a truncated list.
+func (c *Server) saveBans() {
+	if c.bans.path == "" {
+		return
+	}
+
+	c.bans.mu.Lock()
+	defer c.bans.mu.Unlock()
+
+	b, err := json.MarshalIndent(c.Bans(), "", "  ")
+	if err != nil {
+		c.logger.Errorw("failed to encode ban list", zap.Error(err))
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.bans.path), ".bans")
+	if err != nil {
+		c.logger.Errorw("failed to write ban list", zap.Error(err))
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.bans.path)
+	}
+
+	if err != nil {
+		c.logger.Errorw("failed to write ban list", zap.Error(err))
+	}
+}
+
+// Determines if the given IP address is currently banned from connecting to the server.
+func (c Server) isBanned(ip string) bool {
+	if ip == "" {
+		return false
+	}
+
+	if _, ok := c.cache.Get("ban:" + ip); ok {
+		return true
+	}
+
+	_, ok := c.sharedBan(ip)
+
+	return ok
+}
+
+// Returns the ban for the IP address from the shared State store, if there is one.
+func (c Server) sharedBan(ip string) (Ban, bool) {
+	var b Ban
+	if c.State == nil {
+		return b, false
+	}
+
+	v, ok, err := c.State.Get("ban:" + ip)
+	if err != nil {
+		c.logger.Warnw("failed to read ban from shared state", zap.String("ip", ip), zap.Error(err))
+		return b, false
+	}
+
+	if !ok || json.Unmarshal([]byte(v), &b) != nil {
+		return b, false
+	}
+
+	return b, true
+}
+
+// Records a failed authentication attempt from the given IP address and returns the number
+// of failures from that address within the current window.
+func (c Server) recordAuthFailure(ip string) int {
+	key := "auth_failures:" + ip
+	if c.State != nil {
+		n, err := c.State.Incr(key, c.Settings.AuthFailureWindow)
+		if err == nil {
+			return int(n)
+		}
+
+		c.logger.Warnw("failed to record authentication failure in shared state", zap.String("ip", ip), zap.Error(err))
+	}
+
+	if err := c.cache.Add(key, 1, c.Settings.AuthFailureWindow); err == nil {
+		return 1
+	}
+
+	n, err := c.cache.IncrementInt(key, 1)
+	if err != nil {
+		return 1
+	}
+
+	return n
+}
+
+// Returns the number of failed authentication attempts from the IP in the current window.
+func (c Server) authFailures(ip string) int {
+	if ip == "" {
+		return 0
+	}
+
+	if c.State != nil {
+		if v, ok, err := c.State.Get("auth_failures:" + ip); err == nil {
+			if !ok {
+				return 0
+			}
+
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+
+	if v, ok := c.cache.Get("auth_failures:" + ip); ok {
+		return v.(int)
+	}
+
+	return 0
+}
+
+// Records a failed authentication attempt from the IP address, banning it for the configured
+// AuthFailureBanDuration once it reaches MaxAuthFailures within the window. This stops a single
+// address from using the server to brute force credentials against the Panel.
+func (c *Server) authFailed(ip string) {
+	if ip == "" {
+		return
+	}
+
+	n := c.recordAuthFailure(ip)
+	if c.Settings.MaxAuthFailures <= 0 || n < c.Settings.MaxAuthFailures {
+		return
+	}
+
+	c.logger.Warnw("banning ip after too many failed logins", zap.String("ip", ip), zap.Int("failures", n))
+	c.metrics.Inc("auth_failure_bans_total")
+	c.BanIP(ip, c.Settings.AuthFailureBanDuration, "too many failed logins")
+}
+
+// Delays the response to a client if the IP it is connecting from has exceeded the tarpit
+// threshold, wasting the time of clients that are scanning the server.
+func (c Server) tarpit(ip string) {
+	if c.Settings.TarpitThreshold <= 0 || c.authFailures(ip) < c.Settings.TarpitThreshold {
+		return
+	}
+
+	c.metrics.Inc("tarpitted_responses_total")
+	time.Sleep(c.Settings.TarpitDelay)
+}
@@ -0,0 +1,52 @@
+package sftp_server
+
+import (
+	"github.com/pkg/sftp"
+)
+
+// A single operation to perform as part of a batch. Method is one of the SFTP command
+// methods, such as "Rename", "Remove", "Rmdir" or "Mkdir". Target is only used for renames.
+type BatchOperation struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+}
+
+// The result of a single operation in a batch. Error is empty when the operation succeeded.
+type BatchResult struct {
+	BatchOperation
+	Error string `json:"error,omitempty"`
+}
+
+// Performs a batch of file operations against the server in a single call, returning the
+// result of each operation in the same order they were provided. Every operation is run
+// through the same handler as the equivalent SFTP request, so the same permission checks
+// apply. A failed operation does not prevent the remaining operations from being run.
+//
+// The request server in pkg/sftp does not allow handlers for custom extended requests to be
+// registered, so this is exposed for the daemon to call on behalf of the Panel's file manager
+// rather than as an SFTP extension.
+func (fs FileSystem) Batch(ops []BatchOperation) []BatchResult {
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = BatchResult{BatchOperation: op}
+
+		switch op.Method {
+		case "Rename", "Remove", "Rmdir", "Mkdir":
+		default:
+			results[i].Error = sftp.ErrSshFxOpUnsupported.Error()
+			continue
+		}
+
+		r := sftp.NewRequest(op.Method, op.Path)
+		if op.Target != "" {
+			r.Target = op.Target
+		}
+
+		if err := fs.Filecmd(r); err != nil && err != sftp.ErrSshFxOk {
+			results[i].Error = err.Error()
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package sftp_server
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Creates the cgroup v2 group at the given path, applies the I/O limits to the block device
+// that contains the data directory, and moves the current process into the group so that all
+// of its disk I/O is throttled by the kernel.
+func applyIOLimit(cgroup string, dataDir string, limit IOLimit) error {
+	dev, err := blockDevice(dataDir)
+	if err != nil {
+		return err
+	}
+
+	// The io controller must be enabled for the children of the parent group before it can be
+	// used. This fails if it is already enabled or cannot be, in which case writing the limits
+	// below reports a more useful error.
+	ioutil.WriteFile(filepath.Join(filepath.Dir(cgroup), "cgroup.subtree_control"), []byte("+io"), 0644)
+
+	if err := os.MkdirAll(cgroup, 0755); err != nil {
+		return err
+	}
+
+	line := dev + " " + limit.String()
+	if err := ioutil.WriteFile(filepath.Join(cgroup, "io.max"), []byte(line), 0644); err != nil {
+		return fmt.Errorf("sftp: failed to set io limits for cgroup: %w", err)
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	if err := ioutil.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(pid), 0644); err != nil {
+		return fmt.Errorf("sftp: failed to move process into cgroup: %w", err)
+	}
+
+	return nil
+}
+
+// Returns the major and minor number of the whole disk containing the given path, in the form
+// "8:0". Limits can only be applied to whole disks, so if the path is on a partition the disk
+// containing the partition is returned instead.
+func blockDevice(p string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(p, &st); err != nil {
+		return "", err
+	}
+
+	dev := fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+
+	sys := filepath.Join("/sys/dev/block", dev)
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		// The entry for the device is a symlink to the partition's directory, which is within
+		// the directory of the disk it is on.
+		resolved, err := filepath.EvalSymlinks(sys)
+		if err != nil {
+			return "", err
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(filepath.Dir(resolved), "dev"))
+		if err != nil {
+			return "", err
+		}
+
+		dev = strings.TrimSpace(string(b))
+	}
+
+	return dev, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+import (
+	"errors"
+)
+
+func applyIOLimit(cgroup string, dataDir string, limit IOLimit) error {
+	return errors.New("sftp: io limits are not supported on this platform")
+}
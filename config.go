@@ -0,0 +1,318 @@
+package sftp_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// The standalone configuration of the server, typically stored in sftp.yml. This holds only the
+// parts of the daemon's core.json that the server needs, so that it does not require access to
+// the full daemon configuration and every secret in it.
+type Config struct {
+	// The base URL of the Panel.
+	Remote string `yaml:"remote"`
+	// A reference to the token used to authenticate with the Panel, as accepted by ReadSecret,
+	// such as "file:/etc/pterodactyl/sftp.token".
+	Token string `yaml:"token"`
+	// The directory containing the data directory of each server.
+	Path        string   `yaml:"path"`
+	BindAddress string   `yaml:"bind_address"`
+	BindPort    int      `yaml:"bind_port"`
+	ReadOnly    bool     `yaml:"read_only"`
+	User        SftpUser `yaml:"user"`
+
+	// The algorithms offered to clients, see the fields of the same name in Settings.
+	KeyExchanges []string `yaml:"key_exchanges,omitempty"`
+	Ciphers      []string `yaml:"ciphers,omitempty"`
+	MACs         []string `yaml:"macs,omitempty"`
+
+	// The SFTP extensions that are not advertised to clients, see DisabledSFTPExtensions.
+	DisabledSFTPExtensions []string `yaml:"disabled_sftp_extensions,omitempty"`
+
+	// The standalone server sandboxes itself on kernels that support it unless this is set,
+	// see Settings.Sandbox.
+	DisableSandbox bool `yaml:"disable_sandbox,omitempty"`
+}
+
+// Checks that the configuration is complete and valid.
+func (c *Config) Validate() error {
+	if u, err := url.Parse(c.Remote); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("sftp: config: remote \"%s\" is not a valid http(s) url", c.Remote)
+	}
+
+	if c.Token == "" {
+		return errors.New("sftp: config: token is not set")
+	}
+
+	if !filepath.IsAbs(c.Path) {
+		return fmt.Errorf("sftp: config: path \"%s\" must be absolute", c.Path)
+	}
+
+	if c.BindPort < 1 || c.BindPort > 65535 {
+		return fmt.Errorf("sftp: config: bind_port %d is out of range", c.BindPort)
+	}
+
+	if c.User.Uid < 0 || c.User.Gid < 0 {
+		return errors.New("sftp: config: user uid and gid must not be negative")
+	}
+
+	if err := validateAlgorithms("key exchange", c.KeyExchanges, supportedKeyExchanges); err != nil {
+		return err
+	}
+
+	if err := validateAlgorithms("cipher", c.Ciphers, supportedCiphers); err != nil {
+		return err
+	}
+
+	if err := validateAlgorithms("mac", c.MACs, supportedMACs); err != nil {
+		return err
+	}
+
+	for _, e := range c.DisabledSFTPExtensions {
+		if err := validateExtension(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Configures the server and its Panel client using the configuration. The CredentialValidator
+// of the server is only replaced when it is not already set.
+func (c *Config) Apply(s *Server) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	token, err := ReadToken(c.Token)
+	if err != nil {
+		return fmt.Errorf("sftp: config: failed to read token: %w", err)
+	}
+
+	s.Settings.BasePath = c.Path
+	s.Settings.BindAddress = c.BindAddress
+	s.Settings.BindPort = c.BindPort
+	s.Settings.ReadOnly = c.ReadOnly
+	s.Settings.KeyExchanges = c.KeyExchanges
+	s.Settings.Ciphers = c.Ciphers
+	s.Settings.MACs = c.MACs
+	s.Settings.DisabledSFTPExtensions = c.DisabledSFTPExtensions
+	s.Settings.Sandbox = !c.DisableSandbox
+	s.User = c.User
+
+	if s.CredentialValidator == nil {
+		s.CredentialValidator = NewPanelClient(c.Remote, token).ValidateCredentials
+	}
+
+	return nil
+}
+
+// Returns the options for creating a server using NewWithOptions from the configuration.
+func (c *Config) Options() (Options, error) {
+	if err := c.Validate(); err != nil {
+		return Options{}, err
+	}
+
+	token, err := ReadToken(c.Token)
+	if err != nil {
+		return Options{}, fmt.Errorf("sftp: config: failed to read token: %w", err)
+	}
+
+	return Options{
+		PanelURL:    c.Remote,
+		PanelToken:  token,
+		BasePath:    c.Path,
+		BindAddress: c.BindAddress,
+		BindPort:    c.BindPort,
+		ReadOnly:    c.ReadOnly,
+		User:        c.User,
+		Settings: Settings{
+			KeyExchanges: c.KeyExchanges,
+			Ciphers:      c.Ciphers,
+			MACs:         c.MACs,
+
+			DisabledSFTPExtensions: c.DisabledSFTPExtensions,
+			Sandbox:                !c.DisableSandbox,
+		},
+	}, nil
+}
+
+// Loads and validates a standalone configuration file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(&c); err != nil {
+		return nil, fmt.Errorf("sftp: config: failed to parse %s: %w", path, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// The parts of the daemon's core.json that are used by the server.
+type daemonConfig struct {
+	Remote struct {
+		Base string `json:"base"`
+	} `json:"remote"`
+	Keys []string `json:"keys"`
+	Sftp struct {
+		Path string `json:"path"`
+		IP   string `json:"ip"`
+		Port int    `json:"port"`
+	} `json:"sftp"`
+	Docker struct {
+		Container struct {
+			Username string `json:"username"`
+		} `json:"container"`
+	} `json:"docker"`
+}
+
+// Extracts the configuration used by the server from the contents of the daemon's core.json,
+// returning it along with the Panel token. The returned configuration does not reference the
+// token, the caller is expected to store it somewhere and set Config.Token accordingly.
+func MigrateConfig(core []byte) (*Config, string, error) {
+	var d daemonConfig
+	if err := json.Unmarshal(core, &d); err != nil {
+		return nil, "", fmt.Errorf("sftp: migrate: failed to parse daemon config: %w", err)
+	}
+
+	if len(d.Keys) == 0 || d.Keys[0] == "" {
+		return nil, "", errors.New("sftp: migrate: daemon config does not contain any keys")
+	}
+
+	c := &Config{
+		Remote:      d.Remote.Base,
+		Path:        d.Sftp.Path,
+		BindAddress: d.Sftp.IP,
+		BindPort:    d.Sftp.Port,
+	}
+
+	if c.Path == "" {
+		c.Path = "/srv/daemon-data"
+	}
+
+	if c.BindAddress == "" {
+		c.BindAddress = "0.0.0.0"
+	}
+
+	if c.BindPort == 0 {
+		c.BindPort = 2022
+	}
+
+	name := d.Docker.Container.Username
+	if name == "" {
+		name = "pterodactyl"
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("sftp: migrate: failed to lookup user %s: %w", name, err)
+	}
+
+	c.User.Uid, _ = strconv.Atoi(u.Uid)
+	c.User.Gid, _ = strconv.Atoi(u.Gid)
+
+	return c, d.Keys[0], nil
+}
+
+// Runs the migrate-config command with the given arguments, allowing binaries embedding the
+// server to offer it as a subcommand. The relevant parts of the daemon's core.json are written
+// to a standalone configuration file, with the Panel token stored in a separate file that only
+// the owner can read so that it is never kept in the configuration itself.
+func MigrateConfigCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate-config", flag.ContinueOnError)
+	flags.SetOutput(out)
+	core := flags.String("core", "/srv/daemon/config/core.json", "the daemon configuration to migrate")
+	dest := flags.String("out", "/etc/pterodactyl/sftp.yml", "the configuration file to write")
+	tokenFile := flags.String("token-file", "", "the file to write the Panel token to, defaults to sftp.token next to the configuration")
+	force := flags.Bool("force", false, "overwrite existing files")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(*core)
+	if err != nil {
+		return err
+	}
+
+	c, token, err := MigrateConfig(b)
+	if err != nil {
+		return err
+	}
+
+	if *tokenFile == "" {
+		*tokenFile = filepath.Join(filepath.Dir(*dest), "sftp.token")
+	}
+
+	if abs, err := filepath.Abs(*tokenFile); err != nil {
+		return err
+	} else {
+		c.Token = "file:" + abs
+	}
+
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	y, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*dest), 0755); err != nil {
+		return err
+	}
+
+	if err := writeNewFile(*tokenFile, []byte(token+"\n"), *force); err != nil {
+		return err
+	}
+
+	if err := writeNewFile(*dest, y, *force); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "wrote %s and %s, the server no longer needs access to %s\n", *dest, *tokenFile, *core)
+
+	return nil
+}
+
+// Writes a file that only its owner can read, refusing to replace an existing file unless
+// overwrite is set.
+func writeNewFile(p string, b []byte, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(p, flags, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
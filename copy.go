@@ -0,0 +1,220 @@
+package sftp_server
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The SFTP extension that copies a file on the server without the client downloading and
+// uploading it again, as described in draft-ietf-secsh-filexfer-extensions. The request holds
+// the source and target paths and whether an existing target may be overwritten.
+const copyFileExtension = "copy-file"
+
+// Copies a file from one location on the server to another, both paths being relative to
+// the server's root directory. On filesystems that support reflinks the copy is performed
+// as a copy-on-write clone, making it instant and avoiding duplicate disk usage. Otherwise
+// the file contents are copied byte for byte.
+//
+// Unlike the SFTP handlers this is intended to be called directly by the application embedding
+// the server, so the error kinds exported by this package are returned.
+func (fs FileSystem) Copy(source string, target string) error {
+	if fs.isReadOnly() || !fs.can(PermissionFileReadContent) || isVersionsPath(target) || isQuarantinePath(target) {
+		return ErrPermissionDenied
+	}
+
+	if fs.isIgnored(source) || fs.isIgnored(target) {
+		return os.ErrNotExist
+	}
+
+	done, ok := fs.locks.begin(fs.UUID)
+	if !ok {
+		return ErrServerLocked
+	}
+	defer done()
+
+	src, err := fs.buildPath(source)
+	if err != nil {
+		return err
+	}
+
+	dst, err := fs.buildPath(target)
+	if err != nil {
+		return err
+	}
+
+	if fs.inQuarantine(dst) {
+		return ErrPermissionDenied
+	}
+
+	if err := fs.runMiddleware("Get", source, ""); err != nil {
+		return err
+	}
+
+	if st, err := os.Stat(src); err == nil {
+		if err := fs.runMiddlewareWithSize("Put", target, "", st.Size()); err != nil {
+			return err
+		}
+	}
+
+	if !fs.HasDiskSpace(fs) {
+		return ErrQuotaExceeded
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if s, err := os.Stat(src); err != nil {
+		return err
+	} else if !s.Mode().IsRegular() {
+		return ErrNotRegularFile
+	}
+
+	// Replacing an existing file is an update to it, and is checked in the same way as an
+	// upload replacing it would be.
+	existing, err := os.Stat(dst)
+	if err == nil {
+		if !existing.Mode().IsRegular() {
+			return ErrNotRegularFile
+		}
+
+		if !fs.can(PermissionFileUpdate) {
+			return ErrPermissionDenied
+		}
+
+		if err := fs.guardReplacement(target, dst, src, existing); err != nil {
+			return err
+		}
+	} else if !fs.can(PermissionFileCreate) {
+		return ErrPermissionDenied
+	} else {
+		existing = nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		fs.logger.Errorw("error making path for file copy", zap.String("target", dst), zap.Error(err))
+		return err
+	}
+
+	fs.saveVersion(target, dst)
+
+	if err := copyFile(dst, src); err != nil {
+		fs.logger.Errorw("failed to copy file",
+			zap.String("source", src),
+			zap.String("target", dst),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	// Not failing here is intentional. We still made the file, it is just owned incorrectly
+	// and will likely cause some issues. When ownership is being preserved a replaced file is
+	// left owned by whoever owned it before.
+	owner := fs.User
+	if fs.PreserveOwnership && existing != nil {
+		if o, ok := fileOwner(existing); ok {
+			owner = o
+		}
+	}
+
+	if err := os.Chown(dst, owner.Uid, owner.Gid); err != nil {
+		fs.logger.Warnw("error chowning file", zap.String("file", dst), zap.Error(err))
+	}
+
+	fs.relabel(dst)
+	fs.recordModifiedBy(dst)
+	fs.emit(EventWrite, target, "")
+	fs.journalChange(EventWrite, target, "")
+
+	return nil
+}
+
+// Handles a copyFileExtension request from the client, refusing to replace an existing file
+// unless the client allowed it to be overwritten.
+func (fs FileSystem) copyFileRequest(source string, target string, overwrite bool) error {
+	if fs.session != nil {
+		defer fs.session.begin()()
+	}
+
+	if !overwrite {
+		dst, err := fs.buildPath(target)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Lstat(dst); err == nil {
+			return os.ErrExist
+		}
+	}
+
+	return fs.Copy(source, target)
+}
+
+// Returns the status code and message sent to the client for the result of a copyFileExtension
+// request.
+func copyFileStatus(err error) (uint32, string) {
+	var denial *DenialError
+	switch {
+	case err == nil:
+		return sftpStatusOK, "Success"
+	case errors.As(err, &denial):
+		return sftpStatusPermissionDenied, denial.Error()
+	case errors.Is(err, ErrPermissionDenied), errors.Is(err, ErrServerLocked):
+		return sftpStatusPermissionDenied, "Permission denied"
+	case errors.Is(err, ErrPathEscape), errors.Is(err, os.ErrNotExist):
+		return sftpStatusNoSuchFile, "No such file"
+	case errors.Is(err, os.ErrExist):
+		return sftpStatusFailure, "Target file already exists"
+	default:
+		return sftpStatusFailure, "Failure"
+	}
+}
+
+// Copies the file at src to dst, preferring a reflink clone of the file and falling back
+// to copying the contents when the filesystem does not support it.
+func copyFile(dst string, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	s, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return copyContents(out, in)
+}
+
+// Copies the contents of the file at p to out, which must be empty.
+func copyExisting(out *os.File, p string) error {
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return copyContents(out, in)
+}
+
+// Copies the contents of in to out, which must be empty, preferring a reflink clone.
+func copyContents(out *os.File, in *os.File) error {
+	if err := reflink(out, in); err == nil {
+		return nil
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
@@ -1,19 +1,102 @@
 package sftp_server
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
 type AuthenticationRequest struct {
 	User          string `json:"username"`
 	Pass          string `json:"password"`
 	IP            string `json:"ip"`
 	SessionID     []byte `json:"session_id"`
 	ClientVersion []byte `json:"client_version"`
+	// A unique identifier for this authentication attempt. This becomes the ID of the session
+	// if authentication is successful and should be sent to the Panel in the X-Request-Id
+	// header so that requests can be correlated across systems.
+	RequestID string `json:"request_id"`
+	// The structured form of the username, when it was provided in one of the formats
+	// understood by ParseUsername.
+	Identity *UsernameIdentity `json:"identity,omitempty"`
 }
 
 type AuthenticationResponse struct {
 	Server      string   `json:"server"`
 	Token       string   `json:"token"`
 	Permissions []string `json:"permissions"`
+	// The user that files created for this server should be owned by. When not provided the
+	// SftpUser configured for the SFTP server is used.
+	Owner *SftpUser `json:"owner,omitempty"`
+	// The state of the server in the Panel, one of the ServerState constants. An empty state
+	// is treated as a normal, active server.
+	State string `json:"state,omitempty"`
+	// The time at which the server was deleted, only present when State is ServerStateDeleted.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// The message shown to users attempting to modify files while the server is in the
+	// ServerStatePreview state, such as instructions for settling the account.
+	StateMessage string `json:"state_message,omitempty"`
+	// The priority class of the login, such as PriorityAdmin, which determines the limits
+	// applied to the session. See Settings.PriorityClasses.
+	Priority string `json:"priority,omitempty"`
+	// The servers the user has access to, returned instead of a server when the username did
+	// not identify one. Clients using keyboard-interactive authentication are asked to pick
+	// one of these when Settings.InteractiveServerSelection is enabled.
+	Servers []ServerChoice `json:"servers,omitempty"`
+	// The IP addresses and CIDR ranges the user may connect to the server from, such as an
+	// office or VPN range. Sessions from any other address are rejected. Every address is
+	// allowed when empty.
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+}
+
+// A server that a user may choose to connect to.
+type ServerChoice struct {
+	Identifier string `json:"identifier"`
+	Name       string `json:"name"`
 }
 
+// Validates that the response returned for an authentication request is well formed. Sessions
+// must never be created from a malformed response since it could grant access to the wrong
+// server, or to no server at all.
+func (r AuthenticationResponse) Validate() error {
+	if !isUUID(r.Server) {
+		return fmt.Errorf("%w: server \"%s\" is not a valid uuid", ErrInvalidResponse, r.Server)
+	}
+
+	if len(r.Permissions) == 0 {
+		return fmt.Errorf("%w: no permissions were returned", ErrInvalidResponse)
+	}
+
+	for _, p := range r.Permissions {
+		if p == "" || strings.ContainsAny(p, ", ") {
+			return fmt.Errorf("%w: permission \"%s\" is not valid", ErrInvalidResponse, p)
+		}
+	}
+
+	if _, err := parseNetworks(r.AllowedIPs); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidResponse, err)
+	}
+
+	if strings.IndexFunc(r.Token, func(c rune) bool { return c <= ' ' || c > '~' }) != -1 {
+		return fmt.Errorf("%w: token contains invalid characters", ErrInvalidResponse)
+	}
+
+	return nil
+}
+
+// The states a server can be in as returned by the Panel.
+const (
+	ServerStateActive = "active"
+	// The server has been deleted in the Panel but its data has been retained. Users may still
+	// access the server in read-only mode for the configured grace period.
+	ServerStateDeleted = "deleted"
+	// The account owning the server has an outstanding payment. Users may list and download
+	// files but all writes are blocked with a message explaining the state of the account,
+	// allowing hosts to apply a softer policy than fully suspending the server.
+	ServerStatePreview = "preview"
+)
+
 type InvalidCredentialsError struct {
 }
 
@@ -21,8 +104,11 @@ func (ice InvalidCredentialsError) Error() string {
 	return "the credentials provided were invalid"
 }
 
+// Determines if the given error is, or wraps, an InvalidCredentialsError. Both pointer and
+// non-pointer instances of the error are matched.
 func IsInvalidCredentialsError(err error) bool {
-	_, ok := err.(*InvalidCredentialsError)
+	var ice InvalidCredentialsError
+	var ptr *InvalidCredentialsError
 
-	return ok
+	return errors.As(err, &ice) || errors.As(err, &ptr)
 }
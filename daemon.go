@@ -0,0 +1,55 @@
+package sftp_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Returns a function that fetches the disk usage of a server from the daemon's API, which
+// already tracks the usage of every server on the node. Using this as the DiskUsageSource
+// avoids the SFTP server walking the same directories the daemon does. The token is the
+// daemon's own API token.
+func DaemonUsageSource(baseURL string, token string) func(server string) (int64, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	return func(server string) (int64, error) {
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/api/servers/"+url.PathEscape(server), nil)
+		if err != nil {
+			return 0, err
+		}
+
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		res, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("sftp: daemon returned status %d fetching usage for server %s", res.StatusCode, server)
+		}
+
+		var body struct {
+			Utilization struct {
+				DiskBytes *int64 `json:"disk_bytes"`
+			} `json:"utilization"`
+		}
+
+		if err := json.NewDecoder(&limitedReader{r: res.Body, n: 1 << 20}).Decode(&body); err != nil {
+			return 0, fmt.Errorf("sftp: invalid response from daemon: %w", err)
+		}
+
+		if body.Utilization.DiskBytes == nil {
+			return 0, fmt.Errorf("sftp: daemon did not return disk usage for server %s", server)
+		}
+
+		return *body.Utilization.DiskBytes, nil
+	}
+}
@@ -0,0 +1,150 @@
+package sftp_server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A single file that was found to have identical contents to at least one other file
+// during a deduplication scan.
+type DuplicateFile struct {
+	Server string `json:"server"`
+	Path   string `json:"path"`
+}
+
+// A group of files that all share the same contents.
+type DuplicateGroup struct {
+	Hash  string          `json:"hash"`
+	Size  int64           `json:"size"`
+	Files []DuplicateFile `json:"files"`
+}
+
+// Returns the number of bytes that could be reclaimed if every file in this group
+// was replaced with a reflink or hardlink to a single copy.
+func (g DuplicateGroup) Savings() int64 {
+	if len(g.Files) < 2 {
+		return 0
+	}
+
+	return int64(len(g.Files)-1) * g.Size
+}
+
+type DedupReport struct {
+	// The total number of files that were scanned across all servers.
+	Files int `json:"files"`
+	// The total size of all scanned files in bytes.
+	TotalSize int64 `json:"total_size"`
+	// The number of bytes that could be saved by deduplicating all of the groups.
+	Savings int64 `json:"savings"`
+
+	Groups []DuplicateGroup `json:"groups"`
+}
+
+// Scans every server data directory contained within the given directory and returns a
+// report of all files that have identical contents, along with an estimate of the space that
+// could be saved by deduplicating them with reflinks or hardlinks. Each directory directly
+// below dataDir is treated as a single server, using the directory name as the server UUID.
+//
+// Files are first grouped by size and only hashed when there is more than one file of the
+// same size, so running this against a node is significantly cheaper than hashing every file.
+// Files that are already hardlinked to one another are only counted once.
+func NewDedupReport(dataDir string) (*DedupReport, error) {
+	dirs, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DedupReport{}
+	bySize := make(map[int64][]DuplicateFile)
+	infos := make(map[string]os.FileInfo)
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		root := filepath.Join(dataDir, d.Name())
+		err := walkFiles(root, nil, func(p string, info os.FileInfo) error {
+			report.Files++
+			report.TotalSize += info.Size()
+
+			// Empty files are never worth deduplicating.
+			if info.Size() == 0 {
+				return nil
+			}
+
+			bySize[info.Size()] = append(bySize[info.Size()], DuplicateFile{Server: d.Name(), Path: p})
+			infos[p] = info
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for size, files := range bySize {
+		if len(files) < 2 {
+			continue
+		}
+
+		byHash := make(map[string][]DuplicateFile)
+	Files:
+		for _, f := range files {
+			h, err := hashFile(f.Path)
+			if err != nil {
+				continue
+			}
+
+			// Skip over any files that are already hardlinked to a file in this group since
+			// they do not consume any additional space on the disk.
+			for _, e := range byHash[h] {
+				if os.SameFile(infos[e.Path], infos[f.Path]) {
+					continue Files
+				}
+			}
+
+			byHash[h] = append(byHash[h], f)
+		}
+
+		for h, matches := range byHash {
+			if len(matches) < 2 {
+				continue
+			}
+
+			g := DuplicateGroup{Hash: h, Size: size, Files: matches}
+			report.Savings += g.Savings()
+			report.Groups = append(report.Groups, g)
+		}
+	}
+
+	// Sort the largest potential savings to the top of the report since those are what an
+	// administrator will generally care the most about.
+	sort.Slice(report.Groups, func(i, j int) bool {
+		return report.Groups[i].Savings() > report.Groups[j].Savings()
+	})
+
+	return report, nil
+}
+
+// Returns the hex encoded SHA-256 hash of the file at the given path.
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
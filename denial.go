@@ -0,0 +1,121 @@
+package sftp_server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// The reasons a request can be denied for with a DenialError.
+const (
+	// The server does not have enough disk space remaining.
+	DenialQuota = "quota"
+	// The file is protected from being modified, such as a critical configuration file.
+	DenialProtected = "protected"
+	// The server has been deleted in the Panel and is only available for reading.
+	DenialDeleted = "deleted"
+	// The server has a write lock placed on it while it is transferred or backed up.
+	DenialLocked = "locked"
+	// The request was rejected by a policy rule or middleware.
+	DenialPolicy = "policy"
+	// The server is in read-only preview mode because of the state of the account.
+	DenialPreview = "preview"
+	// The node is running low on disk space.
+	DenialDiskFull = "disk-full"
+)
+
+// Returned when the server has a write lock placed on it.
+var ErrServerLocked = errors.New("sftp: server is temporarily read-only while it is being backed up or transferred")
+
+// Returned when the server has been deleted and may only be read from.
+var ErrServerDeleted = errors.New("sftp: server has been deleted and is read-only")
+
+// Returned when the server is in read-only preview mode, wrapped by an error containing the
+// message provided by the Panel.
+var ErrServerPreview = errors.New("sftp: server is in read-only preview mode")
+
+// The message shown to users of a server in read-only preview mode when the Panel does not
+// provide one.
+const defaultPreviewMessage = "This server is read-only until the outstanding balance on the account is paid."
+
+// Returned to the client when a request is denied for a policy reason. The error includes a
+// short reference code that is also attached to the EventDenied event and log line recorded for
+// the denial, so that support can find exactly why a request failed from the message a user
+// pastes into a ticket.
+type DenialError struct {
+	Reason    string
+	Reference string
+	Err       error
+}
+
+func (e *DenialError) Error() string {
+	return fmt.Sprintf("%s (reference %s)", strings.TrimPrefix(e.Err.Error(), "sftp: "), e.Reference)
+}
+
+func (e *DenialError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the error sent to the client for the denial, keeping the message and reference. The
+// SFTP library sends the message of path errors along with the status of the system error they
+// wrap, which is the only way to send both. Denials caused by the quota are sent as a failure,
+// since version 3 of the protocol has no quota status, and the rest as permission denied.
+func (e *DenialError) status() error {
+	errno := syscall.EPERM
+	if errors.Is(e.Err, ErrQuotaExceeded) {
+		errno = syscall.EDQUOT
+	}
+
+	return &os.PathError{Op: strings.TrimPrefix(e.Err.Error(), "sftp: "), Path: "(reference " + e.Reference + ")", Err: errno}
+}
+
+// Denies a request for the given reason, recording the denial under a new reference code and
+// returning the error that should be sent to the client.
+func (fs FileSystem) deny(reason string, p string, err error) error {
+	ref := strings.ToUpper(newRequestID()[:8])
+
+	if fs.logger != nil {
+		fs.logger.Infow("denied request", zap.String("reference", ref), zap.String("reason", reason), zap.String("path", p), zap.Error(err))
+	}
+
+	if fs.metrics != nil {
+		fs.metrics.Inc("requests_denied_total")
+	}
+
+	if fs.events != nil && fs.session != nil {
+		fs.events(Event{
+			Type:      EventDenied,
+			Server:    fs.UUID,
+			User:      fs.session.user,
+			IP:        fs.session.ip,
+			Path:      p,
+			Target:    reason,
+			SessionID: fs.session.id,
+			RequestID: fs.requestID,
+			Reference: ref,
+		})
+	}
+
+	return &DenialError{Reason: reason, Reference: ref, Err: err}
+}
+
+// Returns the error sent to a client attempting to modify a read-only filesystem, explaining
+// why it is read-only when that is not simply how the server was configured.
+func (fs FileSystem) readOnlyError(p string) error {
+	switch {
+	case fs.PreviewMessage != "":
+		return fs.deny(DenialPreview, p, fmt.Errorf("%w: %s", ErrServerPreview, fs.PreviewMessage))
+	case fs.Deleted:
+		return fs.deny(DenialDeleted, p, ErrServerDeleted)
+	case !fs.ReadOnly && fs.locks.locked(fs.UUID):
+		return fs.deny(DenialLocked, p, ErrServerLocked)
+	case !fs.ReadOnly && fs.disk.isLow():
+		return fs.deny(DenialDiskFull, p, ErrNodeDiskFull)
+	default:
+		return sftp.ErrSshFxOpUnsupported
+	}
+}
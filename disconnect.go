@@ -0,0 +1,78 @@
+package sftp_server
+
+import (
+	"encoding/binary"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// The SSH disconnect reason codes sent to clients whose connection is refused, from RFC 4253.
+// Clients show the reason along with the message, and well-behaved clients use it to decide
+// whether reconnecting is worthwhile.
+const (
+	// The client is not allowed to connect at all, such as when its IP address is banned.
+	DisconnectHostNotAllowed uint32 = 1
+	// The server is shutting down.
+	DisconnectByApplication uint32 = 11
+	// The server has reached a connection limit, the client may try again later.
+	DisconnectTooManyConnections uint32 = 12
+)
+
+// The version sent to clients whose connection is refused, matching the version sent by the
+// SSH library for connections that are accepted.
+const rejectVersion = "SSH-2.0-Go"
+
+// Refuses a connection before the SSH handshake, sending a disconnect message with the given
+// reason code instead of simply closing it. Before the key exchange has completed packets are
+// not encrypted, so the message can be written directly along with the server's version, which
+// is sent straight away since many clients wait for it before sending their own. Clients
+// otherwise report a generic connection reset or closed error.
+func (c Server) rejectConnection(conn net.Conn, reason uint32, msg string) {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	payload := make([]byte, 0, 13+len(msg))
+	payload = append(payload, 1) // SSH_MSG_DISCONNECT
+	payload = appendUint32(payload, reason)
+	payload = appendString(payload, msg)
+	payload = appendString(payload, "en")
+
+	// Unencrypted packets are padded to a multiple of 8 bytes with at least 4 bytes of padding.
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+
+	packet := make([]byte, 0, 5+len(payload)+padding)
+	packet = appendUint32(packet, uint32(1+len(payload)+padding))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	packet = append(packet, make([]byte, padding)...)
+
+	if _, err := conn.Write(append([]byte(rejectVersion+"\r\n"), packet...)); err != nil {
+		c.logger.Debugw("failed to send disconnect message to client", zap.String("ip", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+
+	// Drain whatever the client sends, typically its version and key exchange init, until it
+	// closes the connection after reading the message. Closing the connection with data left
+	// unread can reset it before the client reads the message, but clients that send nothing,
+	// such as scanners, are not waited on for long.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(ioutil.Discard, conn)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+
+	return append(b, buf[:]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint32(b, uint32(len(s)))
+
+	return append(b, s...)
+}
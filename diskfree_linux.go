@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package sftp_server
+
+import (
+	"syscall"
+)
+
+// Returns the number of bytes available to unprivileged users on the filesystem containing
+// the given path, along with its total size.
+func diskFree(p string) (free uint64, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, 0, err
+	}
+
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
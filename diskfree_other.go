@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+import (
+	"errors"
+)
+
+func diskFree(p string) (uint64, uint64, error) {
+	return 0, 0, errors.New("sftp: checking free disk space is not supported on this platform")
+}
@@ -0,0 +1,111 @@
+package sftp_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Returned when the node is running out of disk space and all sessions have been made read-only.
+var ErrNodeDiskFull = errors.New("sftp: the node is running low on disk space, uploads are temporarily disabled")
+
+// Emitted when the node's free disk space drops below the configured minimum and all sessions
+// are made read-only, and again once enough space has been freed. These events are not
+// associated with any server.
+const (
+	EventDiskLow       = "disk-low"
+	EventDiskRecovered = "disk-recovered"
+)
+
+// The body of the request sent to the DiskAlertWebhook.
+type DiskAlert struct {
+	Event   string    `json:"event"`
+	Node    string    `json:"node,omitempty"`
+	Path    string    `json:"path"`
+	Free    uint64    `json:"free"`
+	Total   uint64    `json:"total"`
+	MinFree uint64    `json:"min_free"`
+	Time    time.Time `json:"time"`
+}
+
+// Tracks whether the node is low on disk space. This is shared between every profile of a
+// server and every filesystem created by it.
+type diskGuard struct {
+	low int32
+}
+
+func (d *diskGuard) isLow() bool {
+	return d != nil && atomic.LoadInt32(&d.low) == 1
+}
+
+// Periodically checks the free space on the filesystem containing the server data, forcing
+// every session to be read-only when it drops below the configured minimum. Sessions become
+// writable again once the free space is at least 10% above the minimum, so that the server
+// does not flap between states while a game server is writing near the limit.
+func (c *Server) watchDiskSpace() {
+	t := time.NewTicker(c.Settings.DiskCheckInterval)
+	defer t.Stop()
+
+	for {
+		c.checkDiskSpace()
+		<-t.C
+	}
+}
+
+func (c *Server) checkDiskSpace() {
+	free, total, err := diskFree(c.Settings.BasePath)
+	if err != nil {
+		c.logger.Warnw("failed to check free disk space", zap.String("path", c.Settings.BasePath), zap.Error(err))
+		return
+	}
+
+	c.metrics.Set("disk_free_bytes", free)
+
+	min := c.Settings.MinFreeDiskSpace
+	switch {
+	case free < min && atomic.CompareAndSwapInt32(&c.disk.low, 0, 1):
+		c.metrics.Inc("disk_low_total")
+		c.logger.Errorw("node is low on disk space, all sessions are now read-only", zap.Uint64("free", free), zap.Uint64("min_free", min))
+		c.diskAlert(EventDiskLow, free, total)
+	case free >= min+min/10 && atomic.CompareAndSwapInt32(&c.disk.low, 1, 0):
+		c.logger.Infow("node has recovered disk space, sessions are writable again", zap.Uint64("free", free), zap.Uint64("min_free", min))
+		c.diskAlert(EventDiskRecovered, free, total)
+	}
+}
+
+// Notifies the event listener and the configured webhook of a change in the node's disk state.
+func (c *Server) diskAlert(event string, free uint64, total uint64) {
+	if events := c.eventEmitter(); events != nil {
+		events(Event{Type: event, Path: c.Settings.BasePath})
+	}
+
+	if c.Settings.DiskAlertWebhook == "" {
+		return
+	}
+
+	b, _ := json.Marshal(DiskAlert{
+		Event:   event,
+		Node:    c.Settings.Node,
+		Path:    c.Settings.BasePath,
+		Free:    free,
+		Total:   total,
+		MinFree: c.Settings.MinFreeDiskSpace,
+		Time:    time.Now(),
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(c.Settings.DiskAlertWebhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		c.logger.Warnw("failed to send disk alert webhook", zap.Error(err))
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		c.logger.Warnw("disk alert webhook returned an error", zap.Int("status", res.StatusCode))
+	}
+}
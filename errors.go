@@ -1,9 +1,16 @@
 package sftp_server
 
+import (
+	"errors"
+	"github.com/pkg/sftp"
+)
+
 type fxerr uint32
 
 const (
-	// Extends the default SFTP server to return a quota exceeded error to the client.
+	// Extends the default SFTP server to return a quota exceeded error to the client. Version 3
+	// of the protocol has no status for this, so the SFTP library sends it as a failure with
+	// this error's message.
 	//
 	// @see https://tools.ietf.org/id/draft-ietf-secsh-filexfer-13.txt
 	ErrSshQuotaExceeded = fxerr(15)
@@ -16,4 +23,76 @@ func (e fxerr) Error() string {
 	default:
 		return "Failure"
 	}
-}
\ No newline at end of file
+}
+
+// Allows the error codes sent back to the client to be compared against the error kinds
+// exported by this package.
+func (e fxerr) Is(target error) bool {
+	return e == ErrSshQuotaExceeded && target == ErrQuotaExceeded
+}
+
+// The kinds of errors that can be returned by this package. These may be wrapped with additional
+// context, so callers should always compare against them using errors.Is rather than directly.
+var (
+	// Returned when an operation would cause a server to exceed its available disk space.
+	ErrQuotaExceeded = errors.New("sftp: quota exceeded")
+
+	// Returned when a requested path resolves to a location outside of the server's root
+	// directory. PathValidator implementations must return (or wrap) this error for these
+	// paths, any other error is treated as the path not existing.
+	ErrPathEscape = errors.New("sftp: path resolves outside of server root")
+
+	// Returned when the Panel could not be reached to complete a request. CredentialValidator
+	// implementations should return (or wrap) this error when the Panel cannot be reached.
+	ErrPanelUnavailable = errors.New("sftp: panel is unavailable")
+
+	// Returned when the Panel rejects the token used by the node to authenticate with it, which
+	// says nothing about the credentials of the user and is never counted towards their bans.
+	ErrPanelTokenRejected = errors.New("sftp: panel rejected the node token")
+
+	// Returned when the user does not have permission to perform an action.
+	ErrPermissionDenied = errors.New("sftp: permission denied")
+
+	// Returned when a session is opening a file while it is being disconnected. Transfers that
+	// are already in progress are allowed to finish, but new ones cannot be started.
+	ErrSessionClosing = errors.New("sftp: session is being disconnected")
+
+	// Returned when a response from the Panel is malformed.
+	ErrInvalidResponse = errors.New("sftp: invalid response from panel")
+
+	// Returned when an operation that only works on regular files, such as copying, is given
+	// a directory or special file.
+	ErrNotRegularFile = errors.New("sftp: not a regular file")
+)
+
+// Returns the error for a path that the PathValidator could not resolve, which is ErrPathEscape
+// if it resolves outside of the server's directory and otherwise means it does not exist.
+func resolveError(err error) error {
+	if errors.Is(err, ErrPathEscape) {
+		return err
+	}
+
+	return sftp.ErrSshFxNoSuchFile
+}
+
+// Converts an error returned by a handler to the error sent to the client. The SFTP library only
+// sends the status code of its own errors, so the error kinds of this package are replaced by
+// the error with the matching code. Paths outside of the server's directory are reported as
+// not existing so that nothing is revealed about what is outside of it.
+func statusError(err error) error {
+	var denial *DenialError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &denial):
+		return denial.status()
+	case errors.Is(err, ErrQuotaExceeded):
+		return ErrSshQuotaExceeded
+	case errors.Is(err, ErrPathEscape):
+		return sftp.ErrSshFxNoSuchFile
+	case errors.Is(err, ErrPermissionDenied):
+		return sftp.ErrSshFxPermissionDenied
+	}
+
+	return err
+}
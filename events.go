@@ -0,0 +1,111 @@
+package sftp_server
+
+import (
+	"time"
+)
+
+// The types of events that are emitted by the server.
+const (
+	EventLogin           = "login"
+	EventWrite           = "write"
+	EventDelete          = "delete"
+	EventRename          = "rename"
+	EventCreateDirectory = "create-directory"
+	EventCreateSymlink   = "create-symlink"
+	EventSetstat         = "setstat"
+	// Emitted when an uploaded file does not match the checksum uploaded alongside it.
+	EventChecksumMismatch = "checksum-mismatch"
+	// Emitted when an upload replacing a critical configuration file looks like the wrong file.
+	// The reason the upload was flagged is included as the event's target.
+	EventCriticalFileChanged = "critical-file-changed"
+	// Emitted when a previous version of a file is restored. The restored version is included
+	// as the event's target.
+	EventRestore = "restore"
+	// Emitted when an uploaded file fails validation. The validation error is included as the
+	// event's target.
+	EventValidationFailed = "validation-failed"
+	// Emitted when a user successfully logs in from an IP address that has not previously
+	// been used to login to their account.
+	EventNewIP = "new-ip"
+	// Emitted when a connection attempts to login using one of the configured honeypot
+	// usernames. These events are not associated with any server.
+	EventHoneypot = "honeypot"
+	// Emitted when a request is denied for a policy reason. The reason is included as the
+	// event's target, along with the reference code that was sent to the client.
+	EventDenied = "denied"
+	// Emitted when a user is told which permission they lack after repeatedly being denied
+	// because of it. The missing permission is included as the event's target.
+	EventPermissionNotice = "permission-notice"
+	// Emitted when a request attempts to access a path outside of the server's directory. The
+	// raw path requested by the client is included as the event's path.
+	EventPathEscape = "path-escape"
+	// Emitted when a large upload is held in quarantine until it is promoted through the control
+	// API. The ID of the quarantined upload is included as the event's target.
+	EventQuarantined = "quarantined"
+)
+
+// An event that occurred on the SFTP server for a specific game server. These are passed to
+// the EventListener configured for the server, allowing the daemon to surface SFTP activity
+// to the server owner.
+type Event struct {
+	Type      string    `json:"type"`
+	Server    string    `json:"server"`
+	User      string    `json:"user"`
+	IP        string    `json:"ip"`
+	Path      string    `json:"path,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	SessionID string    `json:"session_id"`
+	RequestID string    `json:"request_id,omitempty"`
+	Reference string    `json:"reference,omitempty"`
+	Node      string    `json:"node,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Returns a function that passes events to the configured listener, dropping any events that
+// are not one of the configured types. A nil function is returned if there is no listener.
+func (c Server) eventEmitter() func(e Event) {
+	if c.EventListener == nil {
+		return nil
+	}
+
+	types := make(map[string]bool, len(c.Settings.EventTypes))
+	for _, t := range c.Settings.EventTypes {
+		types[t] = true
+	}
+
+	return func(e Event) {
+		if len(types) > 0 && !types[e.Type] {
+			return
+		}
+
+		e.Node = c.Settings.Node
+		e.Location = c.Settings.Location
+		e.Time = time.Now()
+		c.EventListener(e)
+	}
+}
+
+// Emits an event for an action performed by the session.
+func (fs FileSystem) emit(t string, p string, target string) {
+	// Files are written to after they are opened, so writes are recorded in the journal once
+	// the upload is complete instead.
+	if t != EventWrite {
+		fs.journalChange(t, p, target)
+	}
+
+	if fs.events == nil || fs.session == nil {
+		return
+	}
+
+	fs.events(Event{
+		Type:      t,
+		Server:    fs.UUID,
+		User:      fs.session.user,
+		IP:        fs.session.ip,
+		Path:      p,
+		Target:    target,
+		SessionID: fs.session.id,
+		RequestID: fs.requestID,
+	})
+}
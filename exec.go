@@ -0,0 +1,232 @@
+package sftp_server
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"hash"
+	"io"
+	"math"
+	"strings"
+)
+
+// The commands that can be emulated for exec requests. These are never run using a shell,
+// they are implemented entirely against the user's confined filesystem.
+var execCommands = map[string]func(fs FileSystem, args []string, out io.Writer) error{
+	"md5sum":    hashCommand(md5.New),
+	"sha1sum":   hashCommand(sha1.New),
+	"sha256sum": hashCommand(sha256.New),
+	"du":        duCommand,
+	"watch":     watchCommand,
+	"versions":  versionsCommand,
+	"deleted":   deletedCommand,
+	"restore":   restoreCommand,
+}
+
+// Returns the payload of an exec request, which is the command the client wants to run.
+func parseExecPayload(payload []byte) (string, error) {
+	var p struct{ Command string }
+	if err := ssh.Unmarshal(payload, &p); err != nil {
+		return "", err
+	}
+
+	return p.Command, nil
+}
+
+// Runs the command in an exec request if it is one of the allowed commands for the server,
+// writing the output to the channel and closing it. Any other command is rejected the same
+// way shell requests are.
+func (c Server) handleExec(channel ssh.Channel, fs FileSystem, payload []byte) {
+	cmd, err := parseExecPayload(payload)
+	if err != nil {
+		rejectShell(channel)
+		return
+	}
+
+	args, err := splitCommand(cmd)
+	if err != nil || len(args) == 0 || !c.isExecAllowed(args[0]) {
+		rejectShell(channel)
+		return
+	}
+
+	fs.logger.Debugw("running emulated exec command", zap.String("command", cmd))
+
+	if fs.session != nil {
+		defer fs.session.begin()()
+	}
+
+	status := uint32(0)
+	if err := execCommands[args[0]](fs, args[1:], channel); err != nil {
+		fmt.Fprintf(channel.Stderr(), "%s: %s\r\n", args[0], err)
+		status = 1
+	}
+
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	channel.Close()
+}
+
+// Splits a command into its arguments the way a POSIX shell would, so that clients can quote
+// or escape file names containing spaces. Single quotes keep everything within them as it is,
+// while a backslash escapes the next character outside of quotes and a quote, backslash,
+// dollar or backtick within double quotes. Nothing else a shell does is supported.
+func splitCommand(cmd string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			continue
+		case c == '\\':
+			if i+1 == len(cmd) {
+				return nil, errors.New("command ends with an escape")
+			}
+			i++
+			arg.WriteByte(cmd[i])
+		case c == '\'':
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end == -1 {
+				return nil, errors.New("unterminated quote")
+			}
+			arg.WriteString(cmd[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			i++
+			for ; i < len(cmd) && cmd[i] != '"'; i++ {
+				if cmd[i] == '\\' && i+1 < len(cmd) && strings.IndexByte("\"\\$`", cmd[i+1]) != -1 {
+					i++
+				}
+				arg.WriteByte(cmd[i])
+			}
+			if i == len(cmd) {
+				return nil, errors.New("unterminated quote")
+			}
+		default:
+			arg.WriteByte(c)
+		}
+		inArg = true
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// Determines if the given command is one of the allowed exec commands for the server.
+func (c Server) isExecAllowed(name string) bool {
+	if _, ok := execCommands[name]; !ok {
+		return false
+	}
+
+	for _, v := range c.Settings.ExecCommands {
+		if v == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a command that outputs the hash of each file in the same format as coreutils.
+func hashCommand(h func() hash.Hash) func(fs FileSystem, args []string, out io.Writer) error {
+	return func(fs FileSystem, args []string, out io.Writer) error {
+		if !fs.can(PermissionFileReadContent) {
+			return ErrPermissionDenied
+		}
+
+		if len(args) == 0 {
+			return errors.New("no files provided")
+		}
+
+		for _, a := range args {
+			// Files are opened the same way as for a download, so the same checks apply and
+			// the hash matches the contents the client would download.
+			f, err := fs.Fileread(sftp.NewRequest("Get", a))
+			if err == sftp.ErrSshFxNoSuchFile {
+				return fmt.Errorf("%s: no such file", a)
+			} else if err != nil {
+				return fmt.Errorf("%s: %s", a, err)
+			}
+
+			sum := h()
+			_, err = io.Copy(sum, io.NewSectionReader(f, 0, math.MaxInt64))
+			if c, ok := f.(io.Closer); ok {
+				c.Close()
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(out, "%s  %s\n", hex.EncodeToString(sum.Sum(nil)), a)
+		}
+
+		return nil
+	}
+}
+
+// Outputs the total size of a directory, supporting the -s and -h flags of du.
+func duCommand(fs FileSystem, args []string, out io.Writer) error {
+	human := false
+	dir := "."
+	for _, a := range args {
+		switch {
+		case a == "-s":
+		case a == "-sh" || a == "-hs" || a == "-h":
+			human = true
+		case strings.HasPrefix(a, "-"):
+			return fmt.Errorf("unsupported option %s", a)
+		default:
+			dir = a
+		}
+	}
+
+	s, err := fs.Summary(dir)
+	if err != nil {
+		return err
+	}
+
+	if human {
+		fmt.Fprintf(out, "%s\t%s\n", humanSize(s.Size), dir)
+	} else {
+		fmt.Fprintf(out, "%d\t%s\n", (s.Size+1023)/1024, dir)
+	}
+
+	return nil
+}
+
+// Formats a size in bytes in the same style as du -h.
+func humanSize(size int64) string {
+	const units = "KMGTPE"
+
+	if size < 1024 {
+		return fmt.Sprintf("%d", size)
+	}
+
+	f := float64(size)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+
+	if f < 10 {
+		return fmt.Sprintf("%.1f%c", f, units[i])
+	}
+
+	return fmt.Sprintf("%.0f%c", f, units[i])
+}
@@ -0,0 +1,177 @@
+package sftp_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The formats that events can be exported in.
+const (
+	// ArcSight Common Event Format, as understood by Splunk and most other SIEMs.
+	EventFormatCEF = "cef"
+	// Elastic Common Schema, as JSON documents.
+	EventFormatECS = "ecs"
+)
+
+// The severity of each event type when exported, on the 0-10 scale used by CEF.
+var eventSeverity = map[string]int{
+	EventLogin:    3,
+	EventNewIP:    5,
+	EventHoneypot: 8,
+	EventDelete:   4,
+}
+
+// Returns the severity of the event type, defaulting to a low severity for types that are
+// not listed in eventSeverity.
+func eventSeverityOf(t string) int {
+	if sev, ok := eventSeverity[t]; ok {
+		return sev
+	}
+
+	return 2
+}
+
+// Returns an EventListener that writes each event to the writer in the given format, one event
+// per line, so that SIEMs are able to ingest SFTP activity without needing a custom parser.
+func NewEventExporter(w io.Writer, format string) (func(e Event), error) {
+	var f func(e Event) ([]byte, error)
+	switch format {
+	case EventFormatCEF:
+		f = func(e Event) ([]byte, error) {
+			return []byte(FormatCEF(e)), nil
+		}
+	case EventFormatECS:
+		f = FormatECS
+	default:
+		return nil, fmt.Errorf("sftp: invalid event format \"%s\"", format)
+	}
+
+	var mu sync.Mutex
+	return func(e Event) {
+		b, err := f(e)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Write(append(b, '\n'))
+	}, nil
+}
+
+// Formats the event as a CEF record.
+func FormatCEF(e Event) string {
+	ext := []string{
+		"rt=" + strconv.FormatInt(e.Time.UnixNano()/1e6, 10),
+		"act=" + cefExtension(e.Type),
+		"suser=" + cefExtension(e.User),
+		"src=" + cefExtension(eventHost(e.IP)),
+		"cs1Label=server",
+		"cs1=" + cefExtension(e.Server),
+		"cs2Label=sessionId",
+		"cs2=" + cefExtension(e.SessionID),
+	}
+
+	if e.Path != "" {
+		ext = append(ext, "filePath="+cefExtension(e.Path))
+	}
+
+	if e.Target != "" {
+		ext = append(ext, "destinationFilePath="+cefExtension(e.Target))
+	}
+
+	if e.RequestID != "" {
+		ext = append(ext, "cs3Label=requestId", "cs3="+cefExtension(e.RequestID))
+	}
+
+	if e.Node != "" {
+		ext = append(ext, "dvchost="+cefExtension(e.Node))
+	}
+
+	if e.Location != "" {
+		ext = append(ext, "cs4Label=location", "cs4="+cefExtension(e.Location))
+	}
+
+	return fmt.Sprintf("CEF:0|Pterodactyl|sftp-server|1.0|%s|%s|%d|%s",
+		cefHeader(e.Type),
+		cefHeader("sftp "+e.Type),
+		eventSeverityOf(e.Type),
+		strings.Join(ext, " "),
+	)
+}
+
+// Escapes a value for use in a CEF header field.
+func cefHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ").Replace(s)
+}
+
+// Escapes a value for use in a CEF extension field.
+func cefExtension(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// Formats the event as an ECS document.
+func FormatECS(e Event) ([]byte, error) {
+	doc := map[string]interface{}{
+		"@timestamp": e.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"ecs":        map[string]string{"version": "8.0.0"},
+		"event": map[string]interface{}{
+			"kind":     "event",
+			"category": ecsCategory(e.Type),
+			"action":   e.Type,
+			"dataset":  "sftp.audit",
+			"severity": eventSeverityOf(e.Type),
+		},
+		"user":    map[string]string{"name": e.User},
+		"source":  map[string]string{"ip": eventHost(e.IP)},
+		"service": map[string]string{"type": "sftp", "name": "sftp-server"},
+		"labels": map[string]string{
+			"server":     e.Server,
+			"session_id": e.SessionID,
+			"request_id": e.RequestID,
+		},
+	}
+
+	if e.Path != "" {
+		f := map[string]string{"path": e.Path}
+		if e.Target != "" {
+			f["target_path"] = e.Target
+		}
+
+		doc["file"] = f
+	}
+
+	if e.Node != "" || e.Location != "" {
+		doc["observer"] = map[string]interface{}{
+			"name": e.Node,
+			"geo":  map[string]string{"name": e.Location},
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// Returns the ECS event categories for the event type.
+func ecsCategory(t string) []string {
+	switch t {
+	case EventLogin, EventNewIP, EventHoneypot:
+		return []string{"authentication"}
+	default:
+		return []string{"file"}
+	}
+}
+
+// Returns the host portion of an event IP, which includes the port the client connected from.
+func eventHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
@@ -0,0 +1,291 @@
+package sftp_server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// The version of the SFTP protocol implemented by the server. Clients requesting a different
+// version are still answered with this one, as required by the protocol.
+const sftpProtocolVersion = 3
+
+// The SFTP extensions supported by the server, in the order they are advertised. Every extension
+// other than copyFileExtension is implemented by the SFTP library.
+var supportedSFTPExtensions = []string{"hardlink@openssh.com", "posix-rename@openssh.com", copyFileExtension}
+
+// The SFTP packet types that are rewritten or answered by extensionChannel.
+const (
+	sftpPacketVersion  = 2
+	sftpPacketStatus   = 101
+	sftpPacketExtended = 200
+)
+
+// The SFTP status codes sent in response to requests answered by extensionChannel.
+const (
+	sftpStatusOK               = 0
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusFailure          = 4
+	sftpStatusBadMessage       = 5
+)
+
+// The largest request for an extension handled by extensionChannel that is read, which is far
+// more than two paths need.
+const maxExtensionRequest = 64 * 1024
+
+// The longest extension name that is checked against the disabled extensions, which is longer
+// than the name of any supported extension.
+const maxExtensionName = 64
+
+// Determines the SFTP extensions advertised to clients from the DisabledSFTPExtensions setting.
+// The SFTP library only allows the extensions it advertises to be changed for the whole process,
+// and executes requests for extensions it does not advertise anyway, so sessions are instead
+// wrapped by extensionChannel.
+func (c *Server) configureExtensions() error {
+	disabled := make(map[string]bool)
+	for _, e := range c.Settings.DisabledSFTPExtensions {
+		if err := validateExtension(e); err != nil {
+			return err
+		}
+		disabled[e] = true
+	}
+
+	c.sftpExtensions = []string{}
+	for _, e := range supportedSFTPExtensions {
+		if !disabled[e] {
+			c.sftpExtensions = append(c.sftpExtensions, e)
+		}
+	}
+
+	return nil
+}
+
+// Wraps the channel used by an SFTP session to apply the server's disabled extensions and to
+// answer requests for the extensions the SFTP library does not implement on the filesystem.
+func (c Server) extensionChannel(ch io.ReadWriteCloser, fs FileSystem) io.ReadWriteCloser {
+	disabled := make(map[string]bool)
+	for _, e := range c.Settings.DisabledSFTPExtensions {
+		disabled[e] = true
+	}
+
+	return &extensionChannel{ReadWriteCloser: ch, fs: fs, extensions: c.sftpExtensions, disabled: disabled}
+}
+
+// A channel that only advertises the enabled extensions in the version packet sent to the client,
+// and renames disabled extensions in the requests it receives so that the SFTP library answers
+// them as unsupported rather than executing them. Requests for copyFileExtension are answered
+// by the channel itself and never reach the SFTP library.
+type extensionChannel struct {
+	io.ReadWriteCloser
+
+	fs         FileSystem
+	extensions []string
+	disabled   map[string]bool
+
+	// Held while writing a packet, since responses written by the channel must not be
+	// interleaved with those written by the SFTP library.
+	mu sync.Mutex
+
+	// The start of the packet currently being read that has been checked but not yet returned,
+	// and the number of bytes of the packet left to read after it.
+	pending   []byte
+	remaining uint32
+
+	once sync.Once
+}
+
+func (c *extensionChannel) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 && c.remaining == 0 {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+
+		return n, nil
+	}
+
+	if uint32(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	n, err := c.ReadWriteCloser.Read(b)
+	c.remaining -= uint32(n)
+
+	return n, err
+}
+
+// Reads the start of the next packet, which holds the name of the extension for extended
+// requests, renaming the extension if it is disabled. Requests that are answered by the channel
+// are consumed, and the packet after them is read instead.
+func (c *extensionChannel) next() error {
+	for {
+		header := make([]byte, 4, 4+9+maxExtensionName)
+		if _, err := io.ReadFull(c.ReadWriteCloser, header); err != nil {
+			return err
+		}
+
+		length := binary.BigEndian.Uint32(header)
+		peek := length
+		if peek > 9+maxExtensionName {
+			peek = 9 + maxExtensionName
+		}
+
+		b := header[:4+peek]
+		if _, err := io.ReadFull(c.ReadWriteCloser, b[4:]); err != nil {
+			return err
+		}
+
+		// An extended request starts with its type, id and the length of the extension name.
+		if peek >= 9 && b[4] == sftpPacketExtended {
+			l := binary.BigEndian.Uint32(b[9:13])
+			if l <= peek-9 && c.disabled[string(b[13:13+l])] {
+				for i := uint32(13); i < 13+l; i++ {
+					b[i] = '-'
+				}
+			} else if l <= peek-9 && string(b[13:13+l]) == copyFileExtension {
+				if err := c.copyFile(b[4:], length-peek); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		c.pending = b
+		c.remaining = length - peek
+
+		return nil
+	}
+}
+
+// Reads the rest of a copyFileExtension request, the start of which has already been read, and
+// copies the file it names. The response is written once the copy is complete.
+func (c *extensionChannel) copyFile(start []byte, remaining uint32) error {
+	id := binary.BigEndian.Uint32(start[1:5])
+	if remaining > maxExtensionRequest {
+		if _, err := io.CopyN(ioutil.Discard, c.ReadWriteCloser, int64(remaining)); err != nil {
+			return err
+		}
+
+		return c.writeStatus(id, sftpStatusBadMessage, "request is too large")
+	}
+
+	b := make([]byte, len(start), len(start)+int(remaining))
+	copy(b, start)
+	b = b[:len(b)+int(remaining)]
+	if _, err := io.ReadFull(c.ReadWriteCloser, b[len(start):]); err != nil {
+		return err
+	}
+
+	r := &packetReader{b: b[5:]}
+	r.string()
+	source := r.string()
+	target := r.string()
+	if r.bad || len(r.b) < 1 {
+		return c.writeStatus(id, sftpStatusBadMessage, "malformed copy-file request")
+	}
+
+	code, msg := copyFileStatus(c.fs.copyFileRequest(source, target, r.b[0] != 0))
+
+	return c.writeStatus(id, code, msg)
+}
+
+// Writes a status packet in response to the request with the given id.
+func (c *extensionChannel) writeStatus(id uint32, code uint32, msg string) error {
+	packet := make([]byte, 4, 64+len(msg))
+	packet = append(packet, sftpPacketStatus)
+	packet = appendUint32(packet, id)
+	packet = appendUint32(packet, code)
+	packet = appendString(packet, msg)
+	packet = appendString(packet, "")
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.ReadWriteCloser.Write(packet)
+
+	return err
+}
+
+// Replaces the extensions in the version packet, which is the first packet the SFTP library
+// writes and is always written in a single call.
+func (c *extensionChannel) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rewrite := false
+	c.once.Do(func() {
+		rewrite = len(b) >= 9 && b[4] == sftpPacketVersion
+	})
+
+	if !rewrite {
+		return c.ReadWriteCloser.Write(b)
+	}
+
+	packet := make([]byte, 4, 9+len(b))
+	packet = append(packet, b[4:9]...)
+	for _, e := range c.extensions {
+		packet = appendString(packet, e)
+		packet = appendString(packet, "1")
+	}
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+
+	if _, err := c.ReadWriteCloser.Write(packet); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Checks that the extension is supported by the server.
+func validateExtension(name string) error {
+	for _, e := range supportedSFTPExtensions {
+		if e == name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("sftp: unsupported sftp extension \"%s\"", name)
+}
+
+// Logs the protocol version and extensions requested by a client in its init packet along with
+// those the server responds with, which helps with debugging clients that misbehave with one of
+// the extensions.
+func (c Server) logNegotiation(s *session, b []byte) {
+	if len(b) == 0 || b[0] != 1 {
+		s.logger.Warnw("client did not start the sftp session with an init packet")
+		return
+	}
+
+	r := &packetReader{b: b[1:]}
+	version := r.uint32()
+
+	var extensions []string
+	for len(r.b) > 0 && !r.bad {
+		name := r.string()
+		r.string()
+		extensions = append(extensions, name)
+	}
+
+	fields := []interface{}{
+		zap.Uint32("client_version", version),
+		zap.Strings("client_extensions", extensions),
+		zap.Int("version", sftpProtocolVersion),
+		zap.Strings("extensions", c.sftpExtensions),
+	}
+
+	if version < sftpProtocolVersion {
+		s.logger.Warnw("client requested an older sftp protocol version than the server supports", fields...)
+		return
+	}
+
+	s.logger.Infow("negotiated sftp protocol version", fields...)
+}
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package sftp_server
+
+import (
+	"os"
+	"syscall"
+)
+
+// Opens the lock file at the given path and blocks until an exclusive lock is held on it. The
+// lock is released when the returned file is closed, or when the process exits.
+func acquireLock(p string) (*os.File, error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err == nil {
+			return f, nil
+		}
+
+		if err != syscall.EINTR {
+			f.Close()
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+import (
+	"errors"
+	"os"
+)
+
+func acquireLock(p string) (*os.File, error) {
+	return nil, errors.New("sftp: failover locks are not supported on this platform")
+}
@@ -0,0 +1,253 @@
+package sftp_server
+
+import (
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An option applied to a filesystem created using NewFileSystem.
+type Option func(fs *FileSystem)
+
+// Sets the server that the filesystem provides access to.
+func WithServer(uuid string) Option {
+	return func(fs *FileSystem) {
+		fs.UUID = uuid
+	}
+}
+
+// Sets the permissions the user has on the server, such as PermissionFileRead.
+func WithPermissions(permissions []string) Option {
+	return func(fs *FileSystem) {
+		fs.Permissions = permissions
+	}
+}
+
+// Sets the function used to determine if the server has disk space available for writes. When
+// not set, writes are never rejected for a lack of space.
+func WithQuota(hasDiskSpace func(fs FileSystem) bool) Option {
+	return func(fs *FileSystem) {
+		fs.HasDiskSpace = hasDiskSpace
+	}
+}
+
+// Sets the function used to resolve the paths requested by the client to a location on disk.
+// When not set, paths are resolved within the directory set with WithRoot.
+func WithPathValidator(validator func(fs FileSystem, p string) (string, error)) Option {
+	return func(fs *FileSystem) {
+		fs.PathValidator = validator
+	}
+}
+
+// Sets the directory that paths are resolved within when no PathValidator is set. Paths that
+// resolve outside of it, including through symlinks, are rejected with ErrPathEscape.
+func WithRoot(dir string) Option {
+	return func(fs *FileSystem) {
+		fs.root = dir
+	}
+}
+
+// Sets the backend used when reading and writing file contents, one of the IOBackend constants.
+func WithBackend(backend string) Option {
+	return func(fs *FileSystem) {
+		fs.IOBackend = backend
+	}
+}
+
+// Sets the user that files created on the filesystem are owned by.
+func WithUser(user SftpUser) Option {
+	return func(fs *FileSystem) {
+		fs.User = user
+	}
+}
+
+// Makes the filesystem read-only.
+func WithReadOnly() Option {
+	return func(fs *FileSystem) {
+		fs.ReadOnly = true
+	}
+}
+
+// Sets the logger used by the filesystem. Filesystems do not log anything by default.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(fs *FileSystem) {
+		fs.logger = logger
+	}
+}
+
+// Applies the behaviour configured in the server settings to the filesystem.
+func WithSettings(s Settings) Option {
+	return func(fs *FileSystem) {
+		fs.ReadOnly = fs.ReadOnly || s.ReadOnly
+		fs.IOBackend = s.IOBackend
+		fs.SELinuxContext = s.SELinuxContext
+		fs.Restorecon = s.Restorecon
+		fs.MaxOpenFiles = s.MaxOpenFiles
+		fs.PermissionNoticeThreshold = s.PermissionNoticeThreshold
+		fs.PathEscapeLimit = s.PathEscapeLimit
+		fs.RecordModifiedBy = s.RecordModifiedBy
+		fs.SymlinkPolicy = s.SymlinkPolicy
+		fs.PreserveOwnership = s.PreserveOwnership
+		fs.VerifyChecksums = s.VerifyUploadChecksums
+		fs.SkipUnchangedUploads = s.SkipUnchangedUploads
+		fs.CriticalFileAction = s.CriticalFileAction
+		fs.FileVersions = s.FileVersions
+		fs.MaxVersionsSize = s.MaxVersionsSize
+		fs.WriteValidationErrors = s.WriteValidationErrors
+		fs.UsageExclusions = s.UsageExclusions
+		fs.QuarantineThreshold = s.QuarantineThreshold
+	}
+}
+
+// Applies the restrictions returned by the Panel for the session to the filesystem, and sets the
+// user that files are owned by to the one returned for the server if there is one.
+func withPanelPermissions(perm *ssh.Permissions) Option {
+	return func(fs *FileSystem) {
+		fs.ReadOnly = fs.ReadOnly || perm.Extensions["read_only"] == "true"
+		fs.Deleted = perm.Extensions["deleted"] == "true"
+		fs.PreviewMessage = perm.Extensions["preview"]
+
+		if uid, err := strconv.Atoi(perm.Extensions["uid"]); err == nil {
+			if gid, err := strconv.Atoi(perm.Extensions["gid"]); err == nil {
+				fs.User = SftpUser{Uid: uid, Gid: gid}
+			}
+		}
+	}
+}
+
+// Associates the filesystem with the session it serves, and the channel within that session.
+func withSession(s *session, stats *transferStats, events func(e Event)) Option {
+	return func(fs *FileSystem) {
+		fs.session = s
+		fs.stats = stats
+		fs.events = events
+		fs.transport = &transport{}
+	}
+}
+
+// Shares the state kept by the server, such as its cache, write locks and change journal, with
+// the filesystem, and applies the hooks the server was configured with for the filesystem's
+// server. This must come after the options setting the server and user.
+func (c Server) withServerState() Option {
+	return func(fs *FileSystem) {
+		fs.Cache = c.cache
+		fs.metrics = c.metrics
+		fs.locks = c.locks
+		fs.disk = c.disk
+		fs.journal = c.journal
+		fs.versions = c.versions
+		fs.watches = c.watches
+		fs.middleware = c.Middleware
+		fs.UsageSource = c.DiskUsageSource
+		fs.QuarantineScanner = c.QuarantineScanner
+
+		if c.LineEndingExtensions != nil {
+			fs.LineEndingExtensions = c.LineEndingExtensions(fs.UUID)
+		}
+
+		if c.Watermarks != nil {
+			fs.Watermarks = c.Watermarks(fs.UUID)
+		}
+
+		if c.CriticalFiles != nil {
+			fs.CriticalFiles = c.CriticalFiles(fs.UUID)
+		}
+
+		if c.FileValidators != nil {
+			fs.FileValidators = c.FileValidators(fs.UUID)
+		}
+
+		if c.IDMapping != nil {
+			if m, err := c.IDMapping(fs.UUID); err != nil {
+				fs.logger.Warnw("failed to load user namespace mapping for server", zap.Error(err))
+			} else {
+				fs.User = m.apply(fs.User)
+			}
+		}
+	}
+}
+
+// Creates a new filesystem using the given options. Filesystems must be created using this
+// function rather than directly, since it initializes the internal state that the filesystem
+// depends on.
+func NewFileSystem(opts ...Option) FileSystem {
+	fs := FileSystem{
+		lock:   &sync.Mutex{},
+		logger: zap.NewNop().Sugar(),
+	}
+
+	for _, opt := range opts {
+		opt(&fs)
+	}
+
+	if fs.HasDiskSpace == nil {
+		fs.HasDiskSpace = func(fs FileSystem) bool {
+			return true
+		}
+	}
+
+	if fs.PathValidator == nil {
+		fs.PathValidator = resolveInRoot
+	}
+
+	return fs
+}
+
+// Resolves a path requested by the client within the directory set using WithRoot, following
+// any symlinks in the parts of the path that exist.
+func resolveInRoot(fs FileSystem, p string) (string, error) {
+	if fs.root == "" {
+		return "", ErrPathEscape
+	}
+
+	root, err := filepath.EvalSymlinks(fs.root)
+	if err != nil {
+		return "", err
+	}
+
+	full, err := evalExisting(filepath.Join(root, filepath.Clean("/"+p)))
+	if err != nil {
+		return "", err
+	}
+
+	if rel, err := filepath.Rel(root, full); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrPathEscape
+	}
+
+	return full, nil
+}
+
+// Follows any symlinks in the path. The file being created may not exist yet, so the deepest
+// part of the path that does is resolved and the rest is added back on to it.
+func evalExisting(p string) (string, error) {
+	existing, rest := p, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		} else if !os.IsNotExist(err) || existing == filepath.Dir(existing) {
+			return "", err
+		}
+
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+}
+
+// Returns the SFTP handlers serving requests using the filesystem. Panics while handling a
+// request are recovered from, closing the session the filesystem belongs to if it has one.
+func (fs FileSystem) Handlers() sftp.Handlers {
+	h := recoveryHandler{fs: fs, session: fs.session, metrics: fs.metrics}
+
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
@@ -9,5 +9,6 @@ require (
 	github.com/stretchr/testify v1.6.1 // indirect
 	go.uber.org/zap v1.15.0
 	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
-	golang.org/x/sys v0.0.0-20200806125547-5acd03effb82 // indirect
+	golang.org/x/sys v0.0.0-20200806125547-5acd03effb82
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,143 @@
+package sftp_server
+
+import (
+	"bytes"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// The actions that can be taken when a critical file is replaced with something that looks
+// like the wrong file.
+const (
+	// The upload is allowed, but a warning is logged and an event is emitted.
+	CriticalFileActionWarn = "warn"
+	// The upload is rejected and the existing file is left in place.
+	CriticalFileActionBlock = "block"
+)
+
+// Returned when an upload that would replace a critical file is rejected.
+var ErrCriticalFileRejected = errors.New("sftp: upload rejected, it does not look like a valid replacement for this file")
+
+// The number of bytes read from the start of a file to determine if it is binary.
+const binarySniffSize = 8192
+
+// Determines if the path requested by the client matches one of the critical file patterns for
+// the server.
+func (fs FileSystem) isCriticalFile(name string) bool {
+	for _, pattern := range fs.CriticalFiles {
+		if matchesFilePattern(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks an upload that is about to replace a critical file, catching a user accidentally
+// uploading the wrong file over something like server.properties. An upload is considered
+// suspicious if it turns a text file into a binary one, or if its size is drastically different
+// from the file it replaces.
+func (fs FileSystem) guardCriticalFile(f *uploadFile, existing os.FileInfo) error {
+	return fs.guardReplacement(f.name, f.path, f.tmp, existing)
+}
+
+// Checks a file that is about to be renamed over a critical file in the same way as an upload,
+// since many clients upload to a temporary name and rename the upload into place once it is
+// complete.
+func (fs FileSystem) guardRename(name string, p string, source string) error {
+	existing, err := os.Stat(p)
+	if err != nil || !existing.Mode().IsRegular() {
+		return nil
+	}
+
+	return fs.guardReplacement(name, p, source, existing)
+}
+
+// Checks the file at replacement that is about to replace the critical file at p, which the
+// client knows as name.
+func (fs FileSystem) guardReplacement(name string, p string, replacement string, existing os.FileInfo) error {
+	if existing == nil || !fs.isCriticalFile(name) {
+		return nil
+	}
+
+	uploaded, err := os.Stat(replacement)
+	if err != nil || !uploaded.Mode().IsRegular() {
+		return nil
+	}
+
+	var reason string
+	if !isBinaryFile(p) && isBinaryFile(replacement) {
+		reason = "file became binary"
+	} else if drasticSizeChange(existing.Size(), uploaded.Size()) {
+		reason = "file size changed drastically"
+	} else {
+		return nil
+	}
+
+	fs.logger.Warnw("suspicious upload replacing critical file",
+		zap.String("file", p),
+		zap.String("reason", reason),
+		zap.Int64("previous_size", existing.Size()),
+		zap.Int64("size", uploaded.Size()),
+	)
+	fs.emit(EventCriticalFileChanged, name, reason)
+	if fs.metrics != nil {
+		fs.metrics.Inc("critical_file_warnings_total")
+	}
+
+	if fs.CriticalFileAction == CriticalFileActionBlock {
+		return fs.deny(DenialProtected, name, ErrCriticalFileRejected)
+	}
+
+	return nil
+}
+
+// Determines if a file size has changed by enough that the new file is probably not a version
+// of the old one. Small files are ignored since their size naturally varies a lot.
+func drasticSizeChange(before int64, after int64) bool {
+	if before < 1024 && after < 1024 {
+		return false
+	}
+
+	return after*4 < before || after > before*4
+}
+
+// Determines if the file at the given path contains binary data by checking the start of it
+// for NUL bytes or invalid UTF-8.
+func isBinaryFile(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	b := make([]byte, binarySniffSize)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false
+	}
+	b = b[:n]
+
+	if bytes.IndexByte(b, 0) != -1 {
+		return true
+	}
+
+	if utf8.Valid(b) {
+		return false
+	}
+
+	// The sniffed data may end part way through a multi-byte character, which is not a sign
+	// that the file is binary.
+	if n == binarySniffSize {
+		for i := 1; i < utf8.UTFMax; i++ {
+			if utf8.Valid(b[:n-i]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
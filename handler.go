@@ -8,25 +8,154 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type FileSystem struct {
-	UUID        string
-	Permissions []string
-	ReadOnly    bool
-	User        SftpUser
-	Cache       *cache.Cache
+	UUID                      string
+	Permissions               []string
+	ReadOnly                  bool
+	Deleted                   bool
+	PreviewMessage            string
+	IOBackend                 string
+	MaxOpenFiles              int
+	PermissionNoticeThreshold int
+	RecordModifiedBy          bool
+	SymlinkPolicy             string
+	PreserveOwnership         bool
+	VerifyChecksums           bool
+	SkipUnchangedUploads      bool
+	LineEndingExtensions      []string
+	CriticalFiles             []string
+	CriticalFileAction        string
+	FileVersions              int
+	MaxVersionsSize           int64
+	FileValidators            map[string]FileValidator
+	WriteValidationErrors     bool
+	Watermarks                map[string]string
+	UsageExclusions           []string
+	QuarantineThreshold       int64
+	PathEscapeLimit           int
+	SELinuxContext            string
+	Restorecon                bool
+	User                      SftpUser
+	Cache                     *cache.Cache
 
 	PathValidator func(fs FileSystem, p string) (string, error)
 	HasDiskSpace  func(fs FileSystem) bool
-
-	logger *zap.SugaredLogger
-	lock   sync.Mutex
+	UsageSource   func(server string) (int64, error)
+
+	QuarantineScanner func(server string, name string, p string) error
+
+	root    string
+	logger  *zap.SugaredLogger
+	lock    *sync.Mutex
+	stats   *transferStats
+	metrics *Metrics
+
+	locks      *writeLocks
+	disk       *diskGuard
+	journal    *changeJournal
+	versions   *versionUsage
+	watches    *watchLimits
+	session    *session
+	transport  *transport
+	requestID  string
+	events     func(e Event)
+	middleware []Middleware
 }
 
 func (fs FileSystem) buildPath(p string) (string, error) {
-	return fs.PathValidator(fs, p)
+	resolved, err := fs.PathValidator(fs, p)
+	if err != nil && isPathEscape(err) {
+		fs.pathEscape(p, err)
+	}
+
+	return resolved, err
+}
+
+// The extended attribute used to record which Panel user last modified a file.
+const XattrModifiedBy = "user.pterodactyl.modified_by"
+
+// Records the Panel user for the current session as the last user to have modified the file
+// at the given path, if enabled for the server. Not all filesystems support extended attributes
+// so failures are not treated as fatal.
+func (fs FileSystem) recordModifiedBy(p string) {
+	if !fs.RecordModifiedBy || fs.session == nil {
+		return
+	}
+
+	if err := setxattr(p, XattrModifiedBy, []byte(fs.session.user)); err != nil {
+		fs.logger.Debugw("failed to record modifying user on file", zap.String("file", p), zap.Error(err))
+	}
+}
+
+// The policies that control the creation of symlinks by users.
+const (
+	// Symlinks may not be created at all.
+	SymlinkPolicyDeny = "deny"
+	// Symlinks may only point to locations within the server's root directory and are always
+	// written as relative paths. This is the default policy.
+	SymlinkPolicyInRoot = "in-root"
+	// Symlinks are written as the absolute path to their target on the host.
+	SymlinkPolicyAllow = "allow"
+)
+
+const (
+	IOBackendStandard = "standard"
+	IOBackendUring    = "io_uring"
+)
+
+// The file type returned to the SFTP request server for reads and writes.
+type backendFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// Returns the opened file using the I/O backend configured for the server. If the backend
+// cannot be used on this system the standard file is returned instead. The name is the path
+// of the file relative to the server's root, which is used when recording the transfer.
+func (fs FileSystem) withBackend(name string, f *os.File) backendFile {
+	var bf backendFile = f
+	if fs.IOBackend == IOBackendUring {
+		if uf, err := newUringFile(f); err != nil {
+			fs.logger.Debugw("io_uring backend unavailable, falling back to standard I/O", zap.Error(err))
+		} else {
+			bf = uf
+		}
+	}
+
+	if fs.session != nil {
+		bf = activeFile{backendFile: bf, done: fs.session.begin()}
+	}
+
+	if fs.stats == nil {
+		return bf
+	}
+	atomic.AddInt64(&fs.stats.open, 1)
+
+	return countingFile{backendFile: bf, name: name, stats: fs.stats, counts: &fileCounts{}}
+}
+
+// Determines if the channel has reached the maximum number of files it may have open at
+// once. Filesystems without transfer stats are not used by a channel and are never limited.
+// This must be called while holding the filesystem lock so that the check and the
+// following call to withBackend cannot race with another request.
+func (fs FileSystem) tooManyOpenFiles() bool {
+	if fs.stats == nil || fs.MaxOpenFiles <= 0 {
+		return false
+	}
+
+	if atomic.LoadInt64(&fs.stats.open) >= int64(fs.MaxOpenFiles) {
+		fs.logger.Warn("session has reached the maximum number of open files")
+		return true
+	}
+
+	return false
 }
 
 const (
@@ -39,21 +168,38 @@ const (
 
 // Fileread creates a reader for a file on the system and returns the reader back.
 func (fs FileSystem) Fileread(request *sftp.Request) (io.ReaderAt, error) {
-	// Check first if the user can actually open and view a file. This permission is named
-	// really poorly, but it is checking if they can read. There is an addition permission,
-	// "save-files" which determines if they can write that file.
+	if err := fs.runMiddleware(request.Method, request.Filepath, request.Target); err != nil {
+		return nil, err
+	}
+
+	// Check first if the user can actually open and view a file. Reading the contents of a
+	// file only requires the read-content permission, it is entirely separate from the update
+	// permission which determines if they can write to that file. This allows subusers to be
+	// given download-only access to a server.
 	if !fs.can(PermissionFileReadContent) {
-		return nil, sftp.ErrSshFxPermissionDenied
+		return nil, fs.permissionDenied(PermissionFileReadContent, request.Filepath)
+	}
+
+	if fs.isIgnored(request.Filepath) {
+		return nil, sftp.ErrSshFxNoSuchFile
 	}
 
 	p, err := fs.buildPath(request.Filepath)
 	if err != nil {
-		return nil, sftp.ErrSshFxNoSuchFile
+		return nil, resolveError(err)
 	}
 
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
+	if fs.tooManyOpenFiles() {
+		return nil, sftp.ErrSshFxFailure
+	}
+
+	if fs.session != nil && fs.session.isDraining() {
+		return nil, ErrSessionClosing
+	}
+
 	if _, err := os.Stat(p); os.IsNotExist(err) {
 		return nil, sftp.ErrSshFxNoSuchFile
 	}
@@ -64,29 +210,64 @@ func (fs FileSystem) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		return nil, sftp.ErrSshFxFailure
 	}
 
-	return file, nil
+	if format, ok := fs.watermarkFormat(request.Filepath); ok {
+		return fs.withWatermark(fs.withBackend(request.Filepath, file), file, format), nil
+	}
+
+	return fs.withBackend(request.Filepath, file), nil
 }
 
 // Filewrite handles the write actions for a file on the system.
 func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
-	if fs.ReadOnly {
-		return nil, sftp.ErrSshFxOpUnsupported
+	if err := fs.runMiddleware(request.Method, request.Filepath, request.Target); err != nil {
+		return nil, err
+	}
+
+	if fs.isReadOnly() {
+		return nil, fs.readOnlyError(request.Filepath)
+	}
+
+	done, ok := fs.locks.begin(fs.UUID)
+	if !ok {
+		return nil, fs.readOnlyError(request.Filepath)
+	}
+	defer done()
+
+	// Previous versions of files and quarantined uploads may be downloaded but never modified.
+	if isVersionsPath(request.Filepath) || isQuarantinePath(request.Filepath) {
+		return nil, ErrPermissionDenied
+	}
+
+	if fs.isIgnored(request.Filepath) {
+		return nil, ErrPermissionDenied
 	}
 
 	p, err := fs.buildPath(request.Filepath)
 	if err != nil {
-		return nil, sftp.ErrSshFxNoSuchFile
+		return nil, resolveError(err)
+	}
+
+	if fs.inQuarantine(p) {
+		return nil, ErrPermissionDenied
 	}
 
 	// If the user doesn't have enough space left on the server it should respond with an
 	// error since we won't be letting them write this file to the disk.
 	if !fs.HasDiskSpace(fs) {
-		return nil, ErrSshQuotaExceeded
+		return nil, fs.deny(DenialQuota, request.Filepath, ErrQuotaExceeded)
 	}
 
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
+	if fs.tooManyOpenFiles() {
+		return nil, sftp.ErrSshFxFailure
+	}
+
+	if fs.session != nil && fs.session.isDraining() {
+		return nil, ErrSessionClosing
+	}
+
 	stat, statErr := os.Stat(p)
 	// If the file doesn't exist we need to create it, as well as the directory pathway
 	// leading up to where that file will be created.
@@ -94,7 +275,7 @@ func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		// This is a different pathway than just editing an existing file. If it doesn't exist already
 		// we need to determine if this user has permission to create files.
 		if !fs.can(PermissionFileCreate) {
-			return nil, sftp.ErrSshFxPermissionDenied
+			return nil, fs.permissionDenied(PermissionFileCreate, request.Filepath)
 		}
 
 		// Create all of the directories leading up to the location where this file is being created.
@@ -107,6 +288,20 @@ func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 			return nil, sftp.ErrSshFxFailure
 		}
 
+		// Large uploads are written to the quarantine directory so that they never appear in
+		// place partially written. The file is created once the upload is complete instead.
+		if fs.quarantines(request.Filepath) {
+			file, err := fs.createQuarantined()
+			if err != nil {
+				fs.logger.Errorw("error creating quarantine file for upload", zap.String("source", p), zap.Error(err))
+				return nil, sftp.ErrSshFxFailure
+			}
+
+			fs.emit(EventWrite, request.Filepath, "")
+
+			return fs.withTimes(fs.withWriteLock(fs.withMiddleware(withQuarantine(fs.withUpload(fs.withBackend(request.Filepath, file), p, request.Filepath, file.Name())), request.Filepath, p)), p), nil
+		}
+
 		file, err := os.Create(p)
 		if err != nil {
 			fs.logger.Errorw("error creating file", zap.String("source", p), zap.Error(err))
@@ -119,7 +314,11 @@ func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 			fs.logger.Warnw("error chowning file", zap.String("file", p), zap.Error(err))
 		}
 
-		return file, nil
+		fs.relabel(p)
+		fs.recordModifiedBy(p)
+		fs.emit(EventWrite, request.Filepath, "")
+
+		return fs.withTimes(fs.withWriteLock(fs.withMiddleware(fs.withUpload(fs.withBackend(request.Filepath, file), p, request.Filepath, ""), request.Filepath, p)), p), nil
 	}
 
 	// If the stat error isn't about the file not existing, there is some other issue
@@ -135,7 +334,7 @@ func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	//
 	// But first, check that the user has permission to save modified files.
 	if !fs.can(PermissionFileUpdate) {
-		return nil, sftp.ErrSshFxPermissionDenied
+		return nil, fs.permissionDenied(PermissionFileUpdate, request.Filepath)
 	}
 
 	// Not sure this would ever happen, but lets not find out.
@@ -144,6 +343,47 @@ func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		return nil, sftp.ErrSshFxOpUnsupported
 	}
 
+	if fs.quarantines(request.Filepath) && request.Pflags().Trunc {
+		file, err := fs.createQuarantined()
+		if err != nil {
+			fs.logger.Errorw("error creating quarantine file for upload", zap.String("source", p), zap.Error(err))
+			return nil, sftp.ErrSshFxFailure
+		}
+
+		fs.emit(EventWrite, request.Filepath, "")
+
+		return fs.withTimes(fs.withWriteLock(fs.withMiddleware(withQuarantine(fs.withUpload(fs.withBackend(request.Filepath, file), p, request.Filepath, file.Name())), request.Filepath, p)), p), nil
+	}
+
+	// When skipping unchanged uploads the new contents are written to a temporary file so that
+	// the existing file can be left untouched if the client uploads the same contents again. The
+	// same is done for every write to a critical file so that a suspicious upload can be
+	// rejected. Opens that do not truncate the file only rewrite part of it, so the temporary
+	// file starts out with a copy of the existing contents. The ownership of the file is set
+	// once it replaces the existing one.
+	if (fs.SkipUnchangedUploads && request.Pflags().Trunc) || fs.isCriticalFile(request.Filepath) {
+		file, err := ioutil.TempFile(filepath.Dir(p), uploadTempPattern(p))
+		if err != nil {
+			fs.logger.Errorw("error creating temporary file for upload", zap.String("source", p), zap.Error(err))
+			return nil, sftp.ErrSshFxFailure
+		}
+
+		if !request.Pflags().Trunc {
+			if err := copyExisting(file, p); err != nil {
+				fs.logger.Errorw("error copying file for upload", zap.String("source", p), zap.Error(err))
+				file.Close()
+				os.Remove(file.Name())
+				return nil, sftp.ErrSshFxFailure
+			}
+		}
+
+		fs.emit(EventWrite, request.Filepath, "")
+
+		return fs.withTimes(fs.withWriteLock(fs.withMiddleware(fs.withUpload(fs.withBackend(request.Filepath, file), p, request.Filepath, file.Name()), request.Filepath, p)), p), nil
+	}
+
+	fs.saveVersion(request.Filepath, p)
+
 	file, err := os.Create(p)
 	if err != nil {
 		fs.logger.Errorw("error opening existing file",
@@ -155,65 +395,136 @@ func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	}
 
 	// Not failing here is intentional. We still made the file, it is just owned incorrectly
-	// and will likely cause some issues.
-	if err := os.Chown(p, fs.User.Uid, fs.User.Gid); err != nil {
-		fs.logger.Warnw("error chowning file", zap.String("file", p), zap.Error(err))
+	// and will likely cause some issues. When ownership is being preserved the file is left
+	// owned by whoever owned it before it was edited.
+	if !fs.PreserveOwnership {
+		if err := os.Chown(p, fs.User.Uid, fs.User.Gid); err != nil {
+			fs.logger.Warnw("error chowning file", zap.String("file", p), zap.Error(err))
+		}
 	}
 
-	return file, nil
+	fs.recordModifiedBy(p)
+	fs.emit(EventWrite, request.Filepath, "")
+
+	return fs.withTimes(fs.withWriteLock(fs.withMiddleware(fs.withUpload(fs.withBackend(request.Filepath, file), p, request.Filepath, ""), request.Filepath, p)), p), nil
 }
 
 // Filecmd hander for basic SFTP system calls related to files, but not anything to do with reading
 // or writing to those files.
 func (fs FileSystem) Filecmd(request *sftp.Request) error {
-	if fs.ReadOnly {
-		return sftp.ErrSshFxOpUnsupported
+	if err := fs.runMiddleware(request.Method, request.Filepath, request.Target); err != nil {
+		return err
+	}
+
+	if fs.isReadOnly() {
+		return fs.readOnlyError(request.Filepath)
+	}
+
+	done, ok := fs.locks.begin(fs.UUID)
+	if !ok {
+		return fs.readOnlyError(request.Filepath)
+	}
+	defer done()
+
+	if isVersionsPath(request.Filepath) || (request.Target != "" && isVersionsPath(request.Target)) {
+		return ErrPermissionDenied
+	}
+
+	if isQuarantinePath(request.Filepath) || (request.Target != "" && isQuarantinePath(request.Target)) {
+		return ErrPermissionDenied
+	}
+
+	if fs.isIgnored(request.Filepath) {
+		return sftp.ErrSshFxNoSuchFile
+	}
+
+	if request.Target != "" && fs.isIgnored(request.Target) {
+		return ErrPermissionDenied
 	}
 
 	p, err := fs.buildPath(request.Filepath)
 	if err != nil {
-		return sftp.ErrSshFxNoSuchFile
+		return resolveError(err)
 	}
 
 	var target string
 	// If a target is provided in this request validate that it is going to the correct
-	// location for the server. If it is not, return an operation unsupported error. This
-	// is maybe not the best error response, but its not wrong either.
+	// location for the server.
 	if request.Target != "" {
 		target, err = fs.buildPath(request.Target)
 		if err != nil {
-			return sftp.ErrSshFxOpUnsupported
+			return resolveError(err)
 		}
 	}
 
+	if fs.inQuarantine(p) || (target != "" && fs.inQuarantine(target)) {
+		return ErrPermissionDenied
+	}
+
 	switch request.Method {
 	case "Setstat":
 		if !fs.can(PermissionFileUpdate) {
-			return sftp.ErrSshFxPermissionDenied
+			return fs.permissionDenied(PermissionFileUpdate, request.Filepath)
 		}
 
-		var mode os.FileMode = 0644
-		// If the client passed a valid file permission use that, otherwise use the
-		// default of 0644 set above.
-		if request.Attributes().FileMode().Perm() != 0000 {
-			mode = request.Attributes().FileMode().Perm()
-		}
+		flags := request.AttrFlags()
+		attrs := request.Attributes()
+
+		// Only change the permissions of the file if the client actually sent them, clients
+		// will commonly send a Setstat that only contains the times for a file.
+		if flags.Permissions {
+			var mode os.FileMode = 0644
+			// If the client passed a valid file permission use that, otherwise use the
+			// default of 0644 set above.
+			if attrs.FileMode().Perm() != 0000 {
+				mode = attrs.FileMode().Perm()
+			}
 
-		// Force directories to be 0755
-		if request.Attributes().FileMode().IsDir() {
-			mode = 0755
+			// Force directories to be 0755
+			if attrs.FileMode().IsDir() {
+				mode = 0755
+			}
+
+			if err := os.Chmod(p, mode); err != nil {
+				fs.logger.Errorw("failed to perform setstat", zap.Error(err))
+				return sftp.ErrSshFxFailure
+			}
 		}
 
-		if err := os.Chmod(p, mode); err != nil {
-			fs.logger.Errorw("failed to perform setstat", zap.Error(err))
-			return sftp.ErrSshFxFailure
+		if flags.Acmodtime {
+			atime := time.Unix(int64(attrs.Atime), 0)
+			mtime := time.Unix(int64(attrs.Mtime), 0)
+
+			if err := os.Chtimes(p, atime, mtime); err != nil {
+				fs.logger.Errorw("failed to set file times", zap.String("source", p), zap.Error(err))
+				return sftp.ErrSshFxFailure
+			}
+
+			// If the file is still open for writing these will be applied again once it is closed.
+			if fs.stats != nil {
+				fs.stats.storeTimes(p, atime, mtime)
+			}
 		}
+
+		fs.emit(EventSetstat, request.Filepath, "")
 		return nil
 	case "Rename":
 		if !fs.can(PermissionFileUpdate) {
-			return sftp.ErrSshFxPermissionDenied
+			return fs.permissionDenied(PermissionFileUpdate, request.Filepath)
+		}
+
+		// Moving a directory would reveal the paths within it that are hidden by their
+		// location, so only the owner is able to.
+		if fs.containsIgnored(request.Filepath) {
+			return ErrPermissionDenied
+		}
+
+		if err := fs.guardRename(request.Target, target, p); err != nil {
+			return err
 		}
 
+		fs.saveVersion(request.Target, target)
+
 		if err := os.Rename(p, target); err != nil {
 			fs.logger.Errorw("failed to rename file",
 				zap.String("source", p),
@@ -223,21 +534,31 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.recordModifiedBy(target)
+		fs.emit(EventRename, request.Filepath, request.Target)
 		break
 	case "Rmdir":
 		if !fs.can(PermissionFileDelete) {
-			return sftp.ErrSshFxPermissionDenied
+			return fs.permissionDenied(PermissionFileDelete, request.Filepath)
+		}
+
+		if fs.containsIgnored(request.Filepath) {
+			return ErrPermissionDenied
 		}
 
+		fs.saveDirectoryVersions(request.Filepath, p)
+
 		if err := os.RemoveAll(p); err != nil {
 			fs.logger.Errorw("failed to remove directory", zap.String("source", p), zap.Error(err))
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.emit(EventDelete, request.Filepath, "")
+
 		return sftp.ErrSshFxOk
 	case "Mkdir":
 		if !fs.can(PermissionFileCreate) {
-			return sftp.ErrSshFxPermissionDenied
+			return fs.permissionDenied(PermissionFileCreate, request.Filepath)
 		}
 
 		if err := os.MkdirAll(p, 0755); err != nil {
@@ -245,13 +566,32 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.recordModifiedBy(p)
+		fs.emit(EventCreateDirectory, request.Filepath, "")
+
 		break
 	case "Symlink":
 		if !fs.can(PermissionFileCreate) {
-			return sftp.ErrSshFxPermissionDenied
+			return fs.permissionDenied(PermissionFileCreate, request.Filepath)
+		}
+
+		if fs.SymlinkPolicy == SymlinkPolicyDeny {
+			return ErrPermissionDenied
+		}
+
+		// Unless symlinks are allowed freely, write the link as a path relative to its location
+		// so that it continues to resolve within the server's root when the directory is mounted
+		// elsewhere, such as inside of the server's container.
+		source := p
+		if fs.SymlinkPolicy != SymlinkPolicyAllow {
+			rel, err := filepath.Rel(filepath.Dir(target), p)
+			if err != nil {
+				return sftp.ErrSshFxOpUnsupported
+			}
+			source = rel
 		}
 
-		if err := os.Symlink(p, target); err != nil {
+		if err := os.Symlink(source, target); err != nil {
 			fs.logger.Errorw("failed to create symlink",
 				zap.String("source", p),
 				zap.String("target", target),
@@ -260,12 +600,15 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.emit(EventCreateSymlink, request.Filepath, request.Target)
 		break
 	case "Remove":
 		if !fs.can(PermissionFileDelete) {
-			return sftp.ErrSshFxPermissionDenied
+			return fs.permissionDenied(PermissionFileDelete, request.Filepath)
 		}
 
+		fs.saveVersion(request.Filepath, p)
+
 		if err := os.Remove(p); err != nil {
 			if !os.IsNotExist(err) {
 				fs.logger.Errorw("failed to remove a file", zap.String("source", p), zap.Error(err))
@@ -273,6 +616,8 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.emit(EventDelete, request.Filepath, "")
+
 		return sftp.ErrSshFxOk
 	default:
 		return sftp.ErrSshFxOpUnsupported
@@ -283,6 +628,11 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 		fileLocation = target
 	}
 
+	// A renamed file is still the same file, leave its owner alone if ownership is preserved.
+	if fs.PreserveOwnership && request.Method == "Rename" {
+		return sftp.ErrSshFxOk
+	}
+
 	// Not failing here is intentional. We still made the file, it is just owned incorrectly
 	// and will likely cause some issues. There is no logical check for if the file was removed
 	// because both of those cases (Rmdir, Remove) have an explicit return rather than break.
@@ -290,21 +640,32 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 		fs.logger.Warnw("error chowning file", zap.String("file", fileLocation), zap.Error(err))
 	}
 
+	fs.relabel(fileLocation)
+
 	return sftp.ErrSshFxOk
 }
 
 // Filelist is the handler for SFTP filesystem list calls. This will handle calls to list the contents of
 // a directory as well as perform file/folder stat calls.
 func (fs FileSystem) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	if err := fs.runMiddleware(request.Method, request.Filepath, request.Target); err != nil {
+		return nil, err
+	}
+
 	p, err := fs.buildPath(request.Filepath)
 	if err != nil {
+		return nil, resolveError(err)
+	}
+
+	// Paths hidden by the server's ignore file are treated as if they do not exist.
+	if fs.isIgnored(request.Filepath) {
 		return nil, sftp.ErrSshFxNoSuchFile
 	}
 
 	switch request.Method {
 	case "List":
 		if !fs.can(PermissionFileRead) {
-			return nil, sftp.ErrSshFxPermissionDenied
+			return nil, fs.permissionDenied(PermissionFileRead, request.Filepath)
 		}
 
 		files, err := ioutil.ReadDir(p)
@@ -313,10 +674,13 @@ func (fs FileSystem) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 			return nil, sftp.ErrSshFxFailure
 		}
 
-		return ListerAt(files), nil
+		return ListerAt(hideUploadTempFiles(fs.filterIgnored(request.Filepath, files))), nil
 	case "Stat":
-		if !fs.can(PermissionFileRead) {
-			return nil, sftp.ErrSshFxPermissionDenied
+		// Clients will stat a file before downloading it, so users that are only able to download
+		// files must also be able to stat them. Directories can only be stat'd by users that are
+		// able to list files since that reveals the contents of the server.
+		if !fs.can(PermissionFileRead) && !fs.can(PermissionFileReadContent) {
+			return nil, fs.permissionDenied(PermissionFileRead, request.Filepath)
 		}
 
 		s, err := os.Stat(p)
@@ -327,6 +691,10 @@ func (fs FileSystem) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 			return nil, sftp.ErrSshFxFailure
 		}
 
+		if s.IsDir() && !fs.can(PermissionFileRead) {
+			return nil, fs.permissionDenied(PermissionFileRead, request.Filepath)
+		}
+
 		return ListerAt([]os.FileInfo{s}), nil
 	default:
 		// Before adding readlink support we need to evaluate any potential security risks
@@ -341,20 +709,42 @@ func (fs FileSystem) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 // Determines if a user has permission to perform a specific action on the SFTP server. These
 // permissions are defined and returned by the Panel API.
 func (fs FileSystem) can(permission string) bool {
+	// Permissions can be updated by the Panel while a session is active, so always prefer
+	// the current permissions for the session over those assigned when it was created.
+	permissions := fs.Permissions
+	if fs.session != nil {
+		permissions = fs.session.getPermissions()
+	}
+
 	// Server owners and super admins have their permissions returned as '[*]' via the Panel
 	// API, so for the sake of speed do an initial check for that before iterating over the
 	// entire array of permissions.
-	if len(fs.Permissions) == 1 && fs.Permissions[0] == "*" {
+	if len(permissions) == 1 && permissions[0] == "*" {
 		return true
 	}
 
 	// Not the owner or an admin, loop over the permissions that were returned to determine
 	// if they have the passed permission.
-	for _, p := range fs.Permissions {
-		if p == permission {
+	for _, p := range permissions {
+		if matchesPermission(p, permission) {
 			return true
 		}
 	}
 
 	return false
 }
+
+// Determines if a permission granted by the Panel matches the permission being checked. A
+// granted permission may end in a wildcard to grant every permission within that namespace,
+// for example "file.*" matches both "file.read" and "file.read-content".
+func matchesPermission(granted string, permission string) bool {
+	if granted == permission || granted == "*" {
+		return true
+	}
+
+	if strings.HasSuffix(granted, ".*") {
+		return strings.HasPrefix(permission, strings.TrimSuffix(granted, "*"))
+	}
+
+	return false
+}
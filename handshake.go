@@ -0,0 +1,93 @@
+package sftp_server
+
+import (
+	"bytes"
+	"errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strings"
+)
+
+// The classes of SSH handshake failure reported in metrics and logs, allowing hosts to tell
+// scanners and attacks apart from real clients that are unable to connect.
+const (
+	// The client disconnected without sending anything, typically a scanner grabbing the banner.
+	HandshakeFailureScanner = "scanner"
+	// The client sent something other than SSH, or a malformed SSH version or packet.
+	HandshakeFailureProtocol = "protocol"
+	// The client and server could not agree on the algorithms to use for the connection.
+	HandshakeFailureKex = "kex"
+	// The client failed to authenticate.
+	HandshakeFailureAuth = "auth"
+	// The client did not complete the handshake within the handshake timeout.
+	HandshakeFailureTimeout = "auth-timeout"
+	// The client disconnected part way through the handshake.
+	HandshakeFailureDisconnect = "disconnect"
+	HandshakeFailureOther      = "other"
+)
+
+// Wraps a connection during the SSH handshake, recording the first bytes sent by the client so
+// that handshake failures can be classified.
+type handshakeConn struct {
+	net.Conn
+	read  int
+	first []byte
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if len(c.first) < 4 {
+		c.first = append(c.first, b[:min(n, 4-len(c.first))]...)
+	}
+	c.read += n
+
+	return n, err
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// Determines the class of a failed SSH handshake from the error and the data sent by the client.
+func classifyHandshakeError(c *handshakeConn, err error) string {
+	var ne net.Error
+	var authErr *ssh.ServerAuthError
+	msg := err.Error()
+
+	switch {
+	case c.read == 0:
+		return HandshakeFailureScanner
+	case !bytes.HasPrefix([]byte("SSH-"), c.first) && !bytes.HasPrefix(c.first, []byte("SSH-")):
+		return HandshakeFailureProtocol
+	case errors.As(err, &authErr):
+		return HandshakeFailureAuth
+	case errors.As(err, &ne) && ne.Timeout():
+		return HandshakeFailureTimeout
+	case strings.Contains(msg, "no common algorithm") || strings.Contains(msg, "key exchange"):
+		return HandshakeFailureKex
+	case strings.Contains(msg, "version") || strings.Contains(msg, "packet") || strings.Contains(msg, "parse error") || strings.Contains(msg, "unexpected message"):
+		return HandshakeFailureProtocol
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return HandshakeFailureDisconnect
+	default:
+		return HandshakeFailureOther
+	}
+}
+
+// Records a failed SSH handshake in the metrics and debug logs.
+func (c Server) handshakeFailed(conn *handshakeConn, err error) {
+	class := classifyHandshakeError(conn, err)
+
+	c.metrics.Inc("handshake_failures_" + strings.Replace(class, "-", "_", -1) + "_total")
+	c.logger.Debugw("ssh handshake failed",
+		zap.String("class", class),
+		zap.String("ip", conn.RemoteAddr().String()),
+		zap.Error(err),
+	)
+}
@@ -0,0 +1,369 @@
+package sftp_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A record of a single SFTP session that has ended.
+type SessionRecord struct {
+	ID           string    `json:"id"`
+	Server       string    `json:"server"`
+	User         string    `json:"user"`
+	IP           string    `json:"ip"`
+	Started      time.Time `json:"started"`
+	Ended        time.Time `json:"ended"`
+	BytesRead    uint64    `json:"bytes_read"`
+	BytesWritten uint64    `json:"bytes_written"`
+}
+
+// A record of a single file that was read from or written to during a session.
+type TransferRecord struct {
+	SessionID    string    `json:"session_id"`
+	Server       string    `json:"server"`
+	Path         string    `json:"path"`
+	BytesRead    uint64    `json:"bytes_read"`
+	BytesWritten uint64    `json:"bytes_written"`
+	Time         time.Time `json:"time"`
+}
+
+// Filters the records returned from a HistoryStore.
+type HistoryQuery struct {
+	// Only return records for this server, or for every server when empty.
+	Server string
+	// Only return records that occurred after this time.
+	Since time.Time
+	// The maximum number of records to return, with the most recent records being returned
+	// first. Zero returns every matching record.
+	Limit int
+}
+
+// A store that records the history of sessions and file transfers so that it can be queried
+// later on, such as by the daemon's API.
+type HistoryStore interface {
+	RecordSession(r SessionRecord) error
+	RecordTransfer(r TransferRecord) error
+	Sessions(q HistoryQuery) ([]SessionRecord, error)
+	Transfers(q HistoryQuery) ([]TransferRecord, error)
+}
+
+// A HistoryStore that keeps records in JSON files within a directory, allowing small hosts to
+// retain history without running any external infrastructure. Records older than the
+// retention period are pruned periodically.
+type FileHistoryStore struct {
+	dir       string
+	retention time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+const (
+	historySessionsFile  = "sessions.jsonl"
+	historyTransfersFile = "transfers.jsonl"
+)
+
+// Creates a history store that writes records to the given directory, keeping them for the
+// provided retention period. A retention period of zero keeps records forever.
+func NewFileHistoryStore(dir string, retention time.Duration) (*FileHistoryStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &FileHistoryStore{dir: dir, retention: retention}
+	if err := s.Prune(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileHistoryStore) RecordSession(r SessionRecord) error {
+	return s.append(historySessionsFile, r)
+}
+
+func (s *FileHistoryStore) RecordTransfer(r TransferRecord) error {
+	return s.append(historyTransfersFile, r)
+}
+
+func (s *FileHistoryStore) Sessions(q HistoryQuery) ([]SessionRecord, error) {
+	var records []SessionRecord
+	err := s.read(historySessionsFile, func(b []byte) error {
+		var r SessionRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+
+		if (q.Server == "" || r.Server == q.Server) && r.Ended.After(q.Since) {
+			records = append(records, r)
+		}
+
+		return nil
+	})
+
+	// Records are appended as they occur, so reverse them to return the most recent first.
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[:q.Limit]
+	}
+
+	return records, err
+}
+
+func (s *FileHistoryStore) Transfers(q HistoryQuery) ([]TransferRecord, error) {
+	var records []TransferRecord
+	err := s.read(historyTransfersFile, func(b []byte) error {
+		var r TransferRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+
+		if (q.Server == "" || r.Server == q.Server) && r.Time.After(q.Since) {
+			records = append(records, r)
+		}
+
+		return nil
+	})
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[:q.Limit]
+	}
+
+	return records, err
+}
+
+// Removes any records that are older than the retention period of the store.
+func (s *FileHistoryStore) Prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastPrune = time.Now()
+	if s.retention <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-s.retention)
+	for _, name := range []string{historySessionsFile, historyTransfersFile} {
+		var keep [][]byte
+		err := s.readLocked(name, func(b []byte) error {
+			var r struct {
+				Ended time.Time `json:"ended"`
+				Time  time.Time `json:"time"`
+			}
+
+			if err := json.Unmarshal(b, &r); err != nil {
+				return err
+			}
+
+			if r.Ended.After(cutoff) || r.Time.After(cutoff) {
+				keep = append(keep, append([]byte(nil), b...))
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		tmp, err := ioutil.TempFile(s.dir, "."+name)
+		if err != nil {
+			return err
+		}
+
+		w := bufio.NewWriter(tmp)
+		for _, b := range keep {
+			w.Write(b)
+			w.WriteByte('\n')
+		}
+
+		err = w.Flush()
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+
+		if err == nil {
+			err = os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+		}
+
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Appends a record to the named file, pruning old records first if it has been more than an
+// hour since the store was last pruned.
+func (s *FileHistoryStore) append(name string, v interface{}) error {
+	s.mu.Lock()
+	prune := time.Since(s.lastPrune) > time.Hour
+	s.mu.Unlock()
+
+	if prune {
+		if err := s.Prune(); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (s *FileHistoryStore) read(name string, fn func(b []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readLocked(name, fn)
+}
+
+// Calls the function for every line in the named file. The caller must hold the lock.
+func (s *FileHistoryStore) readLocked(name string, fn func(b []byte) error) error {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Returns a function that records each file transferred during the session in the history.
+func (c Server) recordTransfer(s *session) func(p string, read uint64, written uint64) {
+	return func(p string, read uint64, written uint64) {
+		if read == 0 && written == 0 {
+			return
+		}
+
+		err := c.History.RecordTransfer(TransferRecord{
+			SessionID:    s.id,
+			Server:       s.uuid,
+			Path:         p,
+			BytesRead:    read,
+			BytesWritten: written,
+			Time:         time.Now(),
+		})
+
+		if err != nil {
+			s.logger.Warnw("failed to record transfer history", zap.Error(err))
+		}
+	}
+}
+
+// Records a session that has ended in the history.
+func (c Server) recordSession(s *session, stats *transferStats) {
+	err := c.History.RecordSession(SessionRecord{
+		ID:           s.id,
+		Server:       s.uuid,
+		User:         s.user,
+		IP:           s.ip,
+		Started:      stats.started,
+		Ended:        time.Now(),
+		BytesRead:    atomic.LoadUint64(&stats.read),
+		BytesWritten: atomic.LoadUint64(&stats.written),
+	})
+
+	if err != nil {
+		s.logger.Warnw("failed to record session history", zap.Error(err))
+	}
+}
+
+// Returns a HTTP handler that serves the history recorded by the server's HistoryStore, so
+// that it can be mounted on the daemon's API. The "type" query parameter selects either
+// "sessions" or "transfers", and results can be filtered with the "server", "since" (a RFC
+// 3339 timestamp) and "limit" parameters.
+func (c *Server) HistoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.History == nil {
+			http.Error(w, "history is not enabled", http.StatusNotFound)
+			return
+		}
+
+		q := HistoryQuery{Server: r.URL.Query().Get("server")}
+		if v := r.URL.Query().Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "invalid since parameter", http.StatusBadRequest)
+				return
+			}
+
+			q.Since = t
+		}
+
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+				return
+			}
+
+			q.Limit = n
+		}
+
+		var records interface{}
+		var err error
+		switch r.URL.Query().Get("type") {
+		case "", "sessions":
+			records, err = c.History.Sessions(q)
+		case "transfers":
+			records, err = c.History.Transfers(q)
+		default:
+			http.Error(w, "invalid type parameter", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			c.logger.Errorw("failed to query history", zap.Error(err))
+			http.Error(w, "failed to query history", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	})
+}
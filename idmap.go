@@ -0,0 +1,52 @@
+package sftp_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// The offset applied to the owner of files created for a server whose container runs in a user
+// namespace. The user inside the container is mapped to a subordinate uid and gid on the host,
+// so files must be owned by the host ids for the container to see them as its own.
+type IDMapping struct {
+	UidOffset int `json:"uid_offset"`
+	GidOffset int `json:"gid_offset"`
+}
+
+// Returns the owner of files inside the user namespace as seen from the host.
+func (m IDMapping) apply(u SftpUser) SftpUser {
+	return SftpUser{Uid: u.Uid + m.UidOffset, Gid: u.Gid + m.GidOffset}
+}
+
+// Returns a function for Server.IDMapping that reads the mapping for each server from its
+// server.json file, found by formatting pattern with the server UUID, for example
+// "/srv/daemon/config/servers/%s/server.json". The mapping is read from the "id_mapping" key of
+// the "container" object:
+//
+//	{"container": {"id_mapping": {"uid_offset": 100000, "gid_offset": 100000}}}
+//
+// Servers without a server.json, or without a mapping in it, are not mapped.
+func ServerJSONIDMapping(pattern string) func(server string) (IDMapping, error) {
+	return func(server string) (IDMapping, error) {
+		var cfg struct {
+			Container struct {
+				IDMapping IDMapping `json:"id_mapping"`
+			} `json:"container"`
+		}
+
+		b, err := ioutil.ReadFile(fmt.Sprintf(pattern, server))
+		if os.IsNotExist(err) {
+			return IDMapping{}, nil
+		} else if err != nil {
+			return IDMapping{}, err
+		}
+
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return IDMapping{}, fmt.Errorf("sftp: invalid server.json for %s: %w", server, err)
+		}
+
+		return cfg.Container.IDMapping, nil
+	}
+}
@@ -0,0 +1,256 @@
+package sftp_server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The file in a server's root listing paths that are hidden from subusers, one glob pattern per
+// line. Patterns follow the same rules as FileValidators: those without a slash match the name
+// in any directory, while those with one are matched from the server's root. A pattern that
+// matches a directory hides everything within it. Blank lines and lines starting with "#" are
+// ignored.
+const IgnoreFile = ".sftpignore"
+
+// The largest ignore file that is read. Anything larger is almost certainly not a list of
+// patterns written by hand.
+const maxIgnoreFileSize = 64 * 1024
+
+// The patterns of an ignore file, along with the details of the file they were read from so
+// that they are only read again once it changes.
+type ignoreRules struct {
+	modified time.Time
+	size     int64
+	patterns []string
+}
+
+// Determines if the session belongs to the server's owner or an administrator, who are given
+// every permission by the Panel.
+func (fs FileSystem) isOwner() bool {
+	permissions := fs.Permissions
+	if fs.session != nil {
+		permissions = fs.session.getPermissions()
+	}
+
+	for _, p := range permissions {
+		if p == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the patterns in the server's ignore file, if it has one.
+func (fs FileSystem) ignorePatterns() []string {
+	root, err := fs.buildPath("/")
+	if err != nil {
+		return nil
+	}
+
+	st, err := os.Stat(filepath.Join(root, IgnoreFile))
+	if err != nil || !st.Mode().IsRegular() || st.Size() > maxIgnoreFileSize {
+		return nil
+	}
+
+	key := "ignore:" + fs.UUID
+	if fs.Cache != nil {
+		if v, ok := fs.Cache.Get(key); ok {
+			if r := v.(*ignoreRules); r.modified.Equal(st.ModTime()) && r.size == st.Size() {
+				return r.patterns
+			}
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(root, IgnoreFile))
+	if err != nil {
+		return nil
+	}
+
+	r := &ignoreRules{modified: st.ModTime(), size: st.Size()}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r.patterns = append(r.patterns, strings.TrimSuffix(line, "/"))
+	}
+
+	if fs.Cache != nil {
+		fs.Cache.Set(key, r, 5*time.Minute)
+	}
+
+	return r.patterns
+}
+
+// Determines if the path requested by the client is hidden from the user by the server's ignore
+// file. Ignored paths are treated as if they do not exist, so subusers can neither see nor
+// download them. The ignore file itself is hidden as well so that it cannot be changed to
+// reveal them. Owners are never affected.
+func (fs FileSystem) isIgnored(name string) bool {
+	if fs.isOwner() {
+		return false
+	}
+
+	return fs.ignoredBy(fs.ignorePatterns(), name)
+}
+
+// Determines if the path is hidden by any of the patterns. Besides the path the client
+// requested, the path it resolves to on the host is checked so that a hidden file cannot be
+// reached through a symlink, and paths within the versions directory are checked as the path of
+// the file they are a revision of.
+func (fs FileSystem) ignoredBy(patterns []string, name string) bool {
+	// Without any patterns there is nothing to resolve the path on the host for.
+	if len(patterns) == 0 {
+		return strings.TrimPrefix(path.Clean("/"+name), "/") == IgnoreFile
+	}
+
+	return ignoredNames(patterns, fs.ignoreNames(name))
+}
+
+// Determines if any of the paths, relative to the server's root, are hidden by the patterns.
+func ignoredNames(patterns []string, names []string) bool {
+	for _, n := range names {
+		if n == IgnoreFile {
+			return true
+		}
+
+		parts := strings.Split(n, "/")
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], "/")
+			for _, pattern := range patterns {
+				if matchesFilePattern(pattern, prefix) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Determines if the directory requested by the client contains paths hidden by patterns that
+// are matched from the server's root, which would no longer be hidden once the directory was
+// renamed. Patterns matching a name in any directory continue to hide it wherever it is moved.
+func (fs FileSystem) containsIgnored(name string) bool {
+	if fs.isOwner() {
+		return false
+	}
+
+	patterns := fs.ignorePatterns()
+	if len(patterns) == 0 {
+		return false
+	}
+
+	for _, n := range fs.ignoreNames(name) {
+		parts := strings.Split(n, "/")
+		for _, pattern := range patterns {
+			pp := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+			if !strings.Contains(pattern, "/") || len(pp) <= len(parts) {
+				continue
+			}
+
+			matches := true
+			for i := range parts {
+				if ok, _ := path.Match(pp[i], parts[i]); !ok {
+					matches = false
+					break
+				}
+			}
+
+			if matches {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the paths relative to the server's root that the path requested by the client is
+// checked against the ignore file as.
+func (fs FileSystem) ignoreNames(name string) []string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+
+	names := []string{name}
+	if rel, ok := fs.resolvedName(name); ok && rel != name {
+		names = append(names, rel)
+	}
+
+	for _, n := range names {
+		if isVersionsPath(n) {
+			if n = strings.TrimPrefix(strings.TrimPrefix(n, versionsDir), "/"); n != "" {
+				names = append(names, n)
+			}
+		}
+	}
+
+	return names
+}
+
+// Returns the path that the path requested by the client resolves to on the host, following
+// any symlinks, relative to the server's root.
+func (fs FileSystem) resolvedName(name string) (string, bool) {
+	if fs.PathValidator == nil {
+		return "", false
+	}
+
+	root, err := fs.PathValidator(fs, "/")
+	if err != nil {
+		return "", false
+	}
+
+	p, err := fs.PathValidator(fs, name)
+	if err != nil {
+		return "", false
+	}
+
+	if root, err = evalExisting(root); err != nil {
+		return "", false
+	}
+
+	if p, err = evalExisting(p); err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return filepath.ToSlash(rel), true
+}
+
+// Removes the files hidden by the ignore file from a listing of the given directory.
+func (fs FileSystem) filterIgnored(dir string, files []os.FileInfo) []os.FileInfo {
+	if fs.isOwner() {
+		return files
+	}
+
+	// Without any patterns only the ignore file itself is hidden, which is only ever listed in
+	// the server's root.
+	patterns := fs.ignorePatterns()
+	if len(patterns) == 0 && path.Clean("/"+dir) != "/" {
+		return files
+	}
+
+	visible := files[:0]
+	for _, f := range files {
+		if !fs.ignoredBy(patterns, path.Join(dir, f.Name())) {
+			visible = append(visible, f)
+		}
+	}
+
+	return visible
+}
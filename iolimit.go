@@ -0,0 +1,35 @@
+package sftp_server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The disk I/O limits applied to the SFTP server using a cgroup v2 group, so that large
+// transfers cannot starve the game servers on the same node of disk I/O. Zero values do not
+// limit that kind of I/O.
+type IOLimit struct {
+	ReadBPS   uint64 `json:"read_bps,omitempty"`
+	WriteBPS  uint64 `json:"write_bps,omitempty"`
+	ReadIOPS  uint64 `json:"read_iops,omitempty"`
+	WriteIOPS uint64 `json:"write_iops,omitempty"`
+}
+
+// Returns the limit in the format used by the cgroup io.max file, such as "rbps=1048576 wbps=max".
+func (l IOLimit) String() string {
+	values := []struct {
+		key string
+		v   uint64
+	}{{"rbps", l.ReadBPS}, {"wbps", l.WriteBPS}, {"riops", l.ReadIOPS}, {"wiops", l.WriteIOPS}}
+
+	parts := make([]string, len(values))
+	for i, v := range values {
+		if v.v == 0 {
+			parts[i] = v.key + "=max"
+		} else {
+			parts[i] = v.key + "=" + strconv.FormatUint(v.v, 10)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,360 @@
+//go:build linux
+// +build linux
+
+package sftp_server
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysIoUringSetup = 425
+	sysIoUringEnter = 426
+
+	ioringOffSqRing = 0
+	ioringOffCqRing = 0x8000000
+	ioringOffSqes   = 0x10000000
+
+	ioringOpRead  = 22
+	ioringOpWrite = 23
+
+	ioringEnterGetevents = 1
+)
+
+type uringSqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+type uringCqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCpu, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSqringOffsets
+	cqOff                                                                  uringCqringOffsets
+}
+
+type uringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type uringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// The number of submission queue entries requested for the shared ring, which also bounds the
+// number of operations that may be in flight at once.
+const uringEntries = 64
+
+// The result of a completed operation, delivered to the goroutine that submitted it. The error
+// is set instead if the operation could not be submitted to the kernel at all.
+type uringResult struct {
+	res int32
+	err error
+}
+
+// An io_uring instance shared by every file using the io_uring backend. Operations from any
+// number of goroutines are queued on the ring and submitted together, and a single goroutine
+// reaps the completions and hands each result back to the goroutine waiting for it.
+type uring struct {
+	fd int
+
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+	params uringParams
+
+	// Limits the operations in flight to the size of the submission queue, which keeps the
+	// completion queue (twice as large) from ever overflowing.
+	slots chan struct{}
+
+	// Protects queueing entries on the submission queue and the pending operations, along
+	// with the operations that have been queued but not yet submitted, in order.
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]chan uringResult
+	queued  []uint64
+
+	// Held while entering the kernel to submit, so that entries queued by other goroutines
+	// in the meantime are submitted together by whoever enters next.
+	submitMu  sync.Mutex
+	submitted uint32
+}
+
+var sharedUring struct {
+	once sync.Once
+	ring *uring
+	err  error
+}
+
+// Returns the ring shared by every file, setting it up the first time it is needed. If the
+// kernel does not support io_uring the error is returned every time without trying again.
+func getUring() (*uring, error) {
+	sharedUring.once.Do(func() {
+		sharedUring.ring, sharedUring.err = newUring()
+		if sharedUring.err == nil {
+			go sharedUring.ring.reap()
+		}
+	})
+
+	return sharedUring.ring, sharedUring.err
+}
+
+func newUring() (*uring, error) {
+	r := &uring{pending: make(map[uint64]chan uringResult)}
+
+	fd, _, errno := syscall.Syscall(sysIoUringSetup, uringEntries, uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	r.fd = int(fd)
+
+	var err error
+	p := r.params
+	if r.sqRing, err = syscall.Mmap(r.fd, ioringOffSqRing, int(p.sqOff.array+p.sqEntries*4), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if r.cqRing, err = syscall.Mmap(r.fd, ioringOffCqRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCqe{}))), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if r.sqes, err = syscall.Mmap(r.fd, ioringOffSqes, int(p.sqEntries*uint32(unsafe.Sizeof(uringSqe{}))), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	r.slots = make(chan struct{}, p.sqEntries)
+
+	return r, nil
+}
+
+func (r *uring) u32(ring []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&ring[off]))
+}
+
+// Queues a read or write operation against the given file descriptor and blocks until the
+// kernel has completed it, returning the number of bytes that were transferred.
+func (r *uring) submit(op uint8, fd uintptr, b []byte, off int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+
+	done := make(chan uringResult, 1)
+
+	r.mu.Lock()
+	r.next++
+	id := r.next
+	r.pending[id] = done
+	r.queued = append(r.queued, id)
+
+	p := r.params
+	tail := atomic.LoadUint32(r.u32(r.sqRing, p.sqOff.tail))
+	idx := tail & *r.u32(r.sqRing, p.sqOff.ringMask)
+
+	sqe := (*uringSqe)(unsafe.Pointer(&r.sqes[uintptr(idx)*unsafe.Sizeof(uringSqe{})]))
+	*sqe = uringSqe{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&b[0]))),
+		len:      uint32(len(b)),
+		userData: id,
+	}
+	*r.u32(r.sqRing, p.sqOff.array+idx*4) = idx
+	atomic.StoreUint32(r.u32(r.sqRing, p.sqOff.tail), tail+1)
+	r.mu.Unlock()
+
+	// The result is always waited for, even if submitting fails, since the entry may have been
+	// submitted by another goroutine and the kernel could still be using the buffer.
+	r.flush()
+	res := <-done
+
+	// Ensure the buffer is not collected while the kernel may still be referencing it.
+	runtime.KeepAlive(b)
+
+	if res.err != nil {
+		return 0, res.err
+	}
+
+	if res.res < 0 {
+		return 0, syscall.Errno(-res.res)
+	}
+
+	return int(res.res), nil
+}
+
+// Submits every entry queued on the ring that has not been submitted yet. Entries queued
+// while another goroutine was submitting are picked up here in a single call. If the kernel
+// refuses to take them, the entries are removed from the ring again and their operations fail.
+func (r *uring) flush() {
+	r.submitMu.Lock()
+	defer r.submitMu.Unlock()
+
+	for {
+		n := atomic.LoadUint32(r.u32(r.sqRing, r.params.sqOff.tail)) - r.submitted
+		if n == 0 {
+			return
+		}
+
+		m, _, errno := syscall.Syscall6(sysIoUringEnter, uintptr(r.fd), uintptr(n), 0, 0, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		} else if errno == syscall.EAGAIN || errno == syscall.EBUSY || (errno == 0 && m == 0) {
+			// The kernel is short on resources or completions are waiting to be reaped, both
+			// of which clear up on their own.
+			runtime.Gosched()
+			continue
+		} else if errno != 0 {
+			r.rollback(errno)
+			return
+		}
+
+		r.submitted += uint32(m)
+		r.mu.Lock()
+		r.queued = r.queued[m:]
+		r.mu.Unlock()
+	}
+}
+
+// Removes every entry that has not been submitted from the ring, failing their operations with
+// the error. This must be called while holding submitMu.
+func (r *uring) rollback(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	atomic.StoreUint32(r.u32(r.sqRing, r.params.sqOff.tail), r.submitted)
+	for _, id := range r.queued {
+		if done, ok := r.pending[id]; ok {
+			delete(r.pending, id)
+			done <- uringResult{err: err}
+		}
+	}
+	r.queued = r.queued[:0]
+}
+
+// Waits for operations to complete for as long as the process runs, delivering each result
+// to the goroutine that submitted the operation.
+func (r *uring) reap() {
+	p := r.params
+	for {
+		// A wait that is interrupted is simply retried after handing out whatever has
+		// completed in the meantime.
+		syscall.Syscall6(sysIoUringEnter, uintptr(r.fd), 0, 1, ioringEnterGetevents, 0, 0)
+
+		head := atomic.LoadUint32(r.u32(r.cqRing, p.cqOff.head))
+		tail := atomic.LoadUint32(r.u32(r.cqRing, p.cqOff.tail))
+		for ; head != tail; head++ {
+			cidx := head & *r.u32(r.cqRing, p.cqOff.ringMask)
+			cqe := (*uringCqe)(unsafe.Pointer(&r.cqRing[uintptr(p.cqOff.cqes)+uintptr(cidx)*unsafe.Sizeof(uringCqe{})]))
+
+			r.mu.Lock()
+			done, ok := r.pending[cqe.userData]
+			delete(r.pending, cqe.userData)
+			r.mu.Unlock()
+
+			if ok {
+				done <- uringResult{res: cqe.res}
+			}
+		}
+		atomic.StoreUint32(r.u32(r.cqRing, p.cqOff.head), head)
+	}
+}
+
+func (r *uring) Close() error {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqes} {
+		if m != nil {
+			syscall.Munmap(m)
+		}
+	}
+
+	return syscall.Close(r.fd)
+}
+
+// A file that performs all of its positional reads and writes through the shared io_uring
+// instance, falling back to the regular file methods if the kernel does not support the
+// operation.
+type uringFile struct {
+	*os.File
+	ring *uring
+}
+
+func newUringFile(f *os.File) (*uringFile, error) {
+	r, err := getUring()
+	if err != nil {
+		return nil, err
+	}
+
+	return &uringFile{File: f, ring: r}, nil
+}
+
+func (f *uringFile) ReadAt(b []byte, off int64) (int, error) {
+	var read int
+	for read < len(b) {
+		n, err := f.ring.submit(ioringOpRead, f.Fd(), b[read:], off+int64(read))
+		if err == syscall.EINVAL || err == syscall.EOPNOTSUPP {
+			m, err := f.File.ReadAt(b[read:], off+int64(read))
+			return read + m, err
+		} else if err != nil {
+			return read, &os.PathError{Op: "read", Path: f.Name(), Err: err}
+		}
+
+		// Reads may come up short before the end of the file, so only a read that returns
+		// nothing at all means the end was reached, matching the behavior of os.File.
+		if n == 0 {
+			return read, io.EOF
+		}
+
+		read += n
+	}
+
+	return read, nil
+}
+
+func (f *uringFile) WriteAt(b []byte, off int64) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := f.ring.submit(ioringOpWrite, f.Fd(), b[written:], off+int64(written))
+		if err == syscall.EINVAL || err == syscall.EOPNOTSUPP {
+			m, err := f.File.WriteAt(b[written:], off+int64(written))
+			return written + m, err
+		} else if err != nil {
+			return written, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+func (f *uringFile) Close() error {
+	return f.File.Close()
+}
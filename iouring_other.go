@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+import (
+	"os"
+	"syscall"
+)
+
+type uringFile struct {
+	*os.File
+}
+
+// io_uring is only available on Linux, callers will fall back to the standard file.
+func newUringFile(f *os.File) (*uringFile, error) {
+	return nil, syscall.ENOTSUP
+}
@@ -0,0 +1,299 @@
+package sftp_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The event types that change the files of a server and are recorded in its change journal.
+var journaledEvents = map[string]bool{
+	EventWrite:           true,
+	EventDelete:          true,
+	EventRename:          true,
+	EventCreateDirectory: true,
+	EventCreateSymlink:   true,
+	EventSetstat:         true,
+	EventRestore:         true,
+}
+
+// The op of a change to the contents of a directory that was made outside of SFTP, such as by the
+// game server or the daemon. These are found by comparing the modification times of the
+// directories of the server, so the files that changed are not known and the directory should
+// be listed again. Files changed in place do not change the modification time of their
+// directory, so changes to existing files made outside of SFTP are not reported.
+const ChangeDirectory = "directory"
+
+// The minimum interval between scans of the directories of a server for changes made outside of
+// SFTP, which are made when its changes are requested.
+const changeScanInterval = 10 * time.Second
+
+// The most directories of a server that are scanned for changes made outside of SFTP.
+const maxScannedDirectories = 10000
+
+// A change made to the files of a server.
+type Change struct {
+	Cursor uint64 `json:"cursor"`
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	// The directory containing the changed path, which is the directory a file manager
+	// displaying the change needs to refresh.
+	Directory string    `json:"directory"`
+	Target    string    `json:"target,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// The changes made to a server since a cursor.
+type ChangeFeed struct {
+	Changes []Change `json:"changes"`
+	// The cursor to pass to retrieve the changes made after these ones.
+	Cursor uint64 `json:"cursor"`
+	// Set when changes may have been made since the requested cursor that are no longer in the
+	// journal, in which case the client should list the server's directories again.
+	Reset bool `json:"reset"`
+	// Set when there are more changes after these ones.
+	More bool `json:"more"`
+}
+
+// Keeps the most recent changes made to the files of each server in memory. Cursors increase
+// across every server and are seeded from the time the journal was created, so a cursor handed
+// out before a restart is always older than the journal and results in a reset. Microseconds are
+// used so that cursors remain exact when decoded as JavaScript numbers.
+type changeJournal struct {
+	mu      sync.Mutex
+	size    int
+	base    uint64
+	seq     uint64
+	servers map[string]*serverJournal
+}
+
+// The changes of a single server, kept in a ring buffer holding the most recent changes.
+type serverJournal struct {
+	changes []Change
+	start   int
+	// The cursor of the most recent change dropped from the journal.
+	dropped uint64
+
+	// The modification times of the directories of the server when they were last scanned,
+	// and when that was. Only one scan of a server is made at a time.
+	dirs     map[string]time.Time
+	scanned  time.Time
+	scanning bool
+}
+
+// Returns the server's journal, creating it if it does not exist. The caller must hold the lock.
+func (j *changeJournal) server(server string) *serverJournal {
+	s, ok := j.servers[server]
+	if !ok {
+		s = &serverJournal{dropped: j.base}
+		j.servers[server] = s
+	}
+
+	return s
+}
+
+func newChangeJournal(size int) *changeJournal {
+	base := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+
+	return &changeJournal{size: size, base: base, seq: base, servers: make(map[string]*serverJournal)}
+}
+
+// Records a change to the server, dropping the oldest change if the journal is full.
+func (j *changeJournal) record(server string, c Change) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.add(j.server(server), c)
+}
+
+// Adds a change to the server's journal. The caller must hold the lock.
+func (j *changeJournal) add(s *serverJournal, c Change) {
+	j.seq++
+	c.Cursor = j.seq
+	if c.Directory == "" {
+		c.Directory = path.Dir(c.Path)
+	}
+
+	if len(s.changes) < j.size {
+		s.changes = append(s.changes, c)
+		return
+	}
+
+	s.dropped = s.changes[s.start].Cursor
+	s.changes[s.start] = c
+	s.start = (s.start + 1) % len(s.changes)
+}
+
+// Returns up to limit changes made to the server after the cursor.
+func (j *changeJournal) since(server string, cursor uint64, limit int) ChangeFeed {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	feed := ChangeFeed{Changes: []Change{}, Cursor: cursor}
+
+	s, ok := j.servers[server]
+	if !ok {
+		feed.Reset = cursor < j.base
+		if feed.Reset {
+			feed.Cursor = j.seq
+		}
+
+		return feed
+	}
+
+	feed.Reset = cursor < s.dropped
+	for i := range s.changes {
+		c := s.changes[(s.start+i)%len(s.changes)]
+		if c.Cursor <= cursor {
+			continue
+		}
+
+		if len(feed.Changes) >= limit {
+			feed.More = true
+			break
+		}
+
+		feed.Changes = append(feed.Changes, c)
+		feed.Cursor = c.Cursor
+	}
+
+	if feed.Cursor < s.dropped {
+		feed.Cursor = s.dropped
+	}
+
+	return feed
+}
+
+// Records a change made by the session in the journal of its server.
+func (fs FileSystem) journalChange(t string, p string, target string) {
+	if fs.journal == nil || !journaledEvents[t] {
+		return
+	}
+
+	c := Change{Op: t, Path: path.Clean("/" + p), Target: target, Time: time.Now()}
+	if fs.session != nil {
+		c.User = fs.session.user
+	}
+
+	fs.journal.record(fs.UUID, c)
+}
+
+// Scans the directories of the server for changes made outside of SFTP, recording a change for
+// each directory whose modification time differs from the previous scan. The first scan of a
+// server only records the modification times to compare later scans against. Nothing is done
+// if the server was scanned recently or is being scanned already.
+func (j *changeJournal) scan(server string, root string) {
+	j.mu.Lock()
+	s := j.server(server)
+	if s.scanning || time.Since(s.scanned) < changeScanInterval {
+		j.mu.Unlock()
+		return
+	}
+	s.scanning = true
+	previous := s.dirs
+	j.mu.Unlock()
+
+	dirs := make(map[string]time.Time)
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return filepath.SkipDir
+		}
+
+		name := path.Clean("/" + filepath.ToSlash(rel))
+		if isVersionsPath(name) || isQuarantinePath(name) || len(dirs) >= maxScannedDirectories {
+			return filepath.SkipDir
+		}
+		dirs[name] = info.ModTime()
+
+		return nil
+	})
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	if previous != nil {
+		for name, modified := range dirs {
+			if before, ok := previous[name]; !ok || !before.Equal(modified) {
+				j.add(s, Change{Op: ChangeDirectory, Path: name, Directory: name, Time: now})
+			}
+		}
+	}
+
+	s.dirs, s.scanned, s.scanning = dirs, now, false
+}
+
+// Returns up to limit changes made to the files of the server after the cursor, allowing the
+// daemon or Panel to keep a file manager up to date without listing directories again. A cursor
+// of zero returns the oldest changes still in the journal.
+//
+// Changes made over SFTP are recorded as they are made, while changes made outside of it are
+// found by scanning the directories of the server, at most every few seconds, when its changes
+// are requested. These are reported as a ChangeDirectory change for the directory whose contents
+// changed.
+func (c *Server) Changes(server string, cursor uint64, limit int) ChangeFeed {
+	if limit <= 0 || limit > 1000 {
+		limit = 1000
+	}
+
+	if c.journal == nil {
+		return ChangeFeed{Changes: []Change{}, Cursor: cursor, Reset: true}
+	}
+
+	if root, err := c.serverFileSystem(server).buildPath("/"); err == nil {
+		c.journal.scan(server, root)
+	}
+
+	return c.journal.since(server, cursor, limit)
+}
+
+// Returns a HTTP handler that serves the change journal of the server given by the "server"
+// parameter, starting after the cursor given by the "since" parameter and returning at most
+// "limit" changes, so that it can be mounted on the daemon's control API.
+func (c *Server) ChangesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		server := r.URL.Query().Get("server")
+		if server == "" {
+			http.Error(w, "missing server parameter", http.StatusBadRequest)
+			return
+		}
+
+		var cursor uint64
+		if v := r.URL.Query().Get("since"); v != "" {
+			var err error
+			if cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, "invalid since parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			var err error
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+				http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Changes(server, cursor, limit))
+	})
+}
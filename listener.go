@@ -0,0 +1,99 @@
+package sftp_server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The network families that the server can be bound to.
+const (
+	// Listens on both IPv4 and IPv6 when bound to a wildcard address.
+	BindModeDualStack = "tcp"
+	BindModeIPv4      = "tcp4"
+	BindModeIPv6      = "tcp6"
+)
+
+// Returns the address the server should bind to. IPv6 literals may be provided either with
+// or without surrounding brackets.
+func (c Server) bindAddress() string {
+	host := strings.TrimSuffix(strings.TrimPrefix(c.Settings.BindAddress, "["), "]")
+
+	return net.JoinHostPort(host, strconv.Itoa(c.Settings.BindPort))
+}
+
+// Creates the listener for the server using the configured bind mode, or a unix socket
+// listener if a socket path has been configured. A listener provided by the daemon takes
+// precedence over both.
+func (c Server) listen() (net.Listener, error) {
+	if c.Listener != nil {
+		return c.Listener, nil
+	}
+
+	if c.Settings.BindSocket != "" {
+		return listenUnix(c.Settings.BindSocket)
+	}
+
+	mode := c.Settings.BindMode
+	switch mode {
+	case "":
+		mode = BindModeDualStack
+	case BindModeDualStack, BindModeIPv4, BindModeIPv6:
+	default:
+		return nil, fmt.Errorf("sftp: invalid bind mode \"%s\"", mode)
+	}
+
+	return net.Listen(mode, c.bindAddress())
+}
+
+// Listens on a unix socket at the given path, removing any socket left behind by a previous
+// run of the server. The socket is only accessible to the user and group the server runs as.
+func listenUnix(p string) (net.Listener, error) {
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(p, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Applies the configured socket options to an accepted TCP connection. Connections that are
+// not TCP, such as those accepted on a unix socket, are left as is.
+func (c Server) tuneConn(conn net.Conn) {
+	if mc, ok := conn.(*muxConn); ok {
+		conn = mc.Conn
+	}
+
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if c.Settings.TCPKeepAlivePeriod > 0 {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(c.Settings.TCPKeepAlivePeriod)
+	}
+
+	if c.Settings.DisableTCPNoDelay {
+		tc.SetNoDelay(false)
+	}
+
+	if c.Settings.TCPReadBuffer > 0 {
+		tc.SetReadBuffer(c.Settings.TCPReadBuffer)
+	}
+
+	if c.Settings.TCPWriteBuffer > 0 {
+		tc.SetWriteBuffer(c.Settings.TCPWriteBuffer)
+	}
+}
@@ -0,0 +1,130 @@
+package sftp_server
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned when a login is rejected because the server is over its resource budget.
+var ErrServerBusy = errors.New("sftp: server is busy")
+
+// The message shown to clients that are rejected or disconnected because the server is over its
+// resource budget.
+const serverBusyMessage = "The server is busy, please try again in a few minutes."
+
+// The interval at which the resource usage of the process is checked.
+const loadCheckInterval = 5 * time.Second
+
+// Tracks whether the process is over its CPU or memory budget. This is shared between every
+// profile of a server.
+type loadShedder struct {
+	busy int32
+
+	mu    sync.Mutex
+	bytes map[string]uint64
+}
+
+func (l *loadShedder) isBusy() bool {
+	return l != nil && atomic.LoadInt32(&l.busy) == 1
+}
+
+// Periodically checks the CPU and memory used by the process against the configured budget.
+// While over budget new logins are rejected, and the session that transferred the most data
+// since the previous check is disconnected. The server stops shedding load once usage is back
+// below 90% of the budget.
+func (c *Server) watchLoad() {
+	t := time.NewTicker(loadCheckInterval)
+	defer t.Stop()
+
+	lastCPU, _, err := processUsage()
+	if err != nil {
+		c.logger.Warnw("failed to monitor resource usage, load shedding is disabled", zap.Error(err))
+		return
+	}
+	last := time.Now()
+
+	for range t.C {
+		cpu, rss, err := processUsage()
+		if err != nil {
+			c.logger.Warnw("failed to check resource usage", zap.Error(err))
+			continue
+		}
+
+		now := time.Now()
+		percent := float64(cpu-lastCPU) / float64(now.Sub(last)) * 100
+		lastCPU, last = cpu, now
+
+		c.metrics.Set("process_cpu_percent", uint64(percent))
+		c.metrics.Set("process_rss_bytes", rss)
+
+		over := (c.Settings.MaxCPUPercent > 0 && percent > c.Settings.MaxCPUPercent) ||
+			(c.Settings.MaxMemory > 0 && rss > c.Settings.MaxMemory)
+		under := (c.Settings.MaxCPUPercent <= 0 || percent < c.Settings.MaxCPUPercent*0.9) &&
+			(c.Settings.MaxMemory <= 0 || float64(rss) < float64(c.Settings.MaxMemory)*0.9)
+
+		heaviest := c.heaviestSession()
+
+		switch {
+		case over:
+			if atomic.CompareAndSwapInt32(&c.load.busy, 0, 1) {
+				c.logger.Warnw("server is over its resource budget, rejecting new sessions", zap.Float64("cpu_percent", percent), zap.Uint64("rss", rss))
+			}
+
+			if heaviest != nil {
+				c.metrics.Inc("sessions_shed_total")
+				heaviest.logger.Warnw("disconnecting session to reduce load")
+				go c.disconnect(heaviest, serverBusyMessage)
+			}
+		case under:
+			if atomic.CompareAndSwapInt32(&c.load.busy, 1, 0) {
+				c.logger.Infow("server is back within its resource budget, accepting new sessions", zap.Float64("cpu_percent", percent), zap.Uint64("rss", rss))
+			}
+		}
+	}
+}
+
+// Wraps the banner callback so that clients connecting while the server is busy are shown the
+// busy message before their login is rejected.
+func (c *Server) busyBanner(cb func(conn ssh.ConnMetadata) string) func(conn ssh.ConnMetadata) string {
+	if c.Settings.MaxCPUPercent <= 0 && c.Settings.MaxMemory <= 0 {
+		return cb
+	}
+
+	return func(conn ssh.ConnMetadata) string {
+		if c.load.isBusy() {
+			return serverBusyMessage + "\n"
+		}
+
+		if cb == nil {
+			return ""
+		}
+
+		return cb(conn)
+	}
+}
+
+// Returns the session that has transferred the most data since the previous call, or nil if
+// no session has transferred any data.
+func (c *Server) heaviestSession() *session {
+	c.load.mu.Lock()
+	defer c.load.mu.Unlock()
+
+	current := make(map[string]uint64)
+	var heaviest *session
+	var max uint64
+	for _, s := range c.sessions.all() {
+		n := s.transferred()
+		current[s.id] = n
+
+		if d := n - c.load.bytes[s.id]; n > c.load.bytes[s.id] && d > max {
+			heaviest, max = s, d
+		}
+	}
+	c.load.bytes = current
+
+	return heaviest
+}
@@ -0,0 +1,139 @@
+package sftp_server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Tracks the servers that currently have a write lock placed on them.
+type writeLocks struct {
+	m sync.Map
+}
+
+// The write lock of a single server. Changes that are in progress hold the read side of the
+// mutex, which allows placing the lock to wait for them to finish.
+type serverLock struct {
+	locked int32
+	mu     sync.RWMutex
+	// Held while setting up the files of a server, such as creating its directory skeleton.
+	setup sync.Mutex
+}
+
+func (l *writeLocks) get(uuid string) *serverLock {
+	v, _ := l.m.LoadOrStore(uuid, &serverLock{})
+
+	return v.(*serverLock)
+}
+
+func (l *writeLocks) locked(uuid string) bool {
+	if l == nil {
+		return false
+	}
+
+	v, ok := l.m.Load(uuid)
+
+	return ok && atomic.LoadInt32(&v.(*serverLock).locked) == 1
+}
+
+// Marks the start of a change to the files of the server, returning false if the server has a
+// write lock placed on it. Otherwise the returned function must be called once the change has
+// been made, and placing a write lock waits until it has been.
+func (l *writeLocks) begin(uuid string) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+
+	s := l.get(uuid)
+	s.mu.RLock()
+	if atomic.LoadInt32(&s.locked) == 1 {
+		s.mu.RUnlock()
+		return nil, false
+	}
+
+	return s.mu.RUnlock, true
+}
+
+// Serializes setting up the files of the server between every session and channel, which are
+// handled concurrently, returning the function that releases it.
+func (l *writeLocks) setup(uuid string) func() {
+	if l == nil {
+		return func() {}
+	}
+
+	s := l.get(uuid)
+	s.setup.Lock()
+
+	return s.setup.Unlock
+}
+
+// Places a write lock on the server, making all active and new SFTP sessions for it read-only
+// until the lock is released. This is used by the daemon to keep the file tree stable while a
+// server is being transferred or backed up. Files that are already open for writing can no
+// longer be written to, and this does not return until every write that was in progress when
+// it was called has finished.
+func (c *Server) LockServer(uuid string) {
+	s := c.locks.get(uuid)
+	atomic.StoreInt32(&s.locked, 1)
+
+	s.mu.Lock()
+	s.mu.Unlock()
+}
+
+// Releases the write lock placed on a server.
+func (c *Server) UnlockServer(uuid string) {
+	atomic.StoreInt32(&c.locks.get(uuid).locked, 0)
+}
+
+// Determines if a write lock is currently placed on the server.
+func (c *Server) IsServerLocked(uuid string) bool {
+	return c.locks.locked(uuid)
+}
+
+// Determines if the filesystem is currently read-only, either because it was configured to
+// be, because the server is in read-only preview mode, because the server currently has a
+// write lock placed on it, or because the node is low on disk space.
+func (fs FileSystem) isReadOnly() bool {
+	return fs.ReadOnly || fs.PreviewMessage != "" || fs.locks.locked(fs.UUID) || fs.disk.isLow()
+}
+
+// Wraps a file opened for writing so that it can no longer be written to once the server has a
+// write lock placed on it or the node runs low on disk space, since either can happen long
+// after the file was opened.
+type lockedFile struct {
+	backendFile
+	fs FileSystem
+}
+
+func (fs FileSystem) withWriteLock(f backendFile) backendFile {
+	return &lockedFile{backendFile: f, fs: fs}
+}
+
+func (f *lockedFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.fs.disk.isLow() {
+		return 0, ErrNodeDiskFull
+	}
+
+	done, ok := f.fs.locks.begin(f.fs.UUID)
+	if !ok {
+		return 0, ErrServerLocked
+	}
+	defer done()
+
+	return f.backendFile.WriteAt(b, off)
+}
+
+// Closes the file. Uploads that are finished once they are closed, such as those written to a
+// temporary file, are discarded instead if the server was locked while they were being written.
+func (f *lockedFile) Close() error {
+	done, ok := f.fs.locks.begin(f.fs.UUID)
+	if !ok {
+		if d, ok := f.backendFile.(discarder); ok {
+			return d.discard(ErrServerLocked)
+		}
+
+		return f.backendFile.Close()
+	}
+	defer done()
+
+	return f.backendFile.Close()
+}
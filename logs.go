@@ -0,0 +1,175 @@
+package sftp_server
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The fields that identify who a message is about. Messages are coalesced separately for each
+// combination of these, so that a flood of failed logins from one address cannot hide the
+// failed logins, bans or path escapes of another.
+var coalescingKeyFields = map[string]bool{"ip": true, "user": true, "server": true}
+
+// Tracks how often each message is logged so that a message repeated many times in a short
+// period, such as a chown failure for every file of a large upload, is only written a limited
+// number of times followed by a summary of how many times it was repeated.
+type logCoalescer struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	entries map[string]*coalescedEntry
+	next    time.Time
+}
+
+// The state of a single message within the current window.
+type coalescedEntry struct {
+	start      time.Time
+	level      zapcore.Level
+	message    string
+	fields     []zapcore.Field
+	count      int
+	suppressed int
+	core       zapcore.Core
+}
+
+func newLogCoalescer(limit int, window time.Duration) *logCoalescer {
+	return &logCoalescer{limit: limit, window: window, entries: make(map[string]*coalescedEntry)}
+}
+
+// Determines if an entry should be written, recording it as suppressed if it should not be. The
+// identifying fields of the logger and of the entry are both part of the key, but only those
+// of the entry are added to the summary since the core writing it already has the others.
+func (l *logCoalescer) allow(ent zapcore.Entry, scope []zapcore.Field, fields []zapcore.Field, core zapcore.Core) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ent.Time.After(l.next) {
+		l.flushLocked(ent.Time)
+	}
+
+	key := ent.Level.String() + ":" + ent.Message
+	for _, f := range append(append([]zapcore.Field{}, scope...), fields...) {
+		key += "\x00" + f.Key + "=" + f.String
+	}
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &coalescedEntry{start: ent.Time, level: ent.Level, message: ent.Message, fields: fields}
+		l.entries[key] = e
+	}
+
+	e.count++
+	if e.count <= l.limit {
+		return true
+	}
+
+	e.suppressed++
+	e.core = core
+
+	return false
+}
+
+// Writes a summary for every message that was suppressed in a window that has now ended.
+func (l *logCoalescer) flush() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.flushLocked(time.Now())
+}
+
+func (l *logCoalescer) flushLocked(now time.Time) {
+	for key, e := range l.entries {
+		if now.Sub(e.start) < l.window {
+			continue
+		}
+
+		if e.suppressed > 0 {
+			e.core.Write(zapcore.Entry{
+				Level:   e.level,
+				Time:    now,
+				Message: fmt.Sprintf("%s (repeated %d times)", e.message, e.suppressed),
+			}, append([]zapcore.Field{zap.Duration("window", l.window)}, e.fields...))
+		}
+
+		delete(l.entries, key)
+	}
+
+	l.next = now.Add(l.window)
+}
+
+// A core that drops entries once they have been repeated more than the coalescer allows. The
+// decision is made when the entry is written since the identifying fields of the entry are
+// only known then.
+type coalescingCore struct {
+	zapcore.Core
+	logs *logCoalescer
+	// The identifying fields added to the logger, such as those of a session.
+	keys []zapcore.Field
+}
+
+func (c *coalescingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &coalescingCore{Core: c.Core.With(fields), logs: c.logs, keys: identifyingFields(c.keys, fields)}
+}
+
+func (c *coalescingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.Enabled(ent.Level) {
+		return ce
+	}
+
+	// Traces are never coalesced.
+	if strings.HasSuffix(ent.LoggerName, traceLoggerName) {
+		return c.Core.Check(ent, ce)
+	}
+
+	return ce.AddCore(ent, c)
+}
+
+func (c *coalescingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if !c.logs.allow(ent, c.keys, identifyingFields(nil, fields), c.Core) {
+		return nil
+	}
+
+	return c.Core.Write(ent, fields)
+}
+
+// Returns the identifying string fields of an entry, added to those already known.
+func identifyingFields(keys []zapcore.Field, fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for _, f := range fields {
+		if f.Type == zapcore.StringType && coalescingKeyFields[f.Key] {
+			out = append(out, f)
+		}
+	}
+
+	if len(out) == 0 {
+		return keys
+	}
+
+	return append(append([]zapcore.Field{}, keys...), out...)
+}
+
+func (c *coalescingCore) Sync() error {
+	c.logs.flush()
+
+	return c.Core.Sync()
+}
+
+// Wraps the logger so that repetitive messages are coalesced according to the server's
+// settings. The logger is returned unchanged when coalescing is disabled.
+func (c *Server) coalesceLogs(logger *zap.SugaredLogger) *zap.SugaredLogger {
+	if c.logs == nil {
+		return logger
+	}
+
+	return logger.Desugar().WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &coalescingCore{Core: core, logs: c.logs}
+	})).Sugar()
+}
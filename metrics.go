@@ -0,0 +1,65 @@
+package sftp_server
+
+import (
+	"sync"
+)
+
+// Metrics contains the running counters for the SFTP server. These are intentionally kept
+// as simple named values so that the application embedding this server can export them to
+// whichever metrics system it makes use of.
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	labels   map[string]string
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{counters: make(map[string]uint64)}
+}
+
+// Increments the named counter by one.
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Increments the named counter by the given amount.
+func (m *Metrics) Add(name string, delta uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[name] += delta
+}
+
+// Sets the named value, for values that can go down as well as up such as free disk space.
+func (m *Metrics) Set(name string, value uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[name] = value
+}
+
+// Returns the labels that should be attached to every counter when they are exported, such
+// as the node and location the server is running on.
+func (m *Metrics) Labels() map[string]string {
+	l := make(map[string]string, len(m.labels))
+	for k, v := range m.labels {
+		if v != "" {
+			l[k] = v
+		}
+	}
+
+	return l
+}
+
+// Returns a copy of all of the current counter values.
+func (m *Metrics) Snapshot() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := make(map[string]uint64, len(m.counters))
+	for k, v := range m.counters {
+		s[k] = v
+	}
+
+	return s
+}
@@ -0,0 +1,150 @@
+package sftp_server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// The first byte of a TLS handshake record, which every ClientHello begins with.
+const tlsHandshakeRecord = 0x16
+
+// The amount of time to wait for a client to send its first byte before assuming that it is an
+// SSH client waiting on the server to send its version string first.
+const muxDetectTimeout = 3 * time.Second
+
+var errMuxClosed = errors.New("sftp: multiplexed listener closed")
+
+// A connection that has had its first byte read by the multiplexer. Reads are served from
+// the buffered reader so the byte that was peeked is not lost.
+type muxConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *muxConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// A listener that is fed connections by the multiplexer rather than accepting them itself.
+type muxListener struct {
+	parent *Multiplexer
+	conns  chan net.Conn
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.parent.done:
+		return nil, errMuxClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	return l.parent.Close()
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.parent.listener.Addr()
+}
+
+// Splits a single listener into one that receives SSH connections and one that receives
+// everything else, allowing the SFTP server to share a port with the daemon's HTTPS server.
+// Connections are routed by their first byte: a TLS ClientHello is passed to the TLS listener,
+// while anything else, including a client that sends nothing while waiting for the server's
+// version string, is passed to the SSH listener.
+//
+// The SSH listener should be assigned to Server.Listener, and the TLS listener passed to the
+// daemon's HTTP server. Closing either listener closes the underlying one.
+type Multiplexer struct {
+	listener net.Listener
+	ssh      *muxListener
+	tls      *muxListener
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Creates a new multiplexer for the given listener and begins accepting connections from it.
+func NewMultiplexer(l net.Listener) *Multiplexer {
+	m := &Multiplexer{listener: l, done: make(chan struct{})}
+	m.ssh = &muxListener{parent: m, conns: make(chan net.Conn)}
+	m.tls = &muxListener{parent: m, conns: make(chan net.Conn)}
+
+	go m.serve()
+
+	return m
+}
+
+// Returns the listener that receives SSH connections.
+func (m *Multiplexer) SSH() net.Listener {
+	return m.ssh
+}
+
+// Returns the listener that receives TLS connections.
+func (m *Multiplexer) TLS() net.Listener {
+	return m.tls
+}
+
+// Closes the underlying listener, causing both of the multiplexed listeners to stop
+// accepting connections.
+func (m *Multiplexer) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		err = m.listener.Close()
+	})
+
+	return err
+}
+
+func (m *Multiplexer) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				continue
+			}
+
+			m.Close()
+			return
+		}
+
+		go m.route(conn)
+	}
+}
+
+// Determines which protocol the connection is using and hands it off to the matching listener.
+func (m *Multiplexer) route(conn net.Conn) {
+	mc := &muxConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	conn.SetReadDeadline(time.Now().Add(muxDetectTimeout))
+	b, err := mc.r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+
+	target := m.ssh
+	if err == nil && b[0] == tlsHandshakeRecord {
+		target = m.tls
+	} else if err != nil {
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			conn.Close()
+			return
+		}
+	}
+
+	select {
+	case target.conns <- mc:
+	case <-m.done:
+		conn.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package sftp_server
+
+import (
+	"errors"
+	"time"
+)
+
+// Options used to create a server using NewWithOptions, allowing applications embedding the
+// server to configure it without building a Server themselves.
+type Options struct {
+	// The base URL of the Panel and the token used to authenticate with it. The token is
+	// fetched using TokenSource instead when it is set. The Panel is not used when a
+	// CredentialValidator is provided.
+	PanelURL           string
+	PanelToken         string
+	TokenSource        func() (string, error)
+	PanelClientOptions PanelClientOptions
+
+	// The directory containing the data directory of each server.
+	BasePath    string
+	BindAddress string
+	BindPort    int
+	ReadOnly    bool
+	User        SftpUser
+
+	// The limits applied to the server, see the fields of the same name in Settings.
+	MaxConnections     int
+	MaxOpenFiles       int
+	MaxSessionDuration time.Duration
+	BandwidthLimit     int64
+
+	// Settings for any behaviour not covered by the options above, which take precedence
+	// over the values set here.
+	Settings Settings
+
+	CredentialValidator func(r AuthenticationRequest) (*AuthenticationResponse, error)
+}
+
+// Creates a new server using the given options. The returned server may be configured further
+// before calling Initialize.
+func NewWithOptions(o Options) (*Server, error) {
+	s := &Server{
+		Settings:            o.Settings,
+		User:                o.User,
+		CredentialValidator: o.CredentialValidator,
+	}
+
+	if s.CredentialValidator == nil {
+		if o.PanelURL == "" {
+			return nil, errors.New("sftp: a panel url or credential validator is required")
+		}
+
+		p := NewPanelClientWithOptions(o.PanelURL, o.PanelToken, o.PanelClientOptions)
+		if o.TokenSource != nil {
+			p.TokenSource = o.TokenSource
+			if err := p.RefreshToken(); err != nil {
+				return nil, err
+			}
+		}
+
+		s.CredentialValidator = p.ValidateCredentials
+	}
+
+	if o.BasePath != "" {
+		s.Settings.BasePath = o.BasePath
+	}
+
+	if o.BindAddress != "" {
+		s.Settings.BindAddress = o.BindAddress
+	}
+
+	if o.BindPort != 0 {
+		s.Settings.BindPort = o.BindPort
+	}
+
+	if o.ReadOnly {
+		s.Settings.ReadOnly = true
+	}
+
+	if o.MaxConnections != 0 {
+		s.Settings.MaxConnections = o.MaxConnections
+	}
+
+	if o.MaxOpenFiles != 0 {
+		s.Settings.MaxOpenFiles = o.MaxOpenFiles
+	}
+
+	if o.MaxSessionDuration != 0 {
+		s.Settings.MaxSessionDuration = o.MaxSessionDuration
+	}
+
+	if o.BandwidthLimit != 0 {
+		s.Settings.BandwidthLimit = o.BandwidthLimit
+	}
+
+	if err := New(s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
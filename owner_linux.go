@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package sftp_server
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the user and group that own the file described by info.
+func fileOwner(info os.FileInfo) (SftpUser, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return SftpUser{}, false
+	}
+
+	return SftpUser{Uid: int(st.Uid), Gid: int(st.Gid)}, true
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+import (
+	"os"
+)
+
+func fileOwner(info os.FileInfo) (SftpUser, bool) {
+	return SftpUser{}, false
+}
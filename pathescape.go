@@ -0,0 +1,61 @@
+package sftp_server
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+// Determines if an error returned by the PathValidator means the requested path escapes the
+// server's directory.
+func isPathEscape(err error) bool {
+	return errors.Is(err, ErrPathEscape)
+}
+
+// Records an attempt by the session to access a path outside of the server's directory. These
+// are never the result of normal use, so they are logged as security events along with the raw
+// path that was requested, and the session is closed once it has made PathEscapeLimit attempts.
+func (fs FileSystem) pathEscape(p string, err error) {
+	if fs.metrics != nil {
+		fs.metrics.Inc("path_escape_attempts_total")
+	}
+
+	var user, ip string
+	if fs.session != nil {
+		user, ip = fs.session.user, remoteIP(fs.session.conn.RemoteAddr())
+	}
+
+	fields := []interface{}{zap.String("path", p), zap.Error(err)}
+	if fs.Cache != nil && fs.session != nil {
+		fields = append(fields, zap.Int("user_attempts", countAttempt(fs.Cache, "path_escape:user:"+user)))
+		if ip != "" {
+			fields = append(fields, zap.Int("ip_attempts", countAttempt(fs.Cache, "path_escape:ip:"+ip)))
+		}
+	}
+
+	fs.logger.Warnw("request attempted to access a path outside of the server directory", fields...)
+	fs.emit(EventPathEscape, p, "")
+
+	if fs.session == nil || fs.PathEscapeLimit <= 0 {
+		return
+	}
+
+	if n := atomic.AddInt32(&fs.session.escapes, 1); int(n) == fs.PathEscapeLimit {
+		fs.logger.Warnw("closing sftp session after repeated attempts to access paths outside of the server directory", zap.Int32("attempts", n))
+		if fs.metrics != nil {
+			fs.metrics.Inc("sessions_terminated_path_escape_total")
+		}
+
+		go fs.session.close()
+	}
+}
+
+// Increments a counter held in the cache for a day, returning its new value.
+func countAttempt(c *cache.Cache, key string) int {
+	c.Add(key, 0, 24*time.Hour)
+	n, _ := c.IncrementInt(key, 1)
+
+	return n
+}
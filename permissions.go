@@ -0,0 +1,45 @@
+package sftp_server
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+)
+
+// The names of the permissions as they are shown to server owners in the Panel, used when
+// telling a user which permission they are missing.
+var permissionNames = map[string]string{
+	PermissionFileRead:        "List Files",
+	PermissionFileReadContent: "Read File Contents",
+	PermissionFileCreate:      "Create Files",
+	PermissionFileUpdate:      "Update Files",
+	PermissionFileDelete:      "Delete Files",
+}
+
+// Denies a request because the user lacks the given permission. Users hitting the same missing
+// permission repeatedly, such as a client retrying a failed delete, are told which permission
+// they lack once PermissionNoticeThreshold requests have been denied, since most clients only
+// show a generic error that users otherwise report as a bug.
+func (fs FileSystem) permissionDenied(permission string, p string) error {
+	if fs.metrics != nil {
+		fs.metrics.Inc("permission_denied_total")
+	}
+
+	fs.logger.Debugw("denied request, user lacks permission", zap.String("permission", permission), zap.String("path", p))
+
+	if fs.session == nil || fs.PermissionNoticeThreshold <= 0 {
+		return ErrPermissionDenied
+	}
+
+	if n := fs.session.denied(permission); n == fs.PermissionNoticeThreshold {
+		name, ok := permissionNames[permission]
+		if !ok {
+			name = permission
+		}
+
+		fs.session.notify(fmt.Sprintf("Your account lacks the %s permission on this server, ask the server owner to grant it if you need it.", name))
+		fs.logger.Infow("notified user of missing permission", zap.String("permission", permission), zap.Int("denials", n))
+		fs.emit(EventPermissionNotice, p, permission)
+	}
+
+	return ErrPermissionDenied
+}
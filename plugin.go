@@ -0,0 +1,362 @@
+package sftp_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The version of the interface between the server and external plugins. This is only changed
+// if an incompatible change is made, new fields may be added to RequestContext at any time.
+const PluginABIVersion = 1
+
+// The information about a request that is passed to middleware.
+type RequestContext struct {
+	Method string `json:"method"`
+	Server string `json:"server"`
+	User   string `json:"user"`
+	IP     string `json:"ip"`
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	// The size of the file at Path, or zero if it does not exist. The size of an upload is not
+	// known when it begins, so for Put this is zero and the middleware is run a second time
+	// with the size of the uploaded file once the upload is complete, discarding it if denied.
+	Size        int64    `json:"size"`
+	Permissions []string `json:"permissions"`
+	SessionID   string   `json:"session_id"`
+	RequestID   string   `json:"request_id"`
+}
+
+// Called before each SFTP request is handled, allowing hosts to add custom behavior such as
+// naming policies, quotas or notifications. Returning a DeniedError rejects the request with
+// the error's message, while any other error rejects it with a generic failure.
+//
+// Operations made outside of SFTP, such as Copy, RestoreVersion, PromoteUpload and the exec
+// commands, are passed to middleware as the SFTP requests they are equivalent to, so that the
+// same rules apply to them. For example, copying a file is a Get of the source followed by a
+// Put of the target. Removing a directory is also passed as a Remove of each file within it.
+type Middleware func(ctx RequestContext) error
+
+// Returned by middleware to deny a request. The message is sent to the client.
+type DeniedError struct {
+	Message string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Message
+}
+
+// Runs the middleware for the request, returning the error that should be sent to the client
+// if it was denied. Every operation on the files of a server, whether made over SFTP or not,
+// passes through here before it is made.
+func (fs FileSystem) runMiddleware(method string, p string, target string) error {
+	if len(fs.middleware) == 0 {
+		return nil
+	}
+
+	// The path is resolved again when the request is handled, so attempts to escape the
+	// server's directory are only recorded there.
+	resolved, err := fs.PathValidator(fs, p)
+	if err != nil {
+		resolved = ""
+	}
+
+	var size int64
+	if method != "Put" && resolved != "" {
+		if st, err := os.Lstat(resolved); err == nil {
+			size = st.Size()
+		}
+	}
+
+	if err := fs.runMiddlewareWithSize(method, p, target, size); err != nil {
+		return err
+	}
+
+	// Rules protecting files, such as one denying the removal of "*.db", must not be avoided
+	// by removing the directory containing them instead.
+	if method == "Rmdir" && resolved != "" {
+		return walkFiles(resolved, nil, func(f string, info os.FileInfo) error {
+			rel, err := filepath.Rel(resolved, f)
+			if err != nil {
+				return nil
+			}
+
+			return fs.runMiddlewareWithSize("Remove", path.Join(p, filepath.ToSlash(rel)), "", info.Size())
+		})
+	}
+
+	return nil
+}
+
+// Runs the middleware for a request involving a file of the given size.
+func (fs FileSystem) runMiddlewareWithSize(method string, p string, target string, size int64) error {
+	if len(fs.middleware) == 0 {
+		return nil
+	}
+
+	ctx := RequestContext{
+		Method:      method,
+		Server:      fs.UUID,
+		Path:        p,
+		Target:      target,
+		Size:        size,
+		Permissions: fs.Permissions,
+		RequestID:   fs.requestID,
+	}
+
+	if fs.session != nil {
+		ctx.User = fs.session.user
+		ctx.IP = fs.session.ip
+		ctx.SessionID = fs.session.id
+		ctx.Permissions = fs.session.getPermissions()
+	}
+
+	for _, m := range fs.middleware {
+		if err := m(ctx); err != nil {
+			var denied *DeniedError
+			if errors.As(err, &denied) {
+				return fs.deny(DenialPolicy, p, denied)
+			}
+
+			fs.logger.Warnw("middleware failed to handle request", zap.Error(err))
+			return ErrPermissionDenied
+		}
+	}
+
+	return nil
+}
+
+// Closes a file that was uploaded through the middleware again, now that the size of the
+// upload is known. Uploads that are denied are discarded.
+type middlewareFile struct {
+	backendFile
+	fs   FileSystem
+	name string
+	path string
+}
+
+func (fs FileSystem) withMiddleware(f backendFile, name string, p string) backendFile {
+	if len(fs.middleware) == 0 {
+		return f
+	}
+
+	return &middlewareFile{backendFile: f, fs: fs, name: name, path: p}
+}
+
+func (f *middlewareFile) Close() error {
+	written := f.path
+	if u, ok := f.backendFile.(*uploadFile); ok {
+		written = u.written()
+	}
+
+	var size int64
+	if st, err := os.Stat(written); err == nil {
+		size = st.Size()
+	}
+
+	if err := f.fs.runMiddlewareWithSize("Put", f.name, "", size); err != nil {
+		f.discard(err)
+
+		// Discarding an upload only removes the temporary file it was written to, so uploads
+		// written in place are removed here.
+		if written == f.path {
+			os.Remove(f.path)
+		}
+
+		return err
+	}
+
+	return f.backendFile.Close()
+}
+
+// Closes the file without finishing the upload, and returns the given error.
+func (f *middlewareFile) discard(err error) error {
+	if d, ok := f.backendFile.(discarder); ok {
+		return d.discard(err)
+	}
+
+	f.backendFile.Close()
+
+	return err
+}
+
+// An experimental plugin that runs as a separate process, allowing middleware to be written in
+// any language and loaded without recompiling the server. The process is sent one JSON encoded
+// request per line on its standard input and must write one response per line to its standard
+// output, in the same order:
+//
+//	-> {"id": 1, "context": {"method": "Put", "server": "...", "path": "/server.jar", ...}}
+//	<- {"id": 1, "allow": false, "message": "uploading jar files is not permitted"}
+//
+// When it starts, the plugin must first write {"abi": 1} to declare the version of this
+// protocol that it implements.
+type ExternalPlugin struct {
+	// Allows requests if the plugin cannot be reached or does not respond in time, rather
+	// than denying them.
+	FailOpen bool
+	// The amount of time to wait for the plugin to respond to a request.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	id     uint64
+	dead   bool
+}
+
+type pluginRequest struct {
+	ID      uint64         `json:"id"`
+	Context RequestContext `json:"context"`
+}
+
+type pluginResponse struct {
+	ID      uint64 `json:"id"`
+	Allow   bool   `json:"allow"`
+	Message string `json:"message"`
+}
+
+// Starts the plugin at the given path and waits for it to complete the handshake.
+func NewExternalPlugin(path string, args ...string) (*ExternalPlugin, error) {
+	cmd := exec.Command(path, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &ExternalPlugin{Timeout: 5 * time.Second, cmd: cmd, stdin: stdin, stdout: bufio.NewScanner(stdout)}
+
+	var hello struct {
+		ABI int `json:"abi"`
+	}
+
+	if !p.stdout.Scan() {
+		p.Close()
+		return nil, fmt.Errorf("sftp: plugin %s exited before completing handshake", path)
+	}
+
+	if err := json.Unmarshal(p.stdout.Bytes(), &hello); err != nil || hello.ABI != PluginABIVersion {
+		p.Close()
+		return nil, fmt.Errorf("sftp: plugin %s does not implement abi version %d", path, PluginABIVersion)
+	}
+
+	return p, nil
+}
+
+// Returns the middleware function for the plugin.
+func (p *ExternalPlugin) Middleware() Middleware {
+	return func(ctx RequestContext) error {
+		res, err := p.call(ctx)
+		if err != nil {
+			if p.FailOpen {
+				return nil
+			}
+
+			return err
+		}
+
+		if !res.Allow {
+			msg := res.Message
+			if msg == "" {
+				msg = "request denied"
+			}
+
+			return &DeniedError{Message: msg}
+		}
+
+		return nil
+	}
+}
+
+// Sends a request to the plugin and waits for its response. Only one request is sent to the
+// plugin at a time. If the plugin fails to respond in time it is stopped, since its responses
+// could no longer be matched up with the requests that were sent.
+func (p *ExternalPlugin) call(ctx RequestContext) (*pluginResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.dead {
+		return nil, errors.New("sftp: plugin is not running")
+	}
+
+	p.id++
+	b, err := json.Marshal(pluginRequest{ID: p.id, Context: ctx})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.stdin.Write(append(b, '\n')); err != nil {
+		p.stop()
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	var res pluginResponse
+	go func() {
+		if !p.stdout.Scan() {
+			done <- errors.New("sftp: plugin exited")
+			return
+		}
+
+		done <- json.Unmarshal(p.stdout.Bytes(), &res)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			p.stop()
+			return nil, err
+		}
+	case <-time.After(p.Timeout):
+		p.stop()
+		<-done
+		return nil, errors.New("sftp: plugin did not respond in time")
+	}
+
+	if res.ID != p.id {
+		p.stop()
+		return nil, errors.New("sftp: plugin responded to the wrong request")
+	}
+
+	return &res, nil
+}
+
+// Stops the plugin process. The caller must hold the lock.
+func (p *ExternalPlugin) stop() {
+	if p.dead {
+		return
+	}
+
+	p.dead = true
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// Stops the plugin.
+func (p *ExternalPlugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stop()
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package sftp_server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// The effects that a policy rule can have on a request.
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// A rule that is evaluated against each SFTP request. A rule matches a request when every one of
+// its conditions matches, with conditions that are left empty matching everything. For example,
+// the following rule denies deleting database files overnight:
+//
+//	{"effect": "deny", "methods": ["Remove"], "paths": ["*.db"], "from": "00:00", "to": "06:00"}
+type PolicyRule struct {
+	// The effect of the rule when it matches, one of PolicyAllow or PolicyDeny.
+	Effect string `json:"effect"`
+	// The SFTP methods the rule applies to, such as "Get", "Put", "Remove" or "Rename".
+	Methods []string `json:"methods,omitempty"`
+	// Patterns matching the paths the rule applies to. Patterns without a slash match the file
+	// name in any directory, while patterns with one are matched against the full path.
+	Paths []string `json:"paths,omitempty"`
+	// The users and servers the rule applies to.
+	Users   []string `json:"users,omitempty"`
+	Servers []string `json:"servers,omitempty"`
+	// The rule only applies to users that have, or do not have, this permission.
+	Permission    string `json:"permission,omitempty"`
+	NotPermission string `json:"not_permission,omitempty"`
+	// The rule only applies to files that are at least, or at most, this many bytes in size.
+	MinSize int64 `json:"min_size,omitempty"`
+	MaxSize int64 `json:"max_size,omitempty"`
+	// The local time of day, in the form "15:04", between which the rule applies. The window
+	// may wrap past midnight.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// The message sent to the client when the rule denies a request.
+	Message string `json:"message,omitempty"`
+}
+
+// Returns an error if the rule is not valid.
+func (r PolicyRule) validate() error {
+	if r.Effect != PolicyAllow && r.Effect != PolicyDeny {
+		return fmt.Errorf("sftp: invalid policy effect \"%s\"", r.Effect)
+	}
+
+	if (r.From == "") != (r.To == "") {
+		return fmt.Errorf("sftp: policy rules must set both from and to")
+	}
+
+	for _, t := range []string{r.From, r.To} {
+		if _, err := parseTimeOfDay(t); t != "" && err != nil {
+			return fmt.Errorf("sftp: invalid policy time \"%s\"", t)
+		}
+	}
+
+	for _, p := range r.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("sftp: invalid policy path \"%s\"", p)
+		}
+	}
+
+	return nil
+}
+
+// Determines if the rule matches the request.
+func (r PolicyRule) matches(ctx RequestContext, now time.Time) bool {
+	if len(r.Methods) > 0 && !containsFold(r.Methods, ctx.Method) {
+		return false
+	}
+
+	if len(r.Users) > 0 && !containsFold(r.Users, ctx.User) {
+		return false
+	}
+
+	if len(r.Servers) > 0 && !containsFold(r.Servers, ctx.Server) {
+		return false
+	}
+
+	if len(r.Paths) > 0 {
+		matched := false
+		for _, p := range r.Paths {
+			if matchesFilePattern(p, ctx.Path) || (ctx.Target != "" && matchesFilePattern(p, ctx.Target)) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if r.Permission != "" && !hasPermission(ctx.Permissions, r.Permission) {
+		return false
+	}
+
+	if r.NotPermission != "" && hasPermission(ctx.Permissions, r.NotPermission) {
+		return false
+	}
+
+	if (r.MinSize > 0 && ctx.Size < r.MinSize) || (r.MaxSize > 0 && ctx.Size > r.MaxSize) {
+		return false
+	}
+
+	if r.From != "" && !inTimeWindow(r.From, r.To, now) {
+		return false
+	}
+
+	return true
+}
+
+// Determines if the time of day is within the window between the two times, in the form
+// "15:04". The window may wrap past midnight.
+func inTimeWindow(from string, to string, now time.Time) bool {
+	f, _ := parseTimeOfDay(from)
+	e, _ := parseTimeOfDay(to)
+	t := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+
+	if f <= e {
+		return t >= f && t < e
+	}
+
+	return t >= f || t < e
+}
+
+// A set of rules evaluated against each SFTP request, allowing hosts to express custom rules
+// in their configuration rather than in code. The first rule that matches a request decides
+// whether it is allowed, and requests that match no rules are allowed.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// Creates a policy from the given rules, returning an error if any of them are invalid.
+func NewPolicy(rules []PolicyRule) (*Policy, error) {
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%w (rule %d)", err, i)
+		}
+	}
+
+	return &Policy{Rules: rules}, nil
+}
+
+// Returns the middleware function that enforces the policy.
+func (p *Policy) Middleware() Middleware {
+	return func(ctx RequestContext) error {
+		now := time.Now()
+		for _, r := range p.Rules {
+			if !r.matches(ctx, now) {
+				continue
+			}
+
+			if r.Effect == PolicyDeny {
+				msg := r.Message
+				if msg == "" {
+					msg = "this action is not permitted by the server's policy"
+				}
+
+				return &DeniedError{Message: msg}
+			}
+
+			return nil
+		}
+
+		return nil
+	}
+}
+
+// Parses a time of day in the form "15:04" into the duration since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Determines if any of the permissions grant the given permission.
+func hasPermission(permissions []string, permission string) bool {
+	for _, p := range permissions {
+		if matchesPermission(p, permission) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,150 @@
+package sftp_server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The signature that starts a version 2 PROXY protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Returned when a connection does not start with a valid PROXY protocol header.
+var errInvalidProxyHeader = errors.New("sftp: invalid proxy protocol header")
+
+// A connection accepted from a proxy, reporting the address of the client the proxy accepted
+// the connection from as its remote address.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Reads the PROXY protocol header sent by an SSH gateway or load balancer at the start of the
+// connection, in either the text or binary format, and returns a connection whose remote address
+// is the client the header names. Headers sent for health checks by the proxy itself, which do
+// not name a client, leave the remote address of the connection unchanged.
+//
+// @see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReaderSize(conn, 256)
+	pc := &proxyConn{Conn: conn, r: r, remote: conn.RemoteAddr()}
+
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	if bytes.Equal(sig, proxyV2Signature) {
+		addr, err = readProxyV2(r)
+	} else {
+		addr, err = readProxyV1(r)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if addr != nil {
+		pc.remote = addr
+	}
+
+	return pc, nil
+}
+
+// Reads a text header, such as "PROXY TCP4 203.0.113.7 192.0.2.1 51234 2022\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	// The longest possible header is 107 bytes including the line ending.
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errInvalidProxyHeader
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, errInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// Reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// Connections made by the proxy itself use the LOCAL command.
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	} else if hdr[12]&0x0f != 1 {
+		return nil, errInvalidProxyHeader
+	}
+
+	switch hdr[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,91 @@
+package sftp_server
+
+// The priority classes the Panel can assign to a login, based on the user's relationship to
+// the server. Hosts may also define their own classes.
+const (
+	PriorityAdmin   = "admin"
+	PriorityOwner   = "owner"
+	PrioritySubuser = "subuser"
+)
+
+// The limits applied to the sessions in a priority class. For example, subusers could be limited
+// to a few sessions sharing a small amount of bandwidth, while admin sessions are exempt from
+// the node-wide bandwidth limit so that a rescue session is never starved by bulk downloads.
+type PriorityClass struct {
+	// The maximum number of sessions in the class that may be open at once, across the cluster
+	// when a State store is configured, further logins are rejected. A value of 0 does not
+	// limit sessions.
+	MaxSessions int `json:"max_sessions,omitempty"`
+	// The maximum rate in bytes per second shared by every session in the class. A value of 0
+	// does not limit transfers beyond the node-wide limit.
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+	// Exempts sessions in the class from the node-wide bandwidth limit and schedule.
+	Unthrottled bool `json:"unthrottled,omitempty"`
+}
+
+// The state shared by every session in a priority class.
+type priorityClass struct {
+	PriorityClass
+	sessions  chan struct{}
+	bandwidth *bandwidthLimiter
+}
+
+// The bandwidth limit of the class is split between the instances of a cluster in proportion to
+// the number of sessions in the class each of them is serving.
+func newPriorityClass(name string, pc PriorityClass, cluster *clusterCounts) *priorityClass {
+	p := &priorityClass{PriorityClass: pc}
+	if pc.MaxSessions > 0 {
+		p.sessions = make(chan struct{}, pc.MaxSessions)
+	}
+
+	if pc.BandwidthLimit > 0 {
+		p.bandwidth = newBandwidthLimiter(func() int64 { return cluster.share("class_sessions:"+name, pc.BandwidthLimit) })
+	}
+
+	return p
+}
+
+// Reserves a session in the priority class, returning false if the class already has the
+// maximum number of sessions open. The returned function must be called once the session
+// is closed. Sessions without a configured class are always allowed. When a State store is
+// configured the maximum applies to the sessions in the class across the entire cluster.
+func (c Server) acquirePriorityClass(class string) (func(), bool) {
+	p, ok := c.classes[class]
+	if !ok {
+		return func() {}, true
+	}
+
+	if c.State != nil {
+		return c.acquireShared("class_sessions:"+class, p.MaxSessions)
+	}
+
+	if p.sessions == nil {
+		return func() {}, true
+	}
+
+	select {
+	case p.sessions <- struct{}{}:
+		return func() { <-p.sessions }, true
+	default:
+		return nil, false
+	}
+}
+
+// Returns the bandwidth limiters that apply to a session in the given priority class.
+func (c Server) bandwidthLimiters(class string) []*bandwidthLimiter {
+	p, ok := c.classes[class]
+	if !ok {
+		return []*bandwidthLimiter{c.bandwidth}
+	}
+
+	var limiters []*bandwidthLimiter
+	if !p.Unthrottled {
+		limiters = append(limiters, c.bandwidth)
+	}
+
+	if p.bandwidth != nil {
+		limiters = append(limiters, p.bandwidth)
+	}
+
+	return limiters
+}
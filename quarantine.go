@@ -0,0 +1,510 @@
+package sftp_server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The hidden directory within a server's root that large uploads are held in until they are
+// promoted into place. Users are able to see it, but not write to it.
+const quarantineDir = ".quarantine"
+
+// The states of a quarantined upload.
+const (
+	// The upload is still being validated.
+	QuarantinePending = "pending"
+	// The upload passed validation and may be promoted.
+	QuarantineValid = "valid"
+	// The upload failed validation. The reason is recorded in the upload's error.
+	QuarantineRejected = "rejected"
+)
+
+// Returned when promoting an upload that has not passed validation.
+var ErrUploadNotValidated = errors.New("sftp: quarantined upload has not passed validation")
+
+// Returned when a quarantined upload does not exist.
+var ErrUploadNotFound = errors.New("sftp: quarantined upload does not exist")
+
+// An upload held in quarantine.
+type QuarantinedUpload struct {
+	ID       string    `json:"id"`
+	Server   string    `json:"server"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	User     string    `json:"user,omitempty"`
+	Uploaded time.Time `json:"uploaded"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Determines if the path requested by the client is within the quarantine directory.
+func isQuarantinePath(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	return name == quarantineDir || strings.HasPrefix(name, quarantineDir+"/")
+}
+
+// Determines if the path on the host is within the quarantine directory, following symlinks so
+// that paths reaching it through one, which isQuarantinePath does not catch, are included.
+func (fs FileSystem) inQuarantine(p string) bool {
+	dir, err := fs.quarantinePath()
+	if err != nil {
+		return false
+	}
+
+	if r, err := evalExisting(dir); err == nil {
+		dir = r
+	}
+
+	if r, err := evalExisting(p); err == nil {
+		p = r
+	}
+
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+// Returns the quarantine directory of the server.
+func (fs FileSystem) quarantinePath() (string, error) {
+	root, err := fs.buildPath("/")
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(root, quarantineDir), nil
+}
+
+// Determines if an upload should be written to the quarantine directory. Only uploads that
+// replace the contents of a file entirely are quarantined, since appending to or resuming an
+// upload of a quarantined file is not possible.
+func (fs FileSystem) quarantines(name string) bool {
+	return fs.QuarantineThreshold > 0 && !isVersionsPath(name) && !isQuarantinePath(name)
+}
+
+// Creates the temporary file in the quarantine directory that an upload is written to. Once the
+// upload is complete it is either moved into place or held in quarantine depending on its size,
+// which requires the upload to be marked using withQuarantine.
+func (fs FileSystem) createQuarantined() (*os.File, error) {
+	dir, err := fs.quarantinePath()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(dir, "upload-")
+	if err != nil {
+		return nil, err
+	}
+
+	// Temporary files are only readable by their owner, but new files are normally created
+	// readable by everyone. Replaced files keep the mode of the file they replace.
+	if err := file.Chmod(0644); err != nil {
+		fs.logger.Warnw("error changing mode of quarantine file", zap.String("file", file.Name()), zap.Error(err))
+	}
+
+	return file, nil
+}
+
+// Marks an upload being written to a file created by createQuarantined as quarantined, so that
+// it is held in quarantine once complete if it is large enough.
+func withQuarantine(f backendFile) backendFile {
+	f.(*uploadFile).quarantine = true
+
+	return f
+}
+
+// Determines if a completed upload should be held in quarantine, which is the case if it is
+// larger than the QuarantineThreshold.
+func (fs FileSystem) holds(f *uploadFile) bool {
+	st, err := os.Stat(f.tmp)
+
+	return err == nil && st.Size() > fs.QuarantineThreshold
+}
+
+// Holds a completed upload in quarantine. The upload is validated in the background so that a
+// client uploading a large world is not left waiting for it to be scanned. The checks that are
+// able to reject an upload outright are made before it is held, while the FileValidators are
+// run once it is promoted, as they are for uploads that replace the file directly.
+func (fs FileSystem) holdUpload(f *uploadFile) error {
+	if existing, err := os.Stat(f.path); err == nil {
+		if err := fs.guardCriticalFile(f, existing); err != nil {
+			os.Remove(f.tmp)
+			return err
+		}
+	}
+
+	if fs.VerifyChecksums {
+		if err := fs.verifyChecksum(f); err != nil {
+			os.Remove(f.tmp)
+			return err
+		}
+	}
+
+	st, err := os.Stat(f.tmp)
+	if err != nil {
+		return err
+	}
+
+	u := QuarantinedUpload{
+		ID:       filepath.Base(f.tmp),
+		Server:   fs.UUID,
+		Path:     path.Clean("/" + f.name),
+		Size:     st.Size(),
+		Uploaded: time.Now(),
+		Status:   QuarantinePending,
+	}
+
+	if fs.session != nil {
+		u.User = fs.session.user
+	}
+
+	if err := writeQuarantined(f.tmp, u); err != nil {
+		fs.logger.Errorw("failed to quarantine upload", zap.String("file", f.name), zap.Error(err))
+		os.Remove(f.tmp)
+		return err
+	}
+
+	fs.logger.Infow("holding large upload in quarantine", zap.String("file", f.name), zap.String("id", u.ID), zap.Int64("size", u.Size))
+	if fs.metrics != nil {
+		fs.metrics.Inc("uploads_quarantined_total")
+	}
+	fs.emit(EventQuarantined, f.name, u.ID)
+
+	go fs.validateQuarantined(f.tmp, u)
+
+	return nil
+}
+
+// Checks that a quarantined upload fits within the server's quota, passes the configured
+// QuarantineScanner, and is a readable archive if it looks like one, recording the result.
+func (fs FileSystem) validateQuarantined(p string, u QuarantinedUpload) {
+	err := checkArchive(p, u.Path)
+	if err == nil && fs.HasDiskSpace != nil && !fs.HasDiskSpace(fs) {
+		err = ErrQuotaExceeded
+	}
+
+	if err == nil && fs.QuarantineScanner != nil {
+		err = fs.QuarantineScanner(fs.UUID, u.Path, p)
+	}
+
+	u.Status = QuarantineValid
+	if err != nil {
+		u.Status = QuarantineRejected
+		u.Error = err.Error()
+		fs.logger.Warnw("quarantined upload failed validation", zap.String("file", u.Path), zap.String("id", u.ID), zap.Error(err))
+	}
+
+	// The upload may have been discarded while it was being validated.
+	if _, serr := os.Stat(p); serr != nil {
+		return
+	}
+
+	if werr := writeQuarantined(p, u); werr != nil {
+		fs.logger.Errorw("failed to record quarantined upload status", zap.String("id", u.ID), zap.Error(werr))
+	}
+}
+
+// Checks the structure of zip and tar archives, catching uploads that were cut short and
+// archives containing entries that would be extracted outside of the directory they are
+// extracted in. The type of archive is determined from the name it was uploaded as, other files
+// are not checked.
+func checkArchive(p string, name string) error {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		r, err := zip.OpenReader(p)
+		if err != nil {
+			return fmt.Errorf("sftp: invalid zip archive: %w", err)
+		}
+		defer r.Close()
+
+		for _, f := range r.File {
+			if err := checkArchiveEntry(f.Name); err != nil {
+				return err
+			}
+		}
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		if !strings.HasSuffix(lower, ".tar") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return fmt.Errorf("sftp: invalid tar archive: %w", err)
+			}
+			defer gz.Close()
+			r = gz
+		}
+
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("sftp: invalid tar archive: %w", err)
+			}
+
+			if err := checkArchiveEntry(h.Name); err != nil {
+				return err
+			}
+
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return fmt.Errorf("sftp: invalid tar archive: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkArchiveEntry(name string) error {
+	name = filepath.ToSlash(name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "/../") || strings.HasSuffix(name, "/..") {
+		return fmt.Errorf("sftp: archive entry \"%s\" is outside of the archive", name)
+	}
+
+	return nil
+}
+
+// Writes the metadata of the quarantined upload at p alongside it, replacing it atomically.
+func writeQuarantined(p string, u QuarantinedUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	tmp := p + ".json.tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p+".json")
+}
+
+// Returns a filesystem for the server that is not associated with a session, used to manage
+// quarantined uploads through the control API.
+func (c Server) serverFileSystem(server string) FileSystem {
+	return NewFileSystem(
+		WithServer(server),
+		WithPermissions([]string{"*"}),
+		WithQuota(c.DiskSpaceValidator),
+		WithPathValidator(c.PathValidator),
+		WithRoot(filepath.Join(c.Settings.BasePath, server)),
+		WithUser(c.User),
+		WithLogger(c.logger.With(zap.String("server", server))),
+		WithSettings(c.Settings),
+		c.withServerState(),
+	)
+}
+
+// Returns the uploads held in quarantine for the server, oldest first.
+func (c *Server) Quarantined(server string) ([]QuarantinedUpload, error) {
+	dir, err := c.serverFileSystem(server).quarantinePath()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := []QuarantinedUpload{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+
+		var u QuarantinedUpload
+		if json.Unmarshal(b, &u) == nil {
+			uploads = append(uploads, u)
+		}
+	}
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Uploaded.Before(uploads[j].Uploaded)
+	})
+
+	return uploads, nil
+}
+
+// Returns the quarantined upload with the given ID and the path of its contents.
+func (c *Server) quarantined(fs FileSystem, id string) (QuarantinedUpload, string, error) {
+	var u QuarantinedUpload
+
+	dir, err := fs.quarantinePath()
+	if err != nil {
+		return u, "", err
+	}
+
+	// Only the names of the temporary files created for uploads are accepted, which also rules
+	// out "." and "..", the metadata files, and anything else a user might have placed there.
+	if !strings.HasPrefix(id, "upload-") || id != filepath.Base(id) || strings.Contains(id, ".") {
+		return u, "", ErrUploadNotFound
+	}
+
+	p := filepath.Join(dir, id)
+	b, err := ioutil.ReadFile(p + ".json")
+	if os.IsNotExist(err) {
+		return u, "", ErrUploadNotFound
+	} else if err != nil {
+		return u, "", err
+	}
+
+	return u, p, json.Unmarshal(b, &u)
+}
+
+// Moves a quarantined upload that has passed validation into place, atomically replacing any
+// existing file so that the game server never sees a partially imported file. The replaced
+// file is kept as a previous version if versioning is enabled.
+func (c *Server) PromoteUpload(server string, id string) error {
+	fs := c.serverFileSystem(server)
+
+	u, p, err := c.quarantined(fs, id)
+	if err != nil {
+		return err
+	}
+
+	if u.Status != QuarantineValid {
+		return ErrUploadNotValidated
+	}
+
+	done, ok := fs.locks.begin(fs.UUID)
+	if !ok {
+		return ErrServerLocked
+	}
+	defer done()
+
+	target, err := fs.buildPath(u.Path)
+	if err != nil {
+		return err
+	}
+
+	if fs.inQuarantine(target) {
+		return ErrPermissionDenied
+	}
+
+	if err := fs.runMiddlewareWithSize("Put", u.Path, "", u.Size); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	owner := fs.User
+	if existing, err := os.Stat(target); err == nil {
+		if existing.IsDir() {
+			return fmt.Errorf("sftp: cannot promote upload over directory %s", u.Path)
+		}
+
+		os.Chmod(p, existing.Mode().Perm())
+		if o, ok := fileOwner(existing); ok && fs.PreserveOwnership {
+			owner = o
+		}
+	}
+
+	if err := os.Chown(p, owner.Uid, owner.Gid); err != nil {
+		fs.logger.Warnw("error chowning file", zap.String("file", p), zap.Error(err))
+	}
+
+	fs.relabel(p)
+	fs.saveVersion(u.Path, target)
+
+	if err := os.Rename(p, target); err != nil {
+		return err
+	}
+	os.Remove(p + ".json")
+	fs.journalChange(EventWrite, u.Path, "")
+	fs.validateFile(u.Path, target)
+
+	fs.logger.Infow("promoted quarantined upload", zap.String("file", u.Path), zap.String("id", id))
+	c.metrics.Inc("uploads_promoted_total")
+
+	return nil
+}
+
+// Deletes a quarantined upload without promoting it.
+func (c *Server) DiscardUpload(server string, id string) error {
+	fs := c.serverFileSystem(server)
+
+	_, p, err := c.quarantined(fs, id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(p + ".json")
+}
+
+// Returns a HTTP handler managing the quarantined uploads of the server given by the "server"
+// parameter, so that it can be mounted on the daemon's control API. GET requests list the
+// uploads, while POST and DELETE requests promote or discard the upload given by the "id"
+// parameter.
+func (c *Server) QuarantineHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server := r.URL.Query().Get("server")
+		if server == "" {
+			http.Error(w, "missing server parameter", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			var uploads []QuarantinedUpload
+			if uploads, err = c.Quarantined(server); err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(uploads)
+				return
+			}
+		case http.MethodPost:
+			err = c.PromoteUpload(server, r.URL.Query().Get("id"))
+		case http.MethodDelete:
+			err = c.DiscardUpload(server, r.URL.Query().Get("id"))
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, ErrUploadNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrUploadNotValidated):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.As(err, new(*DenialError)), errors.Is(err, ErrPermissionDenied), errors.Is(err, ErrServerLocked):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			c.logger.Errorw("failed to manage quarantined upload", zap.String("server", server), zap.Error(err))
+			http.Error(w, "failed to manage quarantined upload", http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package sftp_server
+
+import (
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"io"
+	"runtime/debug"
+)
+
+// Wraps the handlers for a session so that a panic triggered while handling a single request
+// only terminates the affected session, rather than crashing the entire SFTP server and every
+// other session being served by it.
+type recoveryHandler struct {
+	fs      FileSystem
+	session *session
+	metrics *Metrics
+}
+
+// Returns a copy of the filesystem whose logger is annotated with a unique ID for the request
+// being handled, allowing every log line produced for it to be correlated.
+func (h recoveryHandler) withRequest(request *sftp.Request) FileSystem {
+	fs := h.fs
+	fs.requestID = newRequestID()
+	fs.logger = fs.logger.With(zap.String("request_id", fs.requestID), zap.String("method", request.Method))
+
+	return fs
+}
+
+// Recovers from a panic in one of the handler functions, logging the stack trace and closing
+// the session that triggered it. The error pointer is updated to return a generic failure to
+// the client.
+func (h recoveryHandler) recover(method string, err *error) {
+	if r := recover(); r != nil {
+		h.fs.logger.Errorw("recovered from panic in sftp handler",
+			zap.String("method", method),
+			zap.Any("panic", r),
+			zap.ByteString("stack", debug.Stack()),
+		)
+
+		if h.metrics != nil {
+			h.metrics.Inc("handler_panics_total")
+		}
+
+		if h.session != nil {
+			go h.session.close()
+		}
+
+		*err = sftp.ErrSshFxFailure
+	}
+}
+
+func (h recoveryHandler) Fileread(request *sftp.Request) (r io.ReaderAt, err error) {
+	defer h.recover(request.Method, &err)
+
+	r, err = h.withRequest(request).Fileread(request)
+
+	return r, statusError(err)
+}
+
+func (h recoveryHandler) Filewrite(request *sftp.Request) (w io.WriterAt, err error) {
+	defer h.recover(request.Method, &err)
+
+	w, err = h.withRequest(request).Filewrite(request)
+
+	return w, statusError(err)
+}
+
+func (h recoveryHandler) Filecmd(request *sftp.Request) (err error) {
+	defer h.recover(request.Method, &err)
+
+	return statusError(h.withRequest(request).Filecmd(request))
+}
+
+func (h recoveryHandler) Filelist(request *sftp.Request) (l sftp.ListerAt, err error) {
+	defer h.recover(request.Method, &err)
+
+	l, err = h.withRequest(request).Filelist(request)
+
+	return l, statusError(err)
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package sftp_server
+
+import (
+	"os"
+	"syscall"
+)
+
+// The FICLONE ioctl request number, see ioctl_ficlone(2).
+const ficlone = 0x40049409
+
+// Attempts to create a copy-on-write clone of the source file at the destination. This is
+// only supported on filesystems such as btrfs and XFS, an error is returned on any other
+// filesystem and the caller is expected to fall back to a regular copy.
+func reflink(dst *os.File, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+import (
+	"os"
+	"syscall"
+)
+
+// Reflinks are only supported on Linux, always fall back to a regular copy.
+func reflink(dst *os.File, src *os.File) error {
+	return syscall.ENOTSUP
+}
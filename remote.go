@@ -0,0 +1,400 @@
+package sftp_server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The versions of the Panel API supported by the client, in order of preference.
+var panelAPIVersions = []string{"v2", "v1"}
+
+// A client for the Panel's remote API, which can be used as the CredentialValidator for the
+// server by applications that do not need to customize how credentials are validated.
+type PanelClient struct {
+	BaseURL string
+	Token   string
+
+	HTTPClient *http.Client
+	// The maximum size of a response body that will be read from the Panel. Responses larger
+	// than this are treated as invalid. A value of zero disables the limit.
+	MaxResponseSize int64
+	// Fetches the token from a secret store such as Vault, see VaultSecret. When set the token
+	// is fetched again whenever the Panel rejects it, and periodically by WatchToken, so that
+	// rotated tokens are picked up without restarting the server.
+	TokenSource func() (string, error)
+
+	mu      sync.Mutex
+	version string
+}
+
+// An error returned by the Panel API.
+type PanelError struct {
+	Status int    `json:"-"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func (e *PanelError) Error() string {
+	return fmt.Sprintf("sftp: panel returned error: status=%d code=%s detail=%s", e.Status, e.Code, e.Detail)
+}
+
+// Options controlling how the client connects to the Panel. Large Panels under load may need
+// longer timeouts, while smaller ones may prefer to fail fast.
+type PanelClientOptions struct {
+	// The total amount of time allowed for a request, including reading the response.
+	Timeout time.Duration
+	// The amount of time allowed for the TLS handshake with the Panel.
+	TLSHandshakeTimeout time.Duration
+	// The maximum size of a response body, see PanelClient.MaxResponseSize.
+	MaxResponseSize int64
+	// The interval between keep-alive probes on connections to the Panel.
+	KeepAlive time.Duration
+	// The amount of time an idle connection to the Panel is kept open for reuse.
+	IdleConnTimeout time.Duration
+	// Disables reuse of connections to the Panel, opening a new one for every request.
+	DisableKeepAlives bool
+}
+
+// Returns the default options used by NewPanelClient.
+func DefaultPanelClientOptions() PanelClientOptions {
+	return PanelClientOptions{
+		Timeout:             10 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxResponseSize:     1 << 20,
+		KeepAlive:           30 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// Returned when the Panel responds with a body that is larger than the client's configured
+// MaxResponseSize.
+var ErrPanelResponseTooLarge = errors.New("sftp: panel response exceeds maximum size")
+
+// An error returned when a successful response from the Panel could not be decoded. These are
+// considered to be invalid responses, so errors.Is(err, ErrInvalidResponse) is true.
+type PanelDecodeError struct {
+	Status int
+	Err    error
+}
+
+func (e *PanelDecodeError) Error() string {
+	return fmt.Sprintf("sftp: failed to decode panel response: status=%d: %s", e.Status, e.Err)
+}
+
+func (e *PanelDecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PanelDecodeError) Is(target error) bool {
+	return target == ErrInvalidResponse
+}
+
+// Creates a new client for the Panel API at the given base URL.
+func NewPanelClient(baseURL string, token string) *PanelClient {
+	return NewPanelClientWithOptions(baseURL, token, DefaultPanelClientOptions())
+}
+
+// Creates a new client for the Panel API at the given base URL using the provided options.
+// Any options that are left as zero use their default value, with the exception of
+// DisableKeepAlives.
+func NewPanelClientWithOptions(baseURL string, token string, opts PanelClientOptions) *PanelClient {
+	d := DefaultPanelClientOptions()
+	if opts.Timeout == 0 {
+		opts.Timeout = d.Timeout
+	}
+
+	if opts.TLSHandshakeTimeout == 0 {
+		opts.TLSHandshakeTimeout = d.TLSHandshakeTimeout
+	}
+
+	if opts.MaxResponseSize == 0 {
+		opts.MaxResponseSize = d.MaxResponseSize
+	}
+
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = d.KeepAlive
+	}
+
+	if opts.IdleConnTimeout == 0 {
+		opts.IdleConnTimeout = d.IdleConnTimeout
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   opts.Timeout,
+			KeepAlive: opts.KeepAlive,
+		}).DialContext,
+		TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		DisableKeepAlives:   opts.DisableKeepAlives,
+		MaxIdleConns:        100,
+	}
+
+	return &PanelClient{
+		BaseURL:         strings.TrimSuffix(baseURL, "/"),
+		Token:           token,
+		HTTPClient:      &http.Client{Timeout: opts.Timeout, Transport: transport},
+		MaxResponseSize: opts.MaxResponseSize,
+	}
+}
+
+// Describes the client without its token, so that it is never written to the logs when the
+// client is printed.
+func (p *PanelClient) String() string {
+	return fmt.Sprintf("PanelClient{BaseURL: %q, Token: <redacted>}", p.BaseURL)
+}
+
+func (p *PanelClient) GoString() string {
+	return p.String()
+}
+
+// Returns the version of the Panel API that was negotiated with the Panel. This is empty
+// until the first request has been made.
+func (p *PanelClient) APIVersion() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.version
+}
+
+// Returns the Accept header sent to the Panel, listing every supported API version with the
+// most preferred version first.
+func acceptHeader() string {
+	types := make([]string, len(panelAPIVersions))
+	for i, v := range panelAPIVersions {
+		types[i] = fmt.Sprintf("application/vnd.pterodactyl.%s+json;q=%.1f", v, 1-float64(i)/10)
+	}
+
+	return strings.Join(types, ", ")
+}
+
+// Records the API version the Panel responded with, based on the response content type.
+func (p *PanelClient) negotiate(res *http.Response) {
+	ct := res.Header.Get("Content-Type")
+	for _, v := range panelAPIVersions {
+		if strings.Contains(ct, "vnd.pterodactyl."+v+"+json") {
+			p.mu.Lock()
+			p.version = v
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Returns the token currently used to authenticate with the Panel.
+func (p *PanelClient) token() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.Token
+}
+
+// Fetches the token from the client's TokenSource, replacing the token currently in use.
+func (p *PanelClient) RefreshToken() error {
+	if p.TokenSource == nil {
+		return errors.New("sftp: panel client does not have a token source")
+	}
+
+	t, err := p.TokenSource()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.Token = t
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Refreshes the token from the client's TokenSource at the given interval until the returned
+// function is called, passing any errors to onError if it is not nil. The token currently in
+// use is kept when a refresh fails.
+func (p *PanelClient) WatchToken(interval time.Duration, onError func(err error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := p.RefreshToken(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Makes a request to the Panel API, decoding a successful response into v. If the Panel
+// rejects the token and the client has a TokenSource, the token is refreshed and the request
+// is retried once, since the token may have been rotated.
+func (p *PanelClient) request(method string, endpoint string, requestID string, body interface{}, v interface{}) error {
+	err := p.do(method, endpoint, requestID, body, v)
+
+	var pe *PanelError
+	if errors.As(err, &pe) && pe.Status == http.StatusUnauthorized && p.TokenSource != nil {
+		if rerr := p.RefreshToken(); rerr == nil {
+			return p.do(method, endpoint, requestID, body, v)
+		}
+	}
+
+	return err
+}
+
+// Makes a single request to the Panel API, decoding a successful response into v. Connection
+// failures and server errors are returned as ErrPanelUnavailable.
+func (p *PanelClient) do(method string, endpoint string, requestID string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, p.BaseURL+endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", acceptHeader())
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.token())
+	if requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrPanelUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	p.negotiate(res)
+
+	var r io.Reader = res.Body
+	if p.MaxResponseSize > 0 {
+		r = &limitedReader{r: res.Body, n: p.MaxResponseSize}
+	}
+
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("%w: status %d", ErrPanelUnavailable, res.StatusCode)
+	}
+
+	if res.StatusCode >= 400 {
+		var errs struct {
+			Errors []PanelError `json:"errors"`
+		}
+
+		pe := &PanelError{Status: res.StatusCode}
+		if err := json.NewDecoder(r).Decode(&errs); err == nil && len(errs.Errors) > 0 {
+			pe.Code, pe.Detail = errs.Errors[0].Code, errs.Errors[0].Detail
+		}
+
+		return pe
+	}
+
+	// Only a JSON object is a valid response, anything else, including a literal null, would
+	// otherwise decode without an error and leave v zero-valued.
+	br := bufio.NewReader(r)
+	if c, err := firstNonSpace(br); err != nil {
+		return &PanelDecodeError{Status: res.StatusCode, Err: err}
+	} else if c != '{' {
+		return &PanelDecodeError{Status: res.StatusCode, Err: fmt.Errorf("expected a JSON object but found %q", c)}
+	}
+
+	if err := json.NewDecoder(br).Decode(v); err != nil {
+		return &PanelDecodeError{Status: res.StatusCode, Err: err}
+	}
+
+	return nil
+}
+
+// Returns the first byte of the reader that is not whitespace without consuming it.
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// A reader that returns ErrPanelResponseTooLarge once more than n bytes have been read from
+// the underlying reader, rather than silently truncating the response like io.LimitReader.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Only fail if there is actually more data to be read, a response that is exactly
+		// the maximum size is still valid.
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+
+		return 0, ErrPanelResponseTooLarge
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+
+	return n, err
+}
+
+// The error code the Panel responds with when it does not accept the node's token, which
+// shares its status with the response for invalid credentials.
+const panelTokenRejectedCode = "AccessDeniedHttpException"
+
+// Validates the credentials for a user against the Panel. An InvalidCredentialsError is
+// returned if the Panel rejects the credentials, while ErrPanelTokenRejected is returned if
+// it rejects the node's token instead.
+func (p *PanelClient) ValidateCredentials(r AuthenticationRequest) (*AuthenticationResponse, error) {
+	var resp AuthenticationResponse
+	err := p.request(http.MethodPost, "/api/remote/sftp/auth", r.RequestID, r, &resp)
+	if err != nil {
+		var pe *PanelError
+		if !errors.As(err, &pe) {
+			return nil, err
+		}
+
+		switch {
+		case pe.Status == http.StatusUnauthorized, pe.Status == http.StatusForbidden && pe.Code == panelTokenRejectedCode:
+			return nil, fmt.Errorf("%w: %s", ErrPanelTokenRejected, pe)
+		case pe.Status == http.StatusForbidden, pe.Status == http.StatusNotFound:
+			return nil, &InvalidCredentialsError{}
+		}
+
+		return nil, err
+	}
+
+	return &resp, nil
+}
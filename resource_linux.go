@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package sftp_server
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Returns the total CPU time used by the process and its current resident set size in bytes.
+func processUsage() (time.Duration, uint64, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0, err
+	}
+
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+
+	b, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return cpu, 0, nil
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return cpu, pages * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+import (
+	"errors"
+	"time"
+)
+
+func processUsage() (time.Duration, uint64, error) {
+	return 0, 0, errors.New("sftp: resource monitoring is not supported on this platform")
+}
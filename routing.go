@@ -0,0 +1,156 @@
+package sftp_server
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A node in a multi-node Panel deployment that serves SFTP for some of its servers.
+type RouteNode struct {
+	// The name of the node, matching the Node setting of the server running on it.
+	Name string `json:"name"`
+	// The address clients should connect to in order to reach the SFTP server on the node,
+	// for example "node2.example.com:2022".
+	Address string `json:"address"`
+	// The relative share of servers assigned to the node by hashing. Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// The topology of a multi-node deployment, as reported by the Panel.
+type Topology struct {
+	Nodes []RouteNode `json:"nodes"`
+	// Explicit assignments of server identifiers to node names. Servers that are not listed
+	// here are assigned to a node using consistent hashing.
+	Servers map[string]string `json:"servers,omitempty"`
+}
+
+// The number of points placed on the ring for each unit of node weight.
+const routerReplicas = 64
+
+type ringPoint struct {
+	hash uint64
+	node int
+}
+
+// Determines which node should serve a given server. Servers explicitly assigned to a node
+// by the Panel are routed there, and all other servers are distributed between the nodes
+// using a consistent hash so that adding or removing a node only moves a small share of them.
+type Router struct {
+	nodes   []RouteNode
+	servers map[string]string
+	ring    []ringPoint
+	indices map[string]int
+}
+
+// Creates a new router for the given topology.
+func NewRouter(t Topology) *Router {
+	r := &Router{
+		nodes:   t.Nodes,
+		servers: make(map[string]string, len(t.Servers)),
+		indices: make(map[string]int, len(t.Nodes)),
+	}
+
+	for id, node := range t.Servers {
+		r.servers[routeKey(id)] = node
+	}
+
+	for i, n := range t.Nodes {
+		r.indices[n.Name] = i
+
+		w := n.Weight
+		if w <= 0 {
+			w = 1
+		}
+
+		for j := 0; j < w*routerReplicas; j++ {
+			r.ring = append(r.ring, ringPoint{hash: routeHash(n.Name + "#" + strconv.Itoa(j)), node: i})
+		}
+	}
+
+	sort.Slice(r.ring, func(i, j int) bool {
+		return r.ring[i].hash < r.ring[j].hash
+	})
+
+	return r
+}
+
+// Returns the node that should serve the server with the given UUID or short identifier,
+// and false if the topology does not contain any nodes.
+func (r *Router) Route(server string) (RouteNode, bool) {
+	key := routeKey(server)
+	if name, ok := r.servers[key]; ok {
+		if i, ok := r.indices[name]; ok {
+			return r.nodes[i], true
+		}
+	}
+
+	if len(r.ring) == 0 {
+		return RouteNode{}, false
+	}
+
+	h := routeHash(key)
+	i := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= h
+	})
+
+	if i == len(r.ring) {
+		i = 0
+	}
+
+	return r.nodes[r.ring[i].node], true
+}
+
+// Returns the key used to route a server. Clients only provide the short identifier of a
+// server when connecting, so only the first eight characters of the UUID are considered in
+// order for the full UUID and the short identifier to route to the same node.
+func routeKey(server string) string {
+	server = strings.ToLower(server)
+	if len(server) > 8 {
+		server = server[:8]
+	}
+
+	return server
+}
+
+func routeHash(s string) uint64 {
+	sum := sha1.Sum([]byte(s))
+
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Returned when a client connects to a node that does not serve the server they are trying
+// to access. The message is suitable for displaying to the user.
+type WrongNodeError struct {
+	Node RouteNode
+}
+
+func (e WrongNodeError) Error() string {
+	return fmt.Sprintf("this server is hosted on %s, please connect to %s instead", e.Node.Name, e.Node.Address)
+}
+
+// Checks that the server identified in the username is served by this node, returning a
+// WrongNodeError pointing the user at the correct node if it is not. Usernames that do not
+// identify a server are always allowed through to the Panel.
+func (c Server) checkRoute(user string) error {
+	if c.Router == nil || c.Settings.Node == "" {
+		return nil
+	}
+
+	id, ok := ParseUsername(user)
+	if !ok {
+		return nil
+	}
+
+	node, ok := c.Router.Route(id.Server)
+	if !ok || node.Name == c.Settings.Node {
+		return nil
+	}
+
+	c.metrics.Inc("auth_wrong_node_total")
+
+	return &WrongNodeError{Node: node}
+}
@@ -0,0 +1,168 @@
+//go:build linux && go1.16 && (amd64 || arm64)
+// +build linux
+// +build go1.16
+// +build amd64 arm64
+
+package sftp_server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	landlockAccessExecute   = 1 << 0
+	landlockAccessWriteFile = 1 << 1
+	landlockAccessReadFile  = 1 << 2
+	landlockAccessReadDir   = 1 << 3
+	landlockAccessRefer     = 1 << 13
+	landlockAccessTruncate  = 1 << 14
+
+	// Every filesystem access right in the first version of the Landlock ABI.
+	landlockAccessABI1 = 1<<13 - 1
+	// The access rights that may be granted on a file rather than a directory.
+	landlockAccessFile = landlockAccessExecute | landlockAccessWriteFile | landlockAccessReadFile | landlockAccessTruncate
+
+	oPath = 0x200000
+
+	prSetNoNewPrivs = 38
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+	seccompRetKillProcess  = 0x80000000
+
+	bpfLoadAbsolute = 0x20
+	bpfJumpEqual    = 0x15
+	bpfReturn       = 0x06
+)
+
+func sandbox(rw []string, ro []string, devices []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("%w: landlock is unavailable: %v", errSandboxUnsupported, errno)
+	}
+
+	handled := uint64(landlockAccessABI1)
+	if abi >= 2 {
+		handled |= landlockAccessRefer
+	}
+	if abi >= 3 {
+		handled |= landlockAccessTruncate
+	}
+
+	attr := handled
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("sftp: failed to create landlock ruleset: %w", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, p := range rw {
+		if err := landlockAllow(int(fd), p, handled); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range ro {
+		if err := landlockAllow(int(fd), p, landlockAccessExecute|landlockAccessReadFile|landlockAccessReadDir); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range devices {
+		if err := landlockAllow(int(fd), p, landlockAccessReadFile|landlockAccessWriteFile); err != nil {
+			return err
+		}
+	}
+
+	// Landlock only restricts the thread that enforces it, so the ruleset must be applied to
+	// every thread of the process. This is not possible in programs using cgo.
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("%w: failed to set no_new_privs: %v", errSandboxUnsupported, errno)
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("sftp: failed to enforce landlock ruleset: %w", errno)
+	}
+
+	return applySeccomp()
+}
+
+// Grants the access rights beneath the given path. Paths that do not exist are skipped.
+func landlockAllow(ruleset int, p string, access uint64) error {
+	fd, err := syscall.Open(p, oPath|syscall.O_CLOEXEC, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("sftp: failed to open %s for sandbox: %w", p, err)
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockAccessFile
+	}
+
+	// struct landlock_path_beneath_attr is packed, so it is built by hand rather than from a
+	// Go struct which would be padded.
+	var attr [12]byte
+	binary.LittleEndian.PutUint64(attr[0:8], access)
+	binary.LittleEndian.PutUint32(attr[8:12], uint32(fd))
+
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0)
+	runtime.KeepAlive(&attr)
+	if errno != 0 {
+		return fmt.Errorf("sftp: failed to add %s to sandbox: %w", p, errno)
+	}
+
+	return nil
+}
+
+// Installs a seccomp filter on every thread that rejects the system calls in seccompDenied
+// with EPERM. A deny list is used rather than an allow list since the set of system calls made
+// by the Go runtime differs between versions. System calls made using a different architecture's
+// calling convention kill the process, since they would bypass the filter.
+func applySeccomp() error {
+	filter := []syscall.SockFilter{
+		{Code: bpfLoadAbsolute, K: 4},
+		{Code: bpfJumpEqual, Jt: 1, K: seccompAuditArch},
+		{Code: bpfReturn, K: seccompRetKillProcess},
+		{Code: bpfLoadAbsolute, K: 0},
+	}
+
+	for i, nr := range seccompDenied {
+		// Jump to the EPERM return at the end of the list when the system call matches.
+		filter = append(filter, syscall.SockFilter{Code: bpfJumpEqual, Jt: uint8(len(seccompDenied) - i), K: nr})
+	}
+
+	filter = append(filter,
+		syscall.SockFilter{Code: bpfReturn, K: seccompRetAllow},
+		syscall.SockFilter{Code: bpfReturn, K: seccompRetErrno | uint32(syscall.EPERM)},
+	)
+
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.Syscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return fmt.Errorf("sftp: failed to install seccomp filter: %w", errno)
+	}
+
+	return nil
+}
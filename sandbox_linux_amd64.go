@@ -0,0 +1,38 @@
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package sftp_server
+
+const (
+	sysSeccomp       = 317
+	seccompAuditArch = 0xc000003e
+)
+
+// The system calls blocked by the seccomp filter. None of these are ever needed by the server,
+// but are useful to an attacker that has found a way to run code in the process.
+var seccompDenied = []uint32{
+	101, // ptrace
+	155, // pivot_root
+	161, // chroot
+	163, // acct
+	164, // settimeofday
+	165, // mount
+	166, // umount2
+	167, // swapon
+	168, // swapoff
+	169, // reboot
+	175, // init_module
+	176, // delete_module
+	246, // kexec_load
+	248, // add_key
+	250, // keyctl
+	272, // unshare
+	298, // perf_event_open
+	308, // setns
+	310, // process_vm_readv
+	311, // process_vm_writev
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+	323, // userfaultfd
+}
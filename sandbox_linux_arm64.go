@@ -0,0 +1,38 @@
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package sftp_server
+
+const (
+	sysSeccomp       = 277
+	seccompAuditArch = 0xc00000b7
+)
+
+// The system calls blocked by the seccomp filter. None of these are ever needed by the server,
+// but are useful to an attacker that has found a way to run code in the process.
+var seccompDenied = []uint32{
+	39,  // umount2
+	40,  // mount
+	41,  // pivot_root
+	51,  // chroot
+	89,  // acct
+	97,  // unshare
+	104, // kexec_load
+	105, // init_module
+	106, // delete_module
+	117, // ptrace
+	142, // reboot
+	170, // settimeofday
+	217, // add_key
+	219, // keyctl
+	224, // swapon
+	225, // swapoff
+	241, // perf_event_open
+	268, // setns
+	270, // process_vm_readv
+	271, // process_vm_writev
+	273, // finit_module
+	280, // bpf
+	282, // userfaultfd
+	294, // kexec_file_load
+}
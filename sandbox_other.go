@@ -0,0 +1,8 @@
+//go:build !linux || !go1.16 || (!amd64 && !arm64)
+// +build !linux !go1.16 !amd64,!arm64
+
+package sftp_server
+
+func sandbox(rw []string, ro []string, devices []string) error {
+	return errSandboxUnsupported
+}
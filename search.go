@@ -0,0 +1,136 @@
+package sftp_server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Returned from a walk function to stop walking without an error.
+var errStopWalk = errors.New("sftp: stop walking")
+
+// The options used when searching for files on a server. Name is matched against the base
+// name of each file either as a glob pattern, if it contains any glob characters, or as a
+// case-insensitive substring otherwise.
+type SearchOptions struct {
+	Name           string
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+
+	// The maximum number of results to return, defaults to 1000.
+	Limit int
+	// The maximum amount of time to spend searching, defaults to 10 seconds. When this is
+	// reached the results found so far are returned.
+	Timeout time.Duration
+}
+
+type SearchResult struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified_at"`
+}
+
+func (o SearchOptions) matches(info os.FileInfo) bool {
+	if o.Name != "" {
+		if strings.ContainsAny(o.Name, "*?[") {
+			if ok, _ := filepath.Match(o.Name, info.Name()); !ok {
+				return false
+			}
+		} else if !strings.Contains(strings.ToLower(info.Name()), strings.ToLower(o.Name)) {
+			return false
+		}
+	}
+
+	if o.MinSize > 0 && info.Size() < o.MinSize {
+		return false
+	}
+
+	if o.MaxSize > 0 && info.Size() > o.MaxSize {
+		return false
+	}
+
+	if !o.ModifiedAfter.IsZero() && !info.ModTime().After(o.ModifiedAfter) {
+		return false
+	}
+
+	if !o.ModifiedBefore.IsZero() && !info.ModTime().Before(o.ModifiedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// Searches the given directory of the server for files matching the provided options. The
+// number of results and the time spent searching are both bounded so that searching a server
+// with a very large number of files cannot tie up the node. Returned paths are relative to
+// the server's root directory. SFTP has no request for searching, so this backs the search of
+// the Panel's file manager and is called by the daemon directly.
+func (fs FileSystem) Search(dir string, opts SearchOptions) ([]SearchResult, error) {
+	if !fs.can(PermissionFileRead) {
+		return nil, ErrPermissionDenied
+	}
+
+	if err := fs.runMiddleware("List", dir, ""); err != nil {
+		return nil, err
+	}
+
+	root, err := fs.buildPath("/")
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := fs.buildPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Limit <= 0 {
+		opts.Limit = 1000
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	deadline := time.Now().Add(opts.Timeout)
+	results := make([]SearchResult, 0)
+
+	owner := fs.isOwner()
+	var patterns []string
+	if !owner {
+		patterns = fs.ignorePatterns()
+	}
+
+	err = walkFiles(p, nil, func(f string, info os.FileInfo) error {
+		if len(results) >= opts.Limit || time.Now().After(deadline) {
+			return errStopWalk
+		}
+
+		if !opts.matches(info) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, f)
+		if err != nil || (!owner && fs.ignoredBy(patterns, filepath.ToSlash(rel))) {
+			return nil
+		}
+
+		results = append(results, SearchResult{
+			Path:    "/" + filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+
+		return nil
+	})
+
+	if err != nil && err != errStopWalk {
+		return nil, err
+	}
+
+	return results, nil
+}
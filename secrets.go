@@ -0,0 +1,67 @@
+package sftp_server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Reads a secret, such as the host key or the Panel token, from the location described by the
+// reference. This keeps secrets out of configuration files that are readable by other users on
+// the node. The supported references are:
+//
+//	credential:<name>  a credential passed by systemd using LoadCredential= or SetCredential=
+//	fd:<number>        an open file descriptor inherited from the parent process
+//	file:<path>        a file, which is also assumed when the reference has no prefix
+//
+// File descriptors are closed once they have been read, since the secret cannot be read from
+// them a second time.
+func ReadSecret(ref string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, "credential:"):
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, fmt.Errorf("sftp: cannot read %s, CREDENTIALS_DIRECTORY is not set", ref)
+		}
+
+		name := strings.TrimPrefix(ref, "credential:")
+		if name == "" || strings.ContainsRune(name, filepath.Separator) {
+			return nil, fmt.Errorf("sftp: invalid credential name \"%s\"", name)
+		}
+
+		return ioutil.ReadFile(filepath.Join(dir, name))
+	case strings.HasPrefix(ref, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(ref, "fd:"))
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("sftp: invalid file descriptor in \"%s\"", ref)
+		}
+
+		f := os.NewFile(uintptr(fd), ref)
+		defer f.Close()
+
+		return ioutil.ReadAll(f)
+	default:
+		return ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+	}
+}
+
+// Reads a token using ReadSecret, removing any surrounding whitespace such as a trailing newline.
+func ReadToken(ref string) (string, error) {
+	b, err := ReadSecret(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(b)), nil
+}
+
+// Overwrites a secret held in memory once it is no longer needed.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,36 @@
+package sftp_server
+
+import (
+	"go.uber.org/zap"
+	"os"
+	"os/exec"
+)
+
+// The extended attribute holding the SELinux security context of a file.
+const xattrSELinux = "security.selinux"
+
+// Applies the configured SELinux context to a file created by a client, or restores its
+// default context using restorecon. Files created by the server otherwise inherit the context
+// of the server process, which is often not one the game server's container is allowed to use.
+// Symlinks are skipped since setting the context would apply it to their target.
+func (fs FileSystem) relabel(p string) {
+	if fs.SELinuxContext == "" && !fs.Restorecon {
+		return
+	}
+
+	if st, err := os.Lstat(p); err != nil || st.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+
+	if fs.SELinuxContext != "" {
+		if err := setxattr(p, xattrSELinux, []byte(fs.SELinuxContext)); err != nil {
+			fs.logger.Warnw("failed to set selinux context on file", zap.String("file", p), zap.Error(err))
+		}
+	}
+
+	if fs.Restorecon {
+		if out, err := exec.Command("restorecon", p).CombinedOutput(); err != nil {
+			fs.logger.Warnw("failed to restore selinux context on file", zap.String("file", p), zap.ByteString("output", out), zap.Error(err))
+		}
+	}
+}
@@ -13,9 +13,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"path"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,17 +28,356 @@ type Settings struct {
 	ReadOnly    bool
 	BindPort    int
 	BindAddress string
+	// The network family to bind to, one of the BindMode constants. Defaults to listening
+	// on both IPv4 and IPv6 when bound to a wildcard address.
+	BindMode string
+	// The path to a unix socket to listen on instead of a TCP address, allowing an SSH gateway
+	// or proxy on the same machine to forward connections to the server.
+	BindSocket string
+	// Reads a PROXY protocol header from the start of every connection and treats the client
+	// address it contains as the address of the connection. This should be enabled when the
+	// server is behind an SSH gateway or load balancer, especially on a unix socket where
+	// connections otherwise have no address and bans, rate limits and IP allowlists are skipped.
+	ProxyProtocol bool
+
+	// A reference to the host key, as accepted by ReadSecret, such as "credential:host_key" to
+	// load it from a systemd credential. When empty the key is read from the data directory,
+	// and generated if it does not exist.
+	HostKey string
+
+	// The key exchange, cipher and MAC algorithms offered to clients, in order of preference.
+	// These allow weak algorithms such as diffie-hellman-group14-sha1 or hmac-sha1 to be
+	// disabled. The defaults of the SSH library are used for any list that is empty.
+	KeyExchanges []string
+	Ciphers      []string
+	MACs         []string
+
+	// SFTP extensions that are not advertised to clients, such as "posix-rename@openssh.com" or
+	// "copy-file", allowing an extension that a client misbehaves with to be disabled for a
+	// deployment.
+	// Requests for a disabled extension are refused as unsupported even if a client sends them
+	// anyway. Each profile of the server applies its own setting.
+	DisabledSFTPExtensions []string
+
+	// The interval at which TCP keepalive probes are sent to connected clients, allowing dead
+	// connections to be detected much sooner than the kernel default. Nagle's algorithm is
+	// disabled for connections unless DisableTCPNoDelay is set. The buffer sizes use the kernel
+	// defaults when not set.
+	TCPKeepAlivePeriod time.Duration
+	DisableTCPNoDelay  bool
+	TCPReadBuffer      int
+	TCPWriteBuffer     int
+
+	// The initial level for the logger created by New, defaults to "info" when not set.
+	LogLevel string
+
+	// The number of times the same message may be logged within LogRepeatWindow, after which
+	// further occurrences are dropped and summarized with a single "repeated N times" line once
+	// the window ends. This keeps a single bad transfer from filling the disk with identical
+	// errors. Messages about different IP addresses, users or servers are counted separately.
+	// Defaults to 10 times a minute, a negative value disables coalescing.
+	LogRepeatLimit  int
+	LogRepeatWindow time.Duration
+
+	// The backend used when reading and writing file contents. Defaults to the standard
+	// file I/O path, IOBackendUring may be used to enable the experimental io_uring path
+	// on supporting Linux kernels.
+	IOBackend string
+
+	// The maximum number of files that a single SFTP channel may have open at once. This
+	// prevents a single aggressive client from holding an unbounded number of handles and
+	// buffers. Defaults to 64 when not set.
+	//
+	// The SFTP library does not allow the maximum packet size, the number of requests handled
+	// at once or the buffers it allocates to be configured for each server, so this limit is
+	// the only control over the memory a client may cause to be used. Files opened by the
+	// daemon through the control API do not belong to a channel and are never limited.
+	MaxOpenFiles int
+
+	// The maximum number of connections that will be served at once, any connections beyond
+	// this limit are closed immediately. A value of 0 does not limit connections.
+	MaxConnections int
+	// The maximum number of connections that will be served at once across every instance
+	// sharing the configured State store. A value of 0 does not limit connections.
+	MaxClusterConnections int
+
+	// The amount of time a session may linger after its connection has gone away before
+	// it is forcefully cleaned up. Defaults to 5 minutes.
+	SessionLeakTimeout time.Duration
+
+	// The types of events that should be passed to the EventListener, all events are passed
+	// along when this is empty.
+	EventTypes []string
+
+	// Usernames that are never valid for the server, such as "root" or "admin". Any attempt
+	// to login using one of these immediately bans the source IP for HoneypotBanDuration.
+	HoneypotUsernames []string
+
+	// The amount of time an IP is banned for after using a honeypot username, defaults to
+	// 24 hours.
+	HoneypotBanDuration time.Duration
+
+	// The number of failed logins from an IP after which all further responses to it are
+	// delayed by TarpitDelay, rather than being answered immediately. A value of 0 disables
+	// tarpitting. The delay defaults to 5 seconds.
+	TarpitThreshold int
+	TarpitDelay     time.Duration
+
+	// The number of failed logins from an IP within AuthFailureWindow after which it is banned
+	// for AuthFailureBanDuration, stopping it from being used to brute force credentials against
+	// the Panel through the server. Defaults to 10 failures in 10 minutes, banning the IP for 15
+	// minutes. A negative value disables the ban. The window also applies to TarpitThreshold.
+	MaxAuthFailures        int
+	AuthFailureWindow      time.Duration
+	AuthFailureBanDuration time.Duration
+
+	// The number of requests a session may have denied because of a missing permission before
+	// the user is told which permission they lack, defaults to 3. A negative value disables
+	// the notice.
+	PermissionNoticeThreshold int
+
+	// The number of requests for paths outside of the server's directory a session may make
+	// before it is closed. Every attempt is logged and counted regardless, a value of 0 never
+	// closes the session.
+	PathEscapeLimit int
+
+	// The banner sent to clients before they authenticate. Banners maps networks in CIDR
+	// notation to a different banner to send to clients connecting from within them, allowing
+	// legal notices to be served based on jurisdiction. When a client matches more than one
+	// network the most specific one is used.
+	Banner  string
+	Banners map[string]string
+
+	// Whether the Panel user that last modified a file should be recorded on it using an
+	// extended attribute, allowing changes on servers with many subusers to be attributed.
+	RecordModifiedBy bool
+
+	// How often the permissions for an active session are refreshed using the server's
+	// PermissionsRefresher. Defaults to 5 minutes.
+	PermissionsRefreshInterval time.Duration
+
+	// The amount of time transfers in progress are given to finish when the server has to
+	// disconnect a session, such as when it reaches its maximum duration or the server is
+	// suspended. The user is sent a message explaining why as soon as the disconnect begins.
+	// Defaults to 10 seconds, a negative value disconnects sessions immediately.
+	DisconnectGracePeriod time.Duration
+
+	// The maximum amount of time a session may remain connected, after which it is closed
+	// with a message to the user. A value of 0 does not limit the session lifetime.
+	MaxSessionDuration time.Duration
+
+	// The number of authentication attempts that may be held while the Panel is unavailable,
+	// rather than failing immediately. Held attempts are retried every second until the Panel
+	// recovers or PanelHoldTimeout is reached. A value of 0 disables holding, the timeout
+	// defaults to 10 seconds.
+	PanelHoldQueueSize int
+	PanelHoldTimeout   time.Duration
+
+	// The policy used when users create symlinks, one of the SymlinkPolicy constants. Defaults
+	// to only allowing symlinks to locations within the server's root directory.
+	SymlinkPolicy string
+
+	// Whether existing files should keep their current owner when they are edited or renamed,
+	// rather than being chowned to the configured SftpUser. This is required when servers run
+	// under their own user, such as in user-namespaced containers.
+	PreserveOwnership bool
+
+	// The amount of time after a server is deleted in the Panel that users may continue to
+	// access it in read-only mode to retrieve their data. Deleted servers cannot be accessed
+	// at all when this is not set.
+	DeletedServerGracePeriod time.Duration
+
+	// The commands that may be run using exec requests, such as "md5sum" or "du". These are
+	// never run using a real shell, they are emulated against the user's filesystem. Only the
+	// md5sum, sha1sum, sha256sum, du, watch, versions, deleted and restore commands are
+	// supported. The watch command streams changes within a directory for as long as the client
+	// keeps its channel open, while versions, deleted and restore manage the revisions kept by
+	// FileVersions.
+	ExecCommands []string
+	// The number of watch commands that may run at once, and the number of directories that
+	// may be watched by all of them, across every session. Each watch uses inotify, which the
+	// kernel limits for every process running as the same user. Default to 32 watch commands
+	// and 4096 directories, negative values remove the limit.
+	MaxWatchers           int
+	MaxWatchedDirectories int
+
+	// Offers keyboard-interactive authentication, which allows users that have access to more
+	// than one server to pick the server to connect to from a list rather than needing to add
+	// the server identifier to their username.
+	InteractiveServerSelection bool
+
+	// The identifier and location of the node this server is running on, as configured in the
+	// Panel. These are attached to emitted events and reported as labels on the metrics so that
+	// hosts aggregating data across a fleet can break it down per node and location.
+	Node     string
+	Location string
+
+	// The path to a file that bans are persisted to so that they survive restarts of the
+	// server. Bans are only kept in memory when this is empty.
+	BanFile string
+
+	// The path to a file that failed authentication attempts are appended to in a stable format
+	// meant for fail2ban, see authLog for the format. A matching fail2ban filter is:
+	//
+	//	[Definition]
+	//	failregex = ^\S+ sftp authentication failure ip=<HOST> port=\d+ user=".*"$
+	//
+	// ReopenAuthLog should be called after the file is rotated. Nothing is written when empty.
+	AuthLogFile string
+
+	// Verifies uploaded files against a checksum uploaded alongside them in a sidecar file
+	// named "<file>.sha256", using the format written by sha256sum. Uploads that do not match
+	// their checksum fail when the client closes them.
+	VerifyUploadChecksums bool
+
+	// Writes uploads that replace an existing file to a temporary file first, leaving the
+	// existing file untouched if the uploaded contents turn out to be identical. The SFTP
+	// protocol gives the server no way to stop the client sending the data, so this saves disk
+	// writes rather than bandwidth.
+	SkipUnchangedUploads bool
+
+	// The action taken when an upload replacing a critical file looks like the wrong file, one
+	// of the CriticalFileAction constants. Defaults to only warning about the upload.
+	CriticalFileAction string
+
+	// The number of previous revisions of each file to keep in the hidden ".versions" directory
+	// of a server, which are saved before a file is overwritten or deleted. Versioning is
+	// disabled when this is zero.
+	FileVersions int
+	// The maximum total size in bytes of the revisions kept for a single server, with the
+	// oldest revisions being removed first. Revisions count towards the server's disk usage unless
+	// ".versions" is listed in UsageExclusions. Defaults to 1 GiB, a negative value does not
+	// limit the size of the revisions.
+	MaxVersionsSize int64
+
+	// Patterns for files and directories that are left out of FileSystem.DiskUsage, such as
+	// ".trash" or "backups/*.tar.gz", so that users are not charged twice for copies retained
+	// by trash, versioning or daemon backups within the server directory. Patterns without a
+	// slash match the name in any directory, others are matched from the server's root. These
+	// are not applied to the usage reported by a DiskUsageSource, which is used as it is.
+	UsageExclusions []string
+
+	// Uploads larger than this many bytes are held in the hidden ".quarantine" directory of the
+	// server rather than being written into place, and must be promoted using PromoteUpload or
+	// the QuarantineHandler once they pass validation. This stops a game server loading a world
+	// that is only partially uploaded. Uploads that replace a file entirely are written to the
+	// quarantine directory while enabled, and moved into place when they are complete if they
+	// are not held. Disabled when zero.
+	QuarantineThreshold int64
+
+	// The number of recent changes to the files of each server kept in memory and served by
+	// Changes and the ChangesHandler, allowing file manager views to be kept in sync without
+	// listing directories again. Changes made outside of SFTP, such as by the game server, are
+	// found by periodically comparing the modification times of the server's directories.
+	// Defaults to 1000, a negative value disables the journal.
+	ChangeJournalSize int
+
+	// Writes the reason an uploaded file failed validation to a "<file>.error.txt" file next
+	// to it, so that users see the problem when browsing the directory.
+	WriteValidationErrors bool
+
+	// Rules evaluated against each SFTP request, allowing custom restrictions to be configured
+	// such as denying the deletion of database files overnight. See Policy.
+	PolicyRules []PolicyRule
+
+	// The path to a lock file shared with a standby instance of the server. Only the instance
+	// holding the lock accepts connections, and a standby takes over automatically once the
+	// active instance exits. Both instances should use the same BasePath so that they present
+	// the same host key to clients.
+	FailoverLockFile string
+
+	// The maximum rate in bytes per second that files are transferred at across every session,
+	// and the windows of the day in which a different limit applies. The limits are applied to
+	// active sessions as soon as the window changes. A value of 0 does not limit transfers.
+	BandwidthLimit    int64
+	BandwidthSchedule []BandwidthWindow
+
+	// The limits applied to sessions in each priority class, keyed by the class returned by
+	// the Panel for the login such as PriorityAdmin. Sessions whose class is not configured are
+	// only subject to the node-wide limits.
+	PriorityClasses map[string]PriorityClass
+
+	// The minimum free space in bytes on the filesystem containing BasePath. When the free
+	// space drops below this every session is made read-only until space is freed, preventing
+	// uploads from filling the disk and corrupting running game servers. The webhook, if set,
+	// is sent a DiskAlert each time the state changes. A value of 0 disables the check.
+	MinFreeDiskSpace  uint64
+	DiskAlertWebhook  string
+	DiskCheckInterval time.Duration
+
+	// The path to a cgroup v2 group, such as "/sys/fs/cgroup/pterodactyl-sftp", that the process
+	// is moved into when the server starts so that IOLimit can be applied to the disk holding
+	// the server data. The group is created if it does not exist. This requires the server to
+	// be running as root, or to have been delegated the parent group.
+	IOCgroup string
+	IOLimit  IOLimit
+
+	// The CPU usage, as a percentage of a single core, and resident memory in bytes that the
+	// server may use before it starts shedding load. While over either limit new logins are
+	// rejected with a busy message and the heaviest transfers are disconnected, protecting the
+	// game servers running on the same node. A value of 0 does not limit that resource.
+	MaxCPUPercent float64
+	MaxMemory     uint64
+
+	// A delay, plus a random amount of up to PreAuthJitter, before the server sends its version
+	// to a connecting client. This slows down mass scanners fingerprinting the service without
+	// being noticeable to users. Connections from the IP addresses or CIDR networks listed in
+	// PreAuthDelayExempt, such as the Panel and monitoring, are not delayed.
+	PreAuthDelay       time.Duration
+	PreAuthJitter      time.Duration
+	PreAuthDelayExempt []string
+
+	// The time a client has to complete the SSH handshake, including authentication, before
+	// it is disconnected. Defaults to two minutes.
+	HandshakeTimeout time.Duration
+
+	// The SELinux context applied to files and directories created by clients, such as
+	// "system_u:object_r:container_file_t:s0", and whether restorecon should be run on them to
+	// apply the default context for their path. Both are only needed on systems enforcing
+	// SELinux where files created by the server end up with the wrong context.
+	SELinuxContext string
+	Restorecon     bool
+
+	// Sandboxes the process on startup, using Landlock to restrict it to the paths the server
+	// is configured to write to and the system directories it needs, and a seccomp filter to
+	// block system calls it never makes. The sandbox applies to the entire process, so it is
+	// off unless enabled, and applications embedding the server that enable it must list any
+	// other paths they write to in SandboxPaths.
+	Sandbox      bool
+	SandboxPaths []string
 }
 
 type SftpUser struct {
-	Uid int
-	Gid int
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
 }
 
 type Server struct {
 	// A custom logger instance that should be used by the server.
-	logger *zap.SugaredLogger
-	cache  *cache.Cache
+	logger    *zap.SugaredLogger
+	level     zap.AtomicLevel
+	cache     *cache.Cache
+	metrics   *Metrics
+	conns     chan struct{}
+	sessions  *sessionRegistry
+	held      chan struct{}
+	profile   bool
+	locks     *writeLocks
+	bans      *banStore
+	cluster   *clusterCounts
+	bandwidth *bandwidthLimiter
+	classes   map[string]*priorityClass
+	disk      *diskGuard
+	load      *loadShedder
+	logs      *logCoalescer
+	traces    *traceRegistry
+	authLog   *authLog
+	journal   *changeJournal
+	versions  *versionUsage
+	watches   *watchLimits
+
+	slowDoorExempt []*net.IPNet
+	sftpExtensions []string
 
 	Settings Settings
 	User     SftpUser
@@ -42,91 +385,430 @@ type Server struct {
 	PathValidator      func(fs FileSystem, p string) (string, error)
 	DiskSpaceValidator func(fs FileSystem) bool
 
+	// Function returning the current disk usage of a server in bytes from a source that
+	// already tracks it, such as DaemonUsageSource. When set, FileSystem.DiskUsage uses it
+	// rather than walking the server's directory, which is then only done if it fails. The
+	// UsageExclusions are not subtracted from the usage it returns.
+	DiskUsageSource func(server string) (int64, error)
+
+	// Function called to scan an upload held in quarantine before it may be promoted, such as
+	// with a virus scanner or a check that an uploaded world is complete. It is passed the path
+	// the upload will be promoted to and the path of its contents, and returns an error if the
+	// upload should be rejected.
+	QuarantineScanner func(server string, name string, p string) error
+
 	// Validator function that is called when a user connects to the server. This should
 	// check against whatever system is desired to confirm if the given username and password
 	// combination is valid. If so, should return an authentication response.
 	CredentialValidator func(r AuthenticationRequest) (*AuthenticationResponse, error)
+
+	// Validator function called instead of CredentialValidator when a user connects using a
+	// one-time credential generated by the Panel, which have a username in the format of
+	// "<server uuid>.<token>". The Panel is expected to invalidate the credential once it has
+	// been validated, and the server will refuse to accept the same credential more than once.
+	// One-time credentials are rejected when this is nil.
+	OneTimeCredentialValidator func(r AuthenticationRequest) (*AuthenticationResponse, error)
+
+	// Function called periodically for active sessions to fetch the current permissions of
+	// the user on the server from the Panel, so that revoked permissions take effect without
+	// the user needing to reconnect. If an InvalidCredentialsError is returned the user no
+	// longer has access to the server and the session is closed. When nil, permissions are
+	// only updated when pushed using UpdatePermissions.
+	PermissionsRefresher func(user string, server string) ([]string, error)
+
+	// Listener function that is called for activity on the server such as logins, uploads and
+	// deletions. This allows the daemon to forward the events to the websocket for the affected
+	// server so they can be shown to the owner. This is called synchronously so implementations
+	// must not block.
+	EventListener func(e Event)
+
+	// Function called when a user logs in from an IP address that is not already known to
+	// this server, allowing the Panel to be checked for whether or not the user has used it
+	// before. If the function returns false an EventNewIP event is emitted so that the user
+	// can be notified. Known addresses are cached for a day so that the function is not called
+	// on every login. When nil no EventNewIP events are emitted, since the server has no record
+	// of addresses seen before it was started.
+	KnownIPValidator func(user string, ip string) bool
+
+	// Function that returns the path to a skeleton directory for a server, typically defined
+	// by the server's egg. When a user logs in to a server whose data directory is empty the
+	// contents of the skeleton are copied into it. An empty string skips this for the server.
+	SkeletonDirectory func(server string) string
+
+	// An existing listener to accept connections from instead of binding one using the
+	// configured address. This is typically the SSH listener of a Multiplexer so that the
+	// server can share a port with the daemon.
+	Listener net.Listener
+
+	// An optional store that records the history of sessions and file transfers.
+	History HistoryStore
+
+	// An optional store for state shared between several instances of the server behind a
+	// load balancer, such as a RedisStateStore. Bans, authentication failures, one-time
+	// credentials, connection counts, priority class sessions and bandwidth limits, and
+	// DisconnectServer are enforced across every instance using it.
+	State StateStore
+
+	// Routes servers to the node that serves them in a multi-node deployment. When set along
+	// with the Node setting, clients that connect to the wrong node are told which node to
+	// connect to instead.
+	Router *Router
+
+	// Function that returns the file extensions, such as "properties" or "yml", of the files
+	// that should have Windows line endings converted to Unix line endings when uploaded to a
+	// server. This is typically defined by the server's egg. Returning nil disables conversion.
+	LineEndingExtensions func(server string) []string
+
+	// Function that returns the user namespace mapping for a server, applied to the owner of
+	// every file created for it so that the files are owned correctly inside its container. See
+	// ServerJSONIDMapping. If an error is returned the server is not mapped.
+	IDMapping func(server string) (IDMapping, error)
+
+	// Function that returns the files whose downloads should be watermarked with a comment
+	// identifying the downloading account, deterring the resale of licensed templates. The map
+	// is keyed by file pattern, such as "*.yml", with the comment format for the file as the
+	// value, such as "# %s" or "<!-- %s -->".
+	Watermarks func(server string) map[string]string
+
+	// Function that returns the patterns matching the critical configuration files for a server,
+	// such as "server.properties", typically defined by the server's egg. Uploads replacing one of
+	// these files are checked to catch the wrong file being uploaded over it.
+	CriticalFiles func(server string) []string
+
+	// Function that returns the validators to run against files uploaded to a server, keyed by
+	// the pattern of the files they apply to, such as "config.yml" or "plugins/*/config.yml".
+	// These are typically defined by the server's egg.
+	FileValidators func(server string) map[string]FileValidator
+
+	// Functions that are called before each SFTP request is handled, in order. See Middleware
+	// and ExternalPlugin.
+	Middleware []Middleware
 }
 
 // Create a new server configuration instance.
 func New(c *Server) error {
-	if logger, err := zap.NewProduction(); err != nil {
+	c.level = zap.NewAtomicLevel()
+	if c.Settings.LogLevel != "" {
+		if err := c.level.UnmarshalText([]byte(c.Settings.LogLevel)); err != nil {
+			return err
+		}
+	}
+
+	cfg := zap.NewProductionConfig()
+	cfg.Level = c.level
+	if logger, err := cfg.Build(); err != nil {
 		return err
 	} else {
 		c.logger = logger.Sugar()
 	}
 
 	c.cache = cache.New(5*time.Minute, 10*time.Minute)
+	c.metrics = newMetrics()
+	c.metrics.labels = map[string]string{"node": c.Settings.Node, "location": c.Settings.Location}
+	c.sessions = newSessionRegistry()
+	c.locks = &writeLocks{}
+	c.bans = &banStore{path: c.Settings.BanFile}
+	if c.Settings.AuthLogFile != "" {
+		l, err := openAuthLog(c.Settings.AuthLogFile)
+		if err != nil {
+			return err
+		}
+		c.authLog = l
+	}
+	c.cluster = newClusterCounts()
+	// The limit is looked up through the pointer so that later changes to the settings apply.
+	c.bandwidth = newBandwidthLimiter(func() int64 { return c.currentBandwidthLimit() })
+	c.disk = &diskGuard{}
+	c.load = &loadShedder{}
+	c.traces = newTraceRegistry()
 
-	return nil
+	c.applyDefaults()
+
+	if c.Settings.LogRepeatLimit > 0 {
+		c.logs = newLogCoalescer(c.Settings.LogRepeatLimit, c.Settings.LogRepeatWindow)
+		c.logger = c.coalesceLogs(c.logger)
+	}
+
+	c.watches = newWatchLimits(c.Settings.MaxWatchers, c.Settings.MaxWatchedDirectories)
+	c.versions = &versionUsage{}
+
+	if c.Settings.ChangeJournalSize > 0 {
+		c.journal = newChangeJournal(c.Settings.ChangeJournalSize)
+	}
+
+	exempt, err := parseNetworks(c.Settings.PreAuthDelayExempt)
+	if err != nil {
+		return err
+	}
+	c.slowDoorExempt = exempt
+
+	if err := c.validateAlgorithms(); err != nil {
+		return err
+	}
+
+	if err := c.configureExtensions(); err != nil {
+		return err
+	}
+
+	for i, w := range c.Settings.BandwidthSchedule {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("%w (window %d)", err, i)
+		}
+	}
+
+	if len(c.Settings.PolicyRules) > 0 {
+		policy, err := NewPolicy(c.Settings.PolicyRules)
+		if err != nil {
+			return err
+		}
+
+		c.Middleware = append(c.Middleware, policy.Middleware())
+	}
+
+	return c.loadBans()
+}
+
+// Fills in the default values for any settings that were not configured and creates the
+// limiters that depend on them.
+func (c *Server) applyDefaults() {
+	if c.Settings.MaxOpenFiles == 0 {
+		c.Settings.MaxOpenFiles = 64
+	}
+
+	if c.Settings.MaxVersionsSize == 0 {
+		c.Settings.MaxVersionsSize = 1 << 30
+	}
+
+	if c.Settings.SessionLeakTimeout == 0 {
+		c.Settings.SessionLeakTimeout = 5 * time.Minute
+	}
+
+	if c.Settings.HoneypotBanDuration == 0 {
+		c.Settings.HoneypotBanDuration = 24 * time.Hour
+	}
+
+	if c.Settings.MaxAuthFailures == 0 {
+		c.Settings.MaxAuthFailures = 10
+	}
+
+	if c.Settings.AuthFailureWindow == 0 {
+		c.Settings.AuthFailureWindow = 10 * time.Minute
+	}
+
+	if c.Settings.AuthFailureBanDuration == 0 {
+		c.Settings.AuthFailureBanDuration = 15 * time.Minute
+	}
+
+	if c.Settings.TarpitDelay == 0 {
+		c.Settings.TarpitDelay = 5 * time.Second
+	}
+
+	if c.Settings.PermissionsRefreshInterval == 0 {
+		c.Settings.PermissionsRefreshInterval = 5 * time.Minute
+	}
+
+	if c.Settings.ChangeJournalSize == 0 {
+		c.Settings.ChangeJournalSize = 1000
+	}
+
+	if c.Settings.MaxWatchers == 0 {
+		c.Settings.MaxWatchers = 32
+	}
+
+	if c.Settings.MaxWatchedDirectories == 0 {
+		c.Settings.MaxWatchedDirectories = 4096
+	}
+
+	if c.Settings.LogRepeatLimit == 0 {
+		c.Settings.LogRepeatLimit = 10
+	}
+
+	if c.Settings.LogRepeatWindow == 0 {
+		c.Settings.LogRepeatWindow = time.Minute
+	}
+
+	if c.Settings.DisconnectGracePeriod == 0 {
+		c.Settings.DisconnectGracePeriod = 10 * time.Second
+	}
+
+	if c.Settings.PermissionNoticeThreshold == 0 {
+		c.Settings.PermissionNoticeThreshold = 3
+	}
+
+	if c.Settings.HandshakeTimeout == 0 {
+		c.Settings.HandshakeTimeout = 2 * time.Minute
+	}
+
+	if c.Settings.DiskCheckInterval == 0 {
+		c.Settings.DiskCheckInterval = 30 * time.Second
+	}
+
+	if c.Settings.PanelHoldTimeout == 0 {
+		c.Settings.PanelHoldTimeout = 10 * time.Second
+	}
+
+	if c.Settings.PanelHoldQueueSize > 0 {
+		c.held = make(chan struct{}, c.Settings.PanelHoldQueueSize)
+	}
+
+	if c.Settings.MaxConnections > 0 {
+		c.conns = make(chan struct{}, c.Settings.MaxConnections)
+	}
+
+	c.classes = make(map[string]*priorityClass, len(c.Settings.PriorityClasses))
+	for name, pc := range c.Settings.PriorityClasses {
+		c.classes[name] = newPriorityClass(name, pc, c.cluster)
+	}
+}
+
+// Returns a copy of the server that listens using a different set of settings, allowing more
+// than one listener to be run from a single process. For example, a public listener with strict
+// connection limits and an internal one with relaxed limits for administrators. The returned
+// server shares the logger, cache, metrics, sessions, and validation hooks with this one, so
+// bans and permission updates apply across every profile. Each profile has its own bandwidth
+// limit and schedule. Call Initialize on it to begin accepting connections.
+func (c *Server) Profile(settings Settings) *Server {
+	p := *c
+	p.Settings = settings
+	p.profile = true
+	p.held = nil
+	p.conns = nil
+	p.bandwidth = newBandwidthLimiter(func() int64 { return p.currentBandwidthLimit() })
+	p.applyDefaults()
+
+	return &p
 }
 
-// Allows configuration of a custom logger.
+// Returns the metrics for this server instance.
+func (c *Server) Metrics() *Metrics {
+	return c.metrics
+}
+
+// Allows configuration of a custom logger. The level of a custom logger is not controlled by
+// SetLogLevel, that remains the responsibility of whoever created it.
 func (c *Server) ConfigureLogger(cb func() *zap.SugaredLogger) {
-	c.logger = cb()
+	c.logger = c.coalesceLogs(cb())
+}
+
+// Changes the level of the server's logger while it is running, allowing debug logging to be
+// enabled on a live node without needing to restart it.
+func (c *Server) SetLogLevel(level string) error {
+	return c.level.UnmarshalText([]byte(level))
+}
+
+// Returns a HTTP handler that reports the current log level on GET requests and changes it
+// on PUT requests, so that it can be mounted on the daemon's control API.
+func (c *Server) LogLevelHandler() http.Handler {
+	return c.level
 }
 
 // Initialize the SFTP server and add a persistent listener to handle inbound SFTP connections.
 func (c *Server) Initialize() error {
-	serverConfig := &ssh.ServerConfig{
-		NoClientAuth: false,
-		MaxAuthTries: 6,
-		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			resp, err := c.CredentialValidator(AuthenticationRequest{
-				User:          conn.User(),
-				Pass:          string(pass),
-				IP:            conn.RemoteAddr().String(),
-				SessionID:     conn.SessionID(),
-				ClientVersion: conn.ClientVersion(),
-			})
-
-			if err != nil {
-				return nil, err
-			}
+	// A standby instance waits for the lock before loading the host key so that two instances
+	// starting at the same time cannot both generate one.
+	if c.Settings.FailoverLockFile != "" {
+		c.logger.Infow("waiting to become the active sftp server", zap.String("lock", c.Settings.FailoverLockFile))
 
-			sshPerm := &ssh.Permissions{
-				Extensions: map[string]string{
-					"uuid":        resp.Server,
-					"user":        conn.User(),
-					"permissions": strings.Join(resp.Permissions, ","),
-				},
-			}
+		lock, err := acquireLock(c.Settings.FailoverLockFile)
+		if err != nil {
+			return err
+		}
+		// The lock is held for as long as the server is running, closing the file releases it.
+		defer lock.Close()
 
-			return sshPerm, nil
-		},
+		c.logger.Infow("acquired failover lock, accepting connections", zap.String("lock", c.Settings.FailoverLockFile))
 	}
 
-	if _, err := os.Stat(path.Join(c.Settings.BasePath, ".sftp/id_rsa")); os.IsNotExist(err) {
-		if err := c.generatePrivateKey(); err != nil {
-			return err
-		}
-	} else if err != nil {
+	// Profiles are copies of the server they were created from, so their extensions are
+	// determined again from their own settings.
+	if err := c.configureExtensions(); err != nil {
 		return err
 	}
 
-	privateBytes, err := ioutil.ReadFile(path.Join(c.Settings.BasePath, ".sftp/id_rsa"))
-	if err != nil {
+	serverConfig := &ssh.ServerConfig{
+		Config: ssh.Config{
+			KeyExchanges: c.Settings.KeyExchanges,
+			Ciphers:      c.Settings.Ciphers,
+			MACs:         c.Settings.MACs,
+		},
+		NoClientAuth:     false,
+		MaxAuthTries:     6,
+		PasswordCallback: c.passwordCallback,
+	}
+
+	if cb, err := c.bannerCallback(); err != nil {
 		return err
+	} else {
+		serverConfig.BannerCallback = c.busyBanner(cb)
+	}
+
+	if c.Settings.InteractiveServerSelection || c.Router != nil {
+		serverConfig.KeyboardInteractiveCallback = c.keyboardInteractiveCallback
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
+	keys, err := c.loadHostKeys()
 	if err != nil {
 		return err
 	}
 
-	// Add our private key to the server configuration.
-	serverConfig.AddHostKey(private)
+	// Add our private keys to the server configuration, the client picks the one to use based
+	// on the host key algorithms it supports.
+	for _, k := range keys {
+		serverConfig.AddHostKey(k)
+	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.Settings.BindAddress, c.Settings.BindPort))
+	listener, err := c.listen()
 	if err != nil {
 		return err
 	}
 
-	c.logger.Infow("sftp subsystem listening for connections", zap.String("host", c.Settings.BindAddress), zap.Int("port", c.Settings.BindPort))
+	c.logger.Infow("sftp subsystem listening for connections",
+		zap.String("host", c.Settings.BindAddress),
+		zap.Int("port", c.Settings.BindPort),
+		zap.String("network", listener.Addr().Network()),
+		zap.String("address", listener.Addr().String()),
+	)
+
+	// Sessions are shared between every profile, so only the server they were created from
+	// needs to watch them for leaks.
+	if !c.profile {
+		if c.Settings.IOCgroup != "" {
+			if err := applyIOLimit(c.Settings.IOCgroup, c.Settings.BasePath, c.Settings.IOLimit); err != nil {
+				return err
+			}
+
+			c.logger.Infow("applied disk io limits", zap.String("cgroup", c.Settings.IOCgroup), zap.String("limit", c.Settings.IOLimit.String()))
+		}
+
+		if c.Settings.Sandbox {
+			if err := c.applySandbox(); err != nil {
+				return err
+			}
+		}
+
+		go c.watchSessions()
+
+		if c.State != nil {
+			go c.watchClusterDisconnects()
+		}
+
+		if c.Settings.MinFreeDiskSpace > 0 {
+			go c.watchDiskSpace()
+		}
+
+		if c.Settings.MaxCPUPercent > 0 || c.Settings.MaxMemory > 0 {
+			go c.watchLoad()
+		}
+	}
 
 	for {
-		conn, _ := listener.Accept()
+		conn, err := listener.Accept()
+		if err == errMuxClosed {
+			return nil
+		}
+
 		if conn != nil {
+			c.tuneConn(conn)
 			go c.AcceptInboundConnection(conn, serverConfig)
 		}
 	}
@@ -136,16 +818,122 @@ func (c *Server) Initialize() error {
 // or not.
 func (c Server) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig) {
 	defer conn.Close()
+	defer c.recoverConnection(conn)
+
+	if c.Settings.ProxyProtocol {
+		conn.SetDeadline(time.Now().Add(c.Settings.HandshakeTimeout))
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			c.logger.Debugw("closing connection without a valid proxy protocol header", zap.String("addr", conn.RemoteAddr().String()), zap.Error(err))
+			return
+		}
+		conn = pc
+	}
+
+	if c.sessions.isClosing() {
+		c.rejectConnection(conn, DisconnectByApplication, "The server is shutting down, please try again shortly.")
+		return
+	}
+
+	if c.isBanned(remoteIP(conn.RemoteAddr())) {
+		c.metrics.Inc("connections_banned_total")
+		c.rejectConnection(conn, DisconnectHostNotAllowed, "Connections from your IP address are not allowed.")
+		return
+	}
+
+	if c.conns != nil {
+		select {
+		case c.conns <- struct{}{}:
+			defer func() { <-c.conns }()
+		default:
+			c.metrics.Inc("connections_rejected_total")
+			c.logger.Warnw("rejecting connection, maximum number of connections reached", zap.String("ip", conn.RemoteAddr().String()))
+			c.rejectConnection(conn, DisconnectTooManyConnections, "The server has too many connections, please try again later.")
+			return
+		}
+	}
+
+	release, ok := c.acquireClusterConnection()
+	if !ok {
+		c.metrics.Inc("connections_rejected_total")
+		c.logger.Warnw("rejecting connection, maximum number of cluster connections reached", zap.String("ip", conn.RemoteAddr().String()))
+		c.rejectConnection(conn, DisconnectTooManyConnections, "The server has too many connections, please try again later.")
+		return
+	}
+	defer release()
+
+	c.tarpit(remoteIP(conn.RemoteAddr()))
+	c.slowDoor(remoteIP(conn.RemoteAddr()))
 
 	// Before beginning a handshake must be performed on the incoming net.Conn
-	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	hconn := &handshakeConn{Conn: conn}
+	conn.SetDeadline(time.Now().Add(c.Settings.HandshakeTimeout))
+	sconn, chans, reqs, err := ssh.NewServerConn(hconn, config)
 	if err != nil {
+		c.handshakeFailed(hconn, err)
 		return
 	}
+	conn.SetDeadline(time.Time{})
 	defer sconn.Close()
 
+	if !allowedIP(sconn.Permissions.Extensions["allowed_ips"], remoteIP(conn.RemoteAddr())) {
+		c.metrics.Inc("sessions_rejected_total")
+		c.logger.Warnw("rejecting session from an address that is not allowed to access the server",
+			zap.String("ip", conn.RemoteAddr().String()),
+			zap.String("server", sconn.Permissions.Extensions["uuid"]),
+			zap.String("user", sconn.Permissions.Extensions["user"]),
+		)
+		return
+	}
+
+	class := sconn.Permissions.Extensions["priority"]
+	releaseClass, ok := c.acquirePriorityClass(class)
+	if !ok {
+		c.metrics.Inc("sessions_rejected_total")
+		c.logger.Warnw("rejecting session, maximum number of sessions reached for priority class", zap.String("ip", conn.RemoteAddr().String()), zap.String("class", class))
+		return
+	}
+	defer releaseClass()
+
+	s := c.sessions.add(sconn, conn, c.logger)
+	defer c.sessions.remove(s.id)
+	c.metrics.Inc("sessions_total")
+
+	events := c.eventEmitter()
+	if events != nil {
+		events(Event{Type: EventLogin, Server: s.uuid, User: s.user, IP: s.ip, SessionID: s.id})
+
+		if !c.isKnownIP(s.user, remoteIP(conn.RemoteAddr())) {
+			events(Event{Type: EventNewIP, Server: s.uuid, User: s.user, IP: s.ip, SessionID: s.id})
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		sconn.Wait()
+		s.disconnected()
+	}()
+
+	if c.PermissionsRefresher != nil {
+		go c.refreshPermissions(s, done)
+	}
+
+	if c.Settings.MaxSessionDuration > 0 {
+		t := time.AfterFunc(c.Settings.MaxSessionDuration, func() {
+			s.logger.Infow("closing sftp session that reached the maximum session duration")
+			c.metrics.Inc("sessions_expired_total")
+			c.disconnect(s, "Your session has reached its maximum duration, please reconnect to continue.")
+		})
+		defer t.Stop()
+	}
+
 	go ssh.DiscardRequests(reqs)
 
+	// Each channel is served independently, so that a long running exec command such as watch
+	// can be used alongside the SFTP subsystem over the same connection.
+	var channels sync.WaitGroup
 	for newChannel := range chans {
 		// If its not a session channel we just move on because its not something we
 		// know how to handle at this point.
@@ -154,68 +942,380 @@ func (c Server) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig)
 			continue
 		}
 
-		channel, requests, err := newChannel.Accept()
-		if err != nil {
-			continue
+		channels.Add(1)
+		go func(newChannel ssh.NewChannel) {
+			defer channels.Done()
+			defer c.recoverConnection(conn)
+
+			c.serveChannel(newChannel, conn, sconn, s, class, events)
+		}(newChannel)
+	}
+	channels.Wait()
+}
+
+// Serves a session channel opened by the client, which is either used for the SFTP subsystem
+// or to run a single shell or exec request.
+func (c Server) serveChannel(newChannel ssh.NewChannel, conn net.Conn, sconn *ssh.ServerConn, s *session, class string, events func(e Event)) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	s.trackChannel(channel)
+
+	// Create a new handler for the currently logged in user's server.
+	stats := newTransferStats()
+	stats.limiters = c.bandwidthLimiters(class)
+	s.trackStats(stats)
+	if c.History != nil {
+		stats.onClose = c.recordTransfer(s)
+	}
+	fs := c.newFileSystem(sconn.Permissions, s, stats, events)
+
+	// Whether the channel is used for SFTP, which is only known once the client makes its
+	// first subsystem, shell or exec request. The SFTP server must not be started on shell
+	// and exec channels, since it would consume the client's input and close the channel
+	// while the response to the request is still being written.
+	sftpRequested := make(chan bool, 1)
+	requested := func(v bool) {
+		select {
+		case sftpRequested <- v:
+		default:
 		}
+	}
+	handled := make(chan struct{})
 
-		// Channels have a type that is dependent on the protocol. For SFTP this is "subsystem"
-		// with a payload that (should) be "sftp". Discard anything else we receive ("pty", "shell", etc)
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				ok := false
+	// Channels have a type that is dependent on the protocol. For SFTP this is "subsystem"
+	// with a payload that (should) be "sftp". Discard anything else we receive ("pty", "shell", etc)
+	go func(in <-chan *ssh.Request) {
+		defer close(handled)
+		defer requested(false)
+		defer c.recoverConnection(conn)
 
-				switch req.Type {
-				case "subsystem":
-					if string(req.Payload[4:]) == "sftp" {
-						ok = true
-					}
-				}
+		for req := range in {
+			ok := false
 
-				req.Reply(ok, nil)
+			switch req.Type {
+			case "subsystem":
+				if len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp" {
+					ok = true
+					requested(true)
+				}
+			case "pty-req":
+				// Accept terminal requests so that clients do not print a confusing allocation
+				// failure before the message below is written to the terminal.
+				ok = true
+			case "shell":
+				// Users commonly try to SSH in to the server, so explain why they cannot rather
+				// than just rejecting the request and leaving them to guess.
+				req.Reply(true, nil)
+				requested(false)
+				rejectShell(channel)
+				continue
+			case "exec":
+				req.Reply(true, nil)
+				requested(false)
+				c.handleExec(channel, fs, req.Payload)
+				continue
 			}
-		}(requests)
 
-		// Configure the user's home folder for the rest of the request cycle.
-		if sconn.Permissions.Extensions["uuid"] == "" {
-			continue
+			req.Reply(ok, nil)
 		}
+	}(requests)
 
-		// Create a new handler for the currently logged in user's server.
-		fs := c.createHandler(sconn.Permissions)
+	if c.SkeletonDirectory != nil {
+		if dir := c.SkeletonDirectory(s.uuid); dir != "" {
+			if err := fs.materializeSkeleton(dir); err != nil {
+				s.logger.Warnw("failed to create directory skeleton for server", zap.Error(err))
+			}
+		}
+	}
 
+	if <-sftpRequested {
 		// Create the server instance for the channel using the filesystem we created above.
-		server := sftp.NewRequestServer(channel, fs)
+		server := sftp.NewRequestServer(c.traceChannel(c.extensionChannel(channel, fs), s, fs.transport), fs.Handlers())
+		s.track(server)
 
 		if err := server.Serve(); err == io.EOF {
 			server.Close()
 		}
+	} else {
+		<-handled
 	}
+
+	// File downloads are sent over the encrypted SSH channel, so the data must pass through
+	// userspace and cannot make use of sendfile. Track the throughput of each session so the
+	// cost of serving transfers on a node can be measured.
+	read, written := atomic.LoadUint64(&stats.read), atomic.LoadUint64(&stats.written)
+	c.metrics.Add("bytes_read_total", read)
+	c.metrics.Add("bytes_written_total", written)
+	s.logger.Debugw("sftp session closed",
+		zap.Uint64("bytes_read", read),
+		zap.Uint64("bytes_written", written),
+		zap.Float64("throughput", stats.Throughput()),
+	)
+
+	if c.History != nil {
+		c.recordSession(s, stats)
+	}
+}
+
+// Determines if the given username is one of the configured honeypot usernames.
+func (c Server) isHoneypotUsername(user string) bool {
+	for _, u := range c.Settings.HoneypotUsernames {
+		if strings.EqualFold(u, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Determines if the user has previously logged in from the given IP address, and marks
+// it as being known for future logins.
+func (c Server) isKnownIP(user string, ip string) bool {
+	if ip == "" || c.KnownIPValidator == nil {
+		return true
+	}
+
+	key := "known_ip:" + user + ":" + ip
+	if c.hasShared(key) {
+		return true
+	}
+
+	c.setShared(key, 24*time.Hour)
+
+	return c.KnownIPValidator(user, ip)
+}
+
+// Updates the permissions for all active sessions of the given user on a server. This allows
+// the Panel to push permission changes so they take effect immediately.
+func (c *Server) UpdatePermissions(server string, user string, permissions []string) {
+	for _, s := range c.sessions.all() {
+		if s.uuid == server && s.user == user {
+			s.setPermissions(permissions)
+		}
+	}
+}
+
+// Disconnects the session with a message to the user, allowing transfers in progress the
+// configured grace period to finish first.
+func (c Server) disconnect(s *session, msg string) {
+	s.disconnect(msg, c.Settings.DisconnectGracePeriod)
+}
+
+// Disconnects every session connected to the given server, such as when it is suspended or
+// killed, with a message to the user. Transfers in progress are given the configured grace
+// period to finish, and this blocks until every session connected to this instance has been
+// closed. When a State store is configured the other instances in the cluster disconnect their
+// sessions for the server as well, within a few seconds.
+func (c *Server) DisconnectServer(server string, msg string) {
+	c.publishDisconnect(server, msg)
+	c.disconnectServer(server, msg, time.Now())
+}
+
+// Disconnects the sessions connected to the server that were started before the given time.
+func (c *Server) disconnectServer(server string, msg string, before time.Time) {
+	var wg sync.WaitGroup
+	for _, s := range c.sessions.all() {
+		if s.uuid == server && s.started.Before(before) {
+			wg.Add(1)
+			go func(s *session) {
+				defer wg.Done()
+				c.disconnect(s, msg)
+			}(s)
+		}
+	}
+
+	wg.Wait()
+}
+
+// Stops accepting new sessions and disconnects every active session with a message to the user,
+// blocking until they have been closed as with DisconnectAll. Clients connecting after this is
+// called are told that the server is shutting down.
+func (c *Server) Shutdown(msg string) {
+	c.sessions.closing()
+	c.DisconnectAll(msg)
+}
+
+// Disconnects every session with a message to the user, such as when the server is shutting
+// down. Transfers in progress are given the configured grace period to finish, and this blocks
+// until every session has been closed.
+func (c *Server) DisconnectAll(msg string) {
+	var wg sync.WaitGroup
+	for _, s := range c.sessions.all() {
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			c.disconnect(s, msg)
+		}(s)
+	}
+
+	wg.Wait()
+}
+
+// Periodically fetches the current permissions for the session's user until the provided
+// channel is closed.
+func (c Server) refreshPermissions(s *session, done <-chan struct{}) {
+	t := time.NewTicker(c.Settings.PermissionsRefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			p, err := c.PermissionsRefresher(s.user, s.uuid)
+			if IsInvalidCredentialsError(err) {
+				s.logger.Infow("closing sftp session for user that no longer has access to server")
+				c.disconnect(s, "You no longer have access to this server.")
+				return
+			} else if err != nil {
+				s.logger.Warnw("failed to refresh permissions for sftp session", zap.Error(err))
+				continue
+			}
+
+			s.setPermissions(p)
+		}
+	}
+}
+
+// The message written to clients that attempt to open a shell or execute a command.
+const shellRejectionMessage = "This server only supports SFTP connections, shell access is not available.\r\n"
+
+// Writes a message explaining that shell access is not available to the channel and then
+// closes it with a non-zero exit status.
+func rejectShell(channel ssh.Channel) {
+	channel.Stderr().Write([]byte(shellRejectionMessage))
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+	channel.Close()
 }
 
-// Creates a new SFTP handler for a given server. The directory argument should
-// be the base directory for a server. All actions done on the server will be
-// relative to that directory, and the user will not be able to escape out of it.
-func (c Server) createHandler(perm *ssh.Permissions) sftp.Handlers {
-	p := FileSystem{
-		UUID:          perm.Extensions["uuid"],
-		Permissions:   strings.Split(perm.Extensions["permissions"], ","),
-		ReadOnly:      c.Settings.ReadOnly,
-		Cache:         c.cache,
-		User:          c.User,
-		HasDiskSpace:  c.DiskSpaceValidator,
-		PathValidator: c.PathValidator,
-		logger:        c.logger,
+// Recovers from a panic in one of the goroutines handling a connection so that it only
+// terminates that connection rather than the entire server.
+func (c Server) recoverConnection(conn net.Conn) {
+	if r := recover(); r != nil {
+		c.logger.Errorw("recovered from panic while handling connection",
+			zap.String("ip", conn.RemoteAddr().String()),
+			zap.Any("panic", r),
+			zap.ByteString("stack", debug.Stack()),
+		)
+
+		c.metrics.Inc("connection_panics_total")
+		conn.Close()
 	}
+}
+
+// Periodically checks for sessions whose connection has gone away but that are still being
+// held open, and forcefully cleans them up so they do not continue to consume resources.
+func (c *Server) watchSessions() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+
+	for range t.C {
+		c.refreshShared()
+		c.logs.flush()
 
-	return sftp.Handlers{
-		FileGet:  p,
-		FilePut:  p,
-		FileCmd:  p,
-		FileList: p,
+		for _, s := range c.sessions.leaked(c.Settings.SessionLeakTimeout) {
+			s.logger.Warnw("cleaning up leaked sftp session")
+
+			s.close()
+			c.sessions.remove(s.id)
+			c.metrics.Inc("sessions_leaked_total")
+		}
 	}
 }
 
+// Loads the host key for the server, from the configured HostKey secret if there is one, and
+// otherwise from the data directory, generating a new key there if one does not exist yet.
+func (c Server) loadHostKey() (ssh.Signer, error) {
+	var b []byte
+	var err error
+	if c.Settings.HostKey != "" {
+		b, err = ReadSecret(c.Settings.HostKey)
+	} else {
+		if _, err := os.Stat(path.Join(c.Settings.BasePath, ".sftp/id_rsa")); os.IsNotExist(err) {
+			if err := c.generatePrivateKey(); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		b, err = ioutil.ReadFile(path.Join(c.Settings.BasePath, ".sftp/id_rsa"))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseHostKey(b)
+}
+
+// The host keys besides id_rsa that are loaded from the data directory when they exist.
+var extraHostKeys = []string{"id_ecdsa", "id_ed25519"}
+
+// Loads every host key used by the server. When a HostKey is configured only that key is used,
+// otherwise the RSA key in the data directory is loaded, generating it if it does not exist,
+// along with any ECDSA and Ed25519 keys placed alongside it. Offering more than one type of
+// key allows clients that do not support RSA host keys to connect.
+func (c Server) loadHostKeys() ([]ssh.Signer, error) {
+	key, err := c.loadHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []ssh.Signer{key}
+	if c.Settings.HostKey != "" {
+		return keys, nil
+	}
+
+	for _, name := range extraHostKeys {
+		b, err := ioutil.ReadFile(path.Join(c.Settings.BasePath, ".sftp", name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		k, err := parseHostKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("sftp: failed to parse host key %s: %w", name, err)
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// Parses an encoded host key. The parsed key is all that is needed from here on, so the
+// encoded copy is not left sitting in memory.
+func parseHostKey(b []byte) (ssh.Signer, error) {
+	defer wipe(b)
+
+	return ssh.ParsePrivateKey(b)
+}
+
+// Creates a new filesystem for the server the session is logged in to. All actions done on
+// the filesystem will be relative to the server's base directory, and the user will not be
+// able to escape out of it. The directory is found in the BasePath unless the server has a
+// PathValidator configured.
+func (c Server) newFileSystem(perm *ssh.Permissions, s *session, stats *transferStats, events func(e Event)) FileSystem {
+	return NewFileSystem(
+		WithServer(perm.Extensions["uuid"]),
+		WithPermissions(strings.Split(perm.Extensions["permissions"], ",")),
+		WithQuota(c.DiskSpaceValidator),
+		WithPathValidator(c.PathValidator),
+		WithRoot(path.Join(c.Settings.BasePath, perm.Extensions["uuid"])),
+		WithUser(c.User),
+		WithLogger(s.logger),
+		WithSettings(c.Settings),
+		withPanelPermissions(perm),
+		withSession(s, stats, events),
+		c.withServerState(),
+	)
+}
+
 // Generates a private key that will be used by the SFTP server.
 func (c Server) generatePrivateKey() error {
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
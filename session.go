@@ -0,0 +1,339 @@
+package sftp_server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An active SSH connection to the server and the SFTP request servers that are currently
+// being served over it.
+type session struct {
+	mu sync.Mutex
+
+	id      string
+	uuid    string
+	user    string
+	ip      string
+	conn    net.Conn
+	started time.Time
+
+	// A logger annotated with the session, user, server and IP, so that the log lines of
+	// concurrent sessions can be told apart.
+	logger *zap.SugaredLogger
+
+	permissions []string
+	// The number of requests denied because of each permission the user lacks.
+	denials map[string]int
+	// Set while the session is waiting for its transfers to finish before being disconnected.
+	draining int32
+	// The number of files and exec commands the session has open, and a channel closed once
+	// there are none left while the session is draining.
+	active int
+	idle   chan struct{}
+	// The number of requests made for paths outside of the server's directory.
+	escapes int32
+
+	// The time at which the underlying connection was detected as being closed. This is
+	// zero while the connection is still active.
+	disconnectedAt time.Time
+	closers        []io.Closer
+	channels       []ssh.Channel
+	stats          []*transferStats
+}
+
+// Marks the session's underlying connection as being gone.
+func (s *session) disconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.disconnectedAt = time.Now()
+}
+
+// Returns the permissions currently assigned to the session.
+func (s *session) getPermissions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.permissions
+}
+
+// Replaces the permissions assigned to the session, taking effect for the next request.
+func (s *session) setPermissions(p []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.permissions = p
+}
+
+// Tracks a closer that should be closed when the session is forcefully cleaned up.
+func (s *session) track(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closers = append(s.closers, c)
+}
+
+// Tracks a channel opened for the session so that messages can be sent to it.
+func (s *session) trackChannel(ch ssh.Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channels = append(s.channels, ch)
+}
+
+// Records a request denied because of a missing permission, returning the number of requests
+// that have been denied because of it during the session.
+func (s *session) denied(permission string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.denials == nil {
+		s.denials = make(map[string]int)
+	}
+	s.denials[permission]++
+
+	return s.denials[permission]
+}
+
+// Writes a message to the stderr stream of every channel in the session. OpenSSH and most
+// other clients display this to the user without interrupting the session. The writes are made
+// without holding the session's lock since they block if the client is not reading stderr.
+func (s *session) notify(msg string) {
+	s.mu.Lock()
+	channels := append([]ssh.Channel{}, s.channels...)
+	s.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.Stderr().Write([]byte(msg + "\r\n"))
+	}
+}
+
+// Tracks the transfer stats for a channel opened for the session.
+func (s *session) trackStats(t *transferStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats = append(s.stats, t)
+}
+
+// Returns the total number of bytes transferred over every channel in the session.
+func (s *session) transferred() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n uint64
+	for _, t := range s.stats {
+		n += atomic.LoadUint64(&t.read) + atomic.LoadUint64(&t.written)
+	}
+
+	return n
+}
+
+// Marks the start of a file being opened or an exec command being run by the session, which
+// disconnecting the session waits for. The returned function must be called once it is done.
+func (s *session) begin() func() {
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			s.active--
+			if s.active == 0 && s.idle != nil {
+				close(s.idle)
+				s.idle = nil
+			}
+		})
+	}
+}
+
+// Returns a channel that is closed once the session has no files or exec commands open, or
+// nil if it has none open already.
+func (s *session) whenIdle() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == 0 {
+		return nil
+	}
+
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+
+	return s.idle
+}
+
+// Wraps a file opened by a session so that disconnecting the session waits for it to be closed.
+type activeFile struct {
+	backendFile
+	done func()
+}
+
+func (f activeFile) Close() error {
+	defer f.done()
+
+	return f.backendFile.Close()
+}
+
+// Determines if the session is waiting for its transfers to finish before being disconnected.
+func (s *session) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Disconnects the session, writing the message to the user immediately and then allowing any
+// transfers and exec commands in progress up to the grace period to finish. No new files may
+// be opened by the session in the meantime. This blocks until the session has been closed.
+func (s *session) disconnect(msg string, grace time.Duration) {
+	s.notify(msg)
+
+	if grace > 0 {
+		atomic.StoreInt32(&s.draining, 1)
+
+		if idle := s.whenIdle(); idle != nil {
+			t := time.NewTimer(grace)
+			select {
+			case <-idle:
+			case <-t.C:
+			}
+			t.Stop()
+		}
+	}
+
+	s.close()
+}
+
+// Closes the underlying connection and every request server associated with the session.
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.closers {
+		c.Close()
+	}
+	s.conn.Close()
+}
+
+// Generates a random identifier that can be used to correlate a session or an individual
+// request across log lines and calls made to the Panel.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	// Set once the server is shutting down and no longer accepts new sessions.
+	closed int32
+}
+
+// Marks the server as shutting down.
+func (r *sessionRegistry) closing() {
+	atomic.StoreInt32(&r.closed, 1)
+}
+
+// Determines if the server is shutting down.
+func (r *sessionRegistry) isClosing() bool {
+	return atomic.LoadInt32(&r.closed) == 1
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+// Registers a new session for the given connection, deriving the session's logger from the
+// one provided.
+func (r *sessionRegistry) add(sconn *ssh.ServerConn, conn net.Conn, logger *zap.SugaredLogger) *session {
+	s := &session{
+		id:      sconn.Permissions.Extensions["session_id"],
+		uuid:    sconn.Permissions.Extensions["uuid"],
+		user:    sconn.User(),
+		ip:      conn.RemoteAddr().String(),
+		conn:    conn,
+		started: time.Now(),
+
+		permissions: strings.Split(sconn.Permissions.Extensions["permissions"], ","),
+	}
+
+	s.logger = logger.With(
+		zap.String("session_id", s.id),
+		zap.String("server", s.uuid),
+		zap.String("user", s.user),
+		zap.String("ip", s.ip),
+	)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.id] = s
+
+	return s
+}
+
+func (r *sessionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, id)
+}
+
+// Returns all of the currently registered sessions.
+func (r *sessionRegistry) all() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := make([]*session, 0, len(r.sessions))
+	for _, v := range r.sessions {
+		s = append(s, v)
+	}
+
+	return s
+}
+
+// Returns the sessions whose underlying connection has been gone for longer than the
+// provided threshold but which are still registered, meaning something is still holding
+// on to them.
+func (r *sessionRegistry) leaked(threshold time.Duration) []*session {
+	var leaked []*session
+	for _, s := range r.all() {
+		s.mu.Lock()
+		if !s.disconnectedAt.IsZero() && time.Since(s.disconnectedAt) > threshold {
+			leaked = append(leaked, s)
+		}
+		s.mu.Unlock()
+	}
+
+	return leaked
+}
+
+// Returns the IP address of a remote address without the port. Connections accepted on a unix
+// socket have no address unless one is provided through the PROXY protocol, in which case this
+// returns an empty string and the features keyed on the client's address are skipped.
+func remoteIP(addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return ""
+	}
+
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+
+	return addr.String()
+}
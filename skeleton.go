@@ -0,0 +1,87 @@
+package sftp_server
+
+import (
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Copies the contents of the skeleton directory into the server's root directory if the root
+// directory is currently empty, giving brand new servers a sensible initial structure. Nothing
+// is copied if the user would not be able to create the files themselves.
+func (fs FileSystem) materializeSkeleton(skeleton string) error {
+	if fs.isReadOnly() || !fs.can(PermissionFileCreate) {
+		return nil
+	}
+
+	done, ok := fs.locks.begin(fs.UUID)
+	if !ok {
+		return nil
+	}
+	defer done()
+
+	root, err := fs.buildPath("/")
+	if err != nil {
+		return err
+	}
+
+	// Each channel of a session is handled by its own filesystem, so the lock shared by every
+	// session of the server is used to stop two of them copying the skeleton at once.
+	defer fs.locks.setup(fs.UUID)()
+
+	if empty, err := isEmptyDir(root); err != nil || !empty {
+		return err
+	}
+
+	fs.logger.Infow("creating directory skeleton for empty server", zap.String("skeleton", skeleton))
+
+	return filepath.Walk(skeleton, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(skeleton, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		dst := filepath.Join(root, rel)
+		switch {
+		case info.IsDir():
+			err = os.MkdirAll(dst, 0755)
+		case info.Mode().IsRegular():
+			err = copyFile(dst, p)
+		default:
+			// Symlinks and other special files in a skeleton are never copied.
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chown(dst, fs.User.Uid, fs.User.Gid); err != nil {
+			fs.logger.Warnw("error chowning file", zap.String("file", dst), zap.Error(err))
+		}
+
+		return nil
+	})
+}
+
+// Determines if the given directory does not contain any entries.
+func isEmptyDir(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
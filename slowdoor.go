@@ -0,0 +1,65 @@
+package sftp_server
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// Parses the networks exempt from the pre-authentication delay. Plain IP addresses are treated
+// as a network containing only that address.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("sftp: invalid ip address \"%s\"", v)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Delays the start of the SSH handshake with a client by the configured delay plus a random
+// amount of jitter, slowing down mass scanners fingerprinting the service while remaining
+// unnoticeable to real users. Connections from exempt networks, such as the Panel or uptime
+// monitoring, are never delayed.
+func (c Server) slowDoor(ip string) {
+	if c.Settings.PreAuthDelay <= 0 && c.Settings.PreAuthJitter <= 0 {
+		return
+	}
+
+	if addr := net.ParseIP(ip); addr != nil {
+		for _, n := range c.slowDoorExempt {
+			if n.Contains(addr) {
+				return
+			}
+		}
+	}
+
+	d := c.Settings.PreAuthDelay
+	if c.Settings.PreAuthJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(c.Settings.PreAuthJitter)))
+	}
+
+	time.Sleep(d)
+}
@@ -0,0 +1,541 @@
+package sftp_server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A store for state that is shared between every instance of the server in a cluster, such as
+// several SFTP front-ends behind a TCP load balancer. When configured, bans, authentication
+// failure counts, one-time credentials, connection and session counts, and disconnects are kept
+// in the store so they are enforced across the entire cluster rather than per instance.
+type StateStore interface {
+	// Returns the value of the key, and false if it does not exist.
+	Get(key string) (string, bool, error)
+	// Sets the value of the key, expiring it after the given duration unless it is zero.
+	Set(key string, value string, ttl time.Duration) error
+	// Sets the value of the key only if it does not already exist, returning false if it did.
+	SetNX(key string, value string, ttl time.Duration) (bool, error)
+	Delete(key string) error
+	// Increments the integer value of the key, creating it with the given expiry if it does
+	// not already exist, and returns the new value.
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Decrements the integer value of the key and returns the new value.
+	Decr(key string) (int64, error)
+	// Changes the expiry of the key, doing nothing if it does not exist.
+	Expire(key string, ttl time.Duration) error
+	// Returns every key that begins with the given prefix.
+	Keys(prefix string) ([]string, error)
+}
+
+// A StateStore backed by a Redis server.
+type RedisStateStore struct {
+	Addr     string
+	Password string
+	DB       int
+	// A prefix added to every key, allowing the Redis server to be shared with other
+	// applications. Defaults to "sftp:".
+	Prefix string
+	// The timeout for connecting to Redis and for each command sent to it.
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Returned when Redis responds to a command with an error.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "sftp: redis: " + string(e)
+}
+
+// Creates a new Redis backed state store. No connection is made until the store is used.
+func NewRedisStateStore(addr string, password string, db int) *RedisStateStore {
+	return &RedisStateStore{Addr: addr, Password: password, DB: db, Prefix: "sftp:", Timeout: 5 * time.Second}
+}
+
+func (s *RedisStateStore) Get(key string) (string, bool, error) {
+	v, err := s.do("GET", s.Prefix+key)
+	if err != nil || v == nil {
+		return "", false, err
+	}
+
+	return v.(string), true, nil
+}
+
+func (s *RedisStateStore) Set(key string, value string, ttl time.Duration) error {
+	args := []string{"SET", s.Prefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+
+	_, err := s.do(args...)
+
+	return err
+}
+
+func (s *RedisStateStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	args := []string{"SET", s.Prefix + key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+
+	v, err := s.do(args...)
+	if err != nil {
+		return false, err
+	}
+
+	return v != nil, nil
+}
+
+func (s *RedisStateStore) Delete(key string) error {
+	_, err := s.do("DEL", s.Prefix+key)
+
+	return err
+}
+
+func (s *RedisStateStore) Incr(key string, ttl time.Duration) (int64, error) {
+	v, err := s.do("INCR", s.Prefix+key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := v.(int64)
+	if !ok {
+		return 0, RedisError("unexpected reply to INCR")
+	}
+
+	if n == 1 && ttl > 0 {
+		if _, err := s.do("PEXPIRE", s.Prefix+key, strconv.FormatInt(int64(ttl/time.Millisecond), 10)); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+func (s *RedisStateStore) Decr(key string) (int64, error) {
+	v, err := s.do("DECR", s.Prefix+key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := v.(int64)
+	if !ok {
+		return 0, RedisError("unexpected reply to DECR")
+	}
+
+	return n, nil
+}
+
+func (s *RedisStateStore) Expire(key string, ttl time.Duration) error {
+	_, err := s.do("PEXPIRE", s.Prefix+key, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+
+	return err
+}
+
+func (s *RedisStateStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		v, err := s.do("SCAN", cursor, "MATCH", s.Prefix+prefix+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+
+		reply, ok := v.([]interface{})
+		if !ok || len(reply) != 2 {
+			return nil, RedisError("unexpected reply to SCAN")
+		}
+
+		cursor, _ = reply[0].(string)
+		items, _ := reply[1].([]interface{})
+		for _, k := range items {
+			if k, ok := k.(string); ok {
+				keys = append(keys, strings.TrimPrefix(k, s.Prefix))
+			}
+		}
+
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Closes the connection to Redis.
+func (s *RedisStateStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
+
+// Sends a command to Redis and returns its reply, connecting first if there is no open
+// connection. Any connection error causes the connection to be discarded so that the next
+// command reconnects.
+func (s *RedisStateStore) do(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := s.command(args...)
+	if err != nil {
+		if _, ok := err.(RedisError); !ok {
+			s.conn.Close()
+			s.conn = nil
+		}
+	}
+
+	return v, err
+}
+
+func (s *RedisStateStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+
+	if s.Password != "" {
+		if _, err := s.command("AUTH", s.Password); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+
+	if s.DB != 0 {
+		if _, err := s.command("SELECT", strconv.Itoa(s.DB)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes a command using the Redis protocol and reads the reply. The caller must hold the lock.
+func (s *RedisStateStore) command(args ...string) (interface{}, error) {
+	s.conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(s.r)
+}
+
+// Reads a single reply from a Redis server. Bulk and simple strings are returned as strings,
+// integers as int64, arrays as []interface{}, and nil replies as nil.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("sftp: redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				if _, ok := err.(RedisError); !ok {
+					return nil, err
+				}
+			}
+		}
+
+		return items, nil
+	default:
+		return nil, fmt.Errorf("sftp: redis: unexpected reply %q", line)
+	}
+}
+
+// Determines if the key has been marked in either the local cache or the shared state.
+func (c Server) hasShared(key string) bool {
+	if _, ok := c.cache.Get(key); ok {
+		return true
+	}
+
+	if c.State == nil {
+		return false
+	}
+
+	_, ok, err := c.State.Get(key)
+	if err != nil {
+		c.logger.Warnw("failed to read from shared state", zap.String("key", key), zap.Error(err))
+	}
+
+	return ok
+}
+
+// Marks the key in the local cache and the shared state for the given duration, returning false
+// if it was already marked. Unlike checking with hasShared first, only one of several sessions
+// doing this at the same time, on any instance of the cluster, is able to mark the key. If the
+// shared state is unavailable only the local cache is checked.
+func (c Server) claimShared(key string, ttl time.Duration) bool {
+	if err := c.cache.Add(key, true, ttl); err != nil {
+		return false
+	}
+
+	if c.State == nil {
+		return true
+	}
+
+	ok, err := c.State.SetNX(key, "1", ttl)
+	if err != nil {
+		c.logger.Warnw("failed to write to shared state", zap.String("key", key), zap.Error(err))
+		return true
+	}
+
+	return ok
+}
+
+// Marks the key in the local cache and the shared state for the given duration.
+func (c Server) setShared(key string, ttl time.Duration) {
+	c.cache.Set(key, true, ttl)
+
+	if c.State != nil {
+		if err := c.State.Set(key, "1", ttl); err != nil {
+			c.logger.Warnw("failed to write to shared state", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+// The amount of time a count kept in the shared state remains there without being refreshed by
+// an instance that contributes to it.
+const clusterCountTTL = 2 * time.Minute
+
+// Tracks the counts this instance contributes to those kept in the shared state, such as the
+// number of connections, along with the cluster-wide totals last seen for them. This allows the
+// counts to be refreshed, and limits that are shared by the cluster, such as the bandwidth limit,
+// to be split between the instances in proportion to how much each of them is serving.
+type clusterCounts struct {
+	mu     sync.Mutex
+	local  map[string]int64
+	totals map[string]int64
+}
+
+func newClusterCounts() *clusterCounts {
+	return &clusterCounts{local: make(map[string]int64), totals: make(map[string]int64)}
+}
+
+func (c *clusterCounts) add(key string, delta int64, total int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.local[key] += delta
+	if c.local[key] <= 0 {
+		delete(c.local, key)
+	}
+	c.totals[key] = total
+}
+
+// Returns the portion of a limit shared by the cluster that applies to this instance, based on
+// the share of the count for the key that it contributes. The entire limit applies when there is
+// no shared state or this instance does not contribute to the count.
+func (c *clusterCounts) share(key string, limit int64) int64 {
+	if c == nil || limit <= 0 {
+		return limit
+	}
+
+	c.mu.Lock()
+	local, total := c.local[key], c.totals[key]
+	c.mu.Unlock()
+
+	if local <= 0 || total <= local {
+		return limit
+	}
+
+	if n := limit * local / total; n > 0 {
+		return n
+	}
+
+	return 1
+}
+
+// Adds one to the count for the key in the shared state, returning false and leaving the count
+// unchanged if it would exceed the limit. The returned function must be called to remove it
+// again. A limit of 0 counts without limiting, and if the shared state is unavailable the
+// request is allowed.
+//
+// Instances that exit without removing what they added, such as when the process is killed,
+// leave the count too high until the key expires, which only happens once no instance is
+// contributing to it any longer.
+func (c Server) acquireShared(key string, limit int) (func(), bool) {
+	if c.State == nil {
+		return func() {}, true
+	}
+
+	n, err := c.State.Incr(key, clusterCountTTL)
+	if err != nil {
+		c.logger.Warnw("failed to write to shared state", zap.String("key", key), zap.Error(err))
+		return func() {}, true
+	}
+
+	if limit > 0 && n > int64(limit) {
+		if _, err := c.State.Decr(key); err != nil {
+			c.logger.Warnw("failed to write to shared state", zap.String("key", key), zap.Error(err))
+		}
+		return nil, false
+	}
+
+	c.cluster.add(key, 1, n)
+
+	return func() {
+		n, err := c.State.Decr(key)
+		if err != nil {
+			c.logger.Warnw("failed to write to shared state", zap.String("key", key), zap.Error(err))
+		}
+		c.cluster.add(key, -1, n)
+	}, true
+}
+
+// Refreshes the expiry of the counts this instance contributes to in the shared state so that
+// they are kept for as long as it is connected, and fetches their current totals.
+func (c Server) refreshShared() {
+	if c.State == nil {
+		return
+	}
+
+	c.cluster.mu.Lock()
+	keys := make([]string, 0, len(c.cluster.local))
+	for k := range c.cluster.local {
+		keys = append(keys, k)
+	}
+	c.cluster.mu.Unlock()
+
+	for _, k := range keys {
+		if err := c.State.Expire(k, clusterCountTTL); err != nil {
+			c.logger.Warnw("failed to write to shared state", zap.String("key", k), zap.Error(err))
+			continue
+		}
+
+		if v, ok, err := c.State.Get(k); err == nil && ok {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			c.cluster.add(k, 0, n)
+		}
+	}
+}
+
+// Records a new connection to this instance, returning false if the cluster has reached the
+// maximum number of connections. The returned function must be called once the connection is
+// closed.
+func (c Server) acquireClusterConnection() (func(), bool) {
+	return c.acquireShared("connections", c.Settings.MaxClusterConnections)
+}
+
+// The interval at which disconnects requested on other instances are checked for.
+const clusterDisconnectInterval = 5 * time.Second
+
+// Publishes a disconnect of every session for a server to the shared state, so that the other
+// instances in the cluster close the sessions that were connected to it before now.
+func (c Server) publishDisconnect(server string, msg string) {
+	if c.State == nil {
+		return
+	}
+
+	v := strconv.FormatInt(time.Now().UnixNano(), 10) + "\n" + msg
+	if err := c.State.Set("disconnect:"+server, v, time.Minute); err != nil {
+		c.logger.Warnw("failed to write to shared state", zap.String("key", "disconnect:"+server), zap.Error(err))
+	}
+}
+
+// Periodically checks the shared state for disconnects published by other instances in the
+// cluster, and disconnects the matching sessions connected to this instance.
+func (c *Server) watchClusterDisconnects() {
+	seen := make(map[string]int64)
+
+	t := time.NewTicker(clusterDisconnectInterval)
+	defer t.Stop()
+
+	for range t.C {
+		keys, err := c.State.Keys("disconnect:")
+		if err != nil {
+			c.logger.Warnw("failed to read from shared state", zap.Error(err))
+			continue
+		}
+
+		for _, k := range keys {
+			v, ok, err := c.State.Get(k)
+			if err != nil || !ok {
+				continue
+			}
+
+			parts := strings.SplitN(v, "\n", 2)
+			at, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil || len(parts) != 2 || at <= seen[k] {
+				continue
+			}
+			seen[k] = at
+
+			c.disconnectServer(strings.TrimPrefix(k, "disconnect:"), parts[1], time.Unix(0, at))
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package sftp_server
+
+import (
+	"encoding/binary"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The maximum amount of time tracing may be enabled for a server at once.
+const maxTraceDuration = time.Hour
+
+// The number of bytes of each packet that are decoded when tracing, which is enough for the
+// paths and attributes of any request without holding on to the contents of file writes.
+const traceCaptureLimit = 4096
+
+// The name of the logger that packet traces are written to. Traces are never coalesced since
+// every packet matters when debugging a client.
+const traceLoggerName = "sftp-trace"
+
+// The servers that currently have tracing enabled, and when it expires for each of them.
+type traceRegistry struct {
+	mu      sync.RWMutex
+	servers map[string]time.Time
+}
+
+func newTraceRegistry() *traceRegistry {
+	return &traceRegistry{servers: make(map[string]time.Time)}
+}
+
+// Determines if tracing is currently enabled for the server.
+func (r *traceRegistry) active(server string) bool {
+	r.mu.RLock()
+	until, ok := r.servers[server]
+	r.mu.RUnlock()
+
+	return ok && time.Now().Before(until)
+}
+
+// Enables tracing of every SFTP packet sent and received by sessions connected to the server
+// for the given amount of time, capped at one hour. Each packet is logged with its type, flags
+// and attributes, allowing incompatibilities with a particular client to be debugged without a
+// custom build. Sessions that are already connected are traced as well.
+func (c *Server) TraceServer(server string, d time.Duration) {
+	if d > maxTraceDuration {
+		d = maxTraceDuration
+	}
+
+	c.traces.mu.Lock()
+	defer c.traces.mu.Unlock()
+
+	for s, until := range c.traces.servers {
+		if time.Now().After(until) {
+			delete(c.traces.servers, s)
+		}
+	}
+
+	c.traces.servers[server] = time.Now().Add(d)
+	c.logger.Infow("enabled sftp packet tracing for server", zap.String("server", server), zap.Duration("duration", d))
+}
+
+// Disables tracing for the server.
+func (c *Server) StopTrace(server string) {
+	c.traces.mu.Lock()
+	defer c.traces.mu.Unlock()
+
+	delete(c.traces.servers, server)
+}
+
+// Returns a HTTP handler that enables tracing for the server given by the "server" parameter on
+// POST requests, for the duration given by the "duration" parameter which defaults to five
+// minutes, and disables it on DELETE requests. This can be mounted on the daemon's control API.
+func (c *Server) TraceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server := r.URL.Query().Get("server")
+		if server == "" {
+			http.Error(w, "missing server parameter", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			d := 5 * time.Minute
+			if v := r.URL.Query().Get("duration"); v != "" {
+				var err error
+				if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+					http.Error(w, "invalid duration parameter", http.StatusBadRequest)
+					return
+				}
+			}
+
+			c.TraceServer(server, d)
+		case http.MethodDelete:
+			c.StopTrace(server)
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Wraps the channel used by an SFTP session so that its packets are logged while tracing is
+// enabled for the session's server. The init packet sent by the client is always captured so
+// that the negotiated protocol version and extensions can be logged.
+type tracingChannel struct {
+	io.ReadWriteCloser
+
+	server    string
+	traces    *traceRegistry
+	transport *transport
+	logger    *zap.SugaredLogger
+
+	in  traceStream
+	out traceStream
+}
+
+func (c Server) traceChannel(ch io.ReadWriteCloser, s *session, tr *transport) io.ReadWriteCloser {
+	t := &tracingChannel{
+		ReadWriteCloser: ch,
+		server:          s.uuid,
+		traces:          c.traces,
+		transport:       tr,
+		logger:          s.logger.Named(traceLoggerName),
+		in:              traceStream{direction: "request"},
+		out:             traceStream{direction: "response"},
+	}
+
+	t.in.first = func(b []byte) {
+		c.logNegotiation(s, b)
+	}
+
+	return t
+}
+
+func (t *tracingChannel) Read(b []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(b)
+	if n > 0 {
+		t.in.feed(b[:n], t.traces.active(t.server), t.logger)
+	}
+
+	// The SFTP server stops once reading fails, closing any files the client left open.
+	if err != nil {
+		t.transport.lose()
+	}
+
+	return n, err
+}
+
+func (t *tracingChannel) Write(b []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(b)
+	if n > 0 {
+		t.out.feed(b[:n], t.traces.active(t.server), t.logger)
+	}
+
+	return n, err
+}
+
+// Splits one direction of an SFTP stream into packets. Packet boundaries are always tracked so
+// that tracing can be enabled part way through a session, but packets are only captured and
+// decoded while tracing is active.
+type traceStream struct {
+	mu        sync.Mutex
+	direction string
+	header    [4]byte
+	headerLen int
+	remaining uint32
+	length    uint32
+	body      []byte
+	packets   int
+
+	// Called with the first packet of the stream, if set.
+	first func(b []byte)
+}
+
+func (t *traceStream) feed(b []byte, active bool, logger *zap.SugaredLogger) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(b) > 0 {
+		capture := active || (t.packets == 0 && t.first != nil)
+		if t.remaining == 0 {
+			k := copy(t.header[t.headerLen:], b)
+			t.headerLen += k
+			b = b[k:]
+			if t.headerLen < 4 {
+				return
+			}
+
+			t.headerLen = 0
+			t.length = binary.BigEndian.Uint32(t.header[:])
+			t.remaining = t.length
+			t.body = t.body[:0]
+			continue
+		}
+
+		k := uint32(len(b))
+		if k > t.remaining {
+			k = t.remaining
+		}
+
+		if capture && len(t.body) < traceCaptureLimit {
+			c := int(k)
+			if len(t.body)+c > traceCaptureLimit {
+				c = traceCaptureLimit - len(t.body)
+			}
+			t.body = append(t.body, b[:c]...)
+		}
+
+		t.remaining -= k
+		b = b[k:]
+
+		if t.remaining > 0 {
+			continue
+		}
+
+		t.packets++
+		if t.packets == 1 && t.first != nil {
+			t.first(t.body)
+		}
+
+		if active {
+			fields := append([]interface{}{zap.String("direction", t.direction), zap.Uint32("length", t.length)}, decodePacket(t.body)...)
+			logger.Infow("sftp packet", fields...)
+		}
+	}
+}
+
+// The names of the SFTP packet types.
+var packetTypes = map[byte]string{
+	1: "init", 2: "version", 3: "open", 4: "close", 5: "read", 6: "write", 7: "lstat", 8: "fstat",
+	9: "setstat", 10: "fsetstat", 11: "opendir", 12: "readdir", 13: "remove", 14: "mkdir",
+	15: "rmdir", 16: "realpath", 17: "stat", 18: "rename", 19: "readlink", 20: "symlink",
+	101: "status", 102: "handle", 103: "data", 104: "name", 105: "attrs", 200: "extended",
+	201: "extended-reply",
+}
+
+// Reads the fields of a packet, recording whether any field could not be read because the
+// packet is truncated or malformed.
+type packetReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *packetReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.bad = true
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+
+	return v
+}
+
+func (r *packetReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.bad = true
+		return 0
+	}
+
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+
+	return v
+}
+
+func (r *packetReader) string() string {
+	n := r.uint32()
+	if r.bad || uint32(len(r.b)) < n {
+		r.bad = true
+		return ""
+	}
+
+	v := string(r.b[:n])
+	r.b = r.b[n:]
+
+	return v
+}
+
+// Reads a set of file attributes, returning the attributes that are present.
+func (r *packetReader) attrs() map[string]interface{} {
+	flags := r.uint32()
+	a := map[string]interface{}{"flags": flags}
+	if flags&0x1 != 0 {
+		a["size"] = r.uint64()
+	}
+
+	if flags&0x2 != 0 {
+		a["uid"] = r.uint32()
+		a["gid"] = r.uint32()
+	}
+
+	if flags&0x4 != 0 {
+		a["mode"] = r.uint32()
+	}
+
+	if flags&0x8 != 0 {
+		a["atime"] = r.uint32()
+		a["mtime"] = r.uint32()
+	}
+
+	if flags&0x80000000 != 0 {
+		n := r.uint32()
+		for i := uint32(0); i < n && !r.bad; i++ {
+			a["extended:"+r.string()] = r.string()
+		}
+	}
+
+	return a
+}
+
+// Decodes the contents of a packet into fields for a log line. The contents of files and
+// handles are not logged, only their sizes.
+func decodePacket(b []byte) []interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+
+	name, ok := packetTypes[b[0]]
+	if !ok {
+		return []interface{}{zap.Uint8("type", b[0])}
+	}
+
+	fields := []interface{}{zap.String("type", name)}
+	r := &packetReader{b: b[1:]}
+	if b[0] == 1 || b[0] == 2 {
+		return append(fields, zap.Uint32("version", r.uint32()))
+	}
+
+	fields = append(fields, zap.Uint32("id", r.uint32()))
+
+	switch name {
+	case "open":
+		fields = append(fields, zap.String("path", r.string()), zap.Uint32("pflags", r.uint32()), zap.Any("attrs", r.attrs()))
+	case "close", "fstat", "readdir":
+		r.string()
+	case "read":
+		r.string()
+		fields = append(fields, zap.Uint64("offset", r.uint64()), zap.Uint32("size", r.uint32()))
+	case "write":
+		r.string()
+		fields = append(fields, zap.Uint64("offset", r.uint64()), zap.Uint32("size", r.uint32()))
+	case "setstat", "mkdir":
+		fields = append(fields, zap.String("path", r.string()), zap.Any("attrs", r.attrs()))
+	case "fsetstat":
+		r.string()
+		fields = append(fields, zap.Any("attrs", r.attrs()))
+	case "lstat", "opendir", "remove", "rmdir", "realpath", "stat", "readlink":
+		fields = append(fields, zap.String("path", r.string()))
+	case "rename", "symlink":
+		fields = append(fields, zap.String("path", r.string()), zap.String("target", r.string()))
+	case "status":
+		fields = append(fields, zap.Uint32("code", r.uint32()), zap.String("message", r.string()))
+	case "data":
+		fields = append(fields, zap.Uint32("size", r.uint32()))
+	case "name":
+		fields = append(fields, zap.Uint32("count", r.uint32()))
+	case "attrs":
+		fields = append(fields, zap.Any("attrs", r.attrs()))
+	case "extended":
+		req := r.string()
+		fields = append(fields, zap.String("request", req))
+		if req == "posix-rename@openssh.com" || req == "hardlink@openssh.com" {
+			fields = append(fields, zap.String("path", r.string()), zap.String("target", r.string()))
+		}
+	}
+
+	if r.bad {
+		fields = append(fields, zap.Bool("truncated", true))
+	}
+
+	return fields
+}
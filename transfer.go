@@ -0,0 +1,147 @@
+package sftp_server
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracks the number of bytes transferred during a single SFTP session.
+type transferStats struct {
+	read    uint64
+	written uint64
+	open    int64
+	started time.Time
+
+	// The files that are currently open for writing, keyed by their path, along with the
+	// access and modification times set by the client while they were open. These are
+	// re-applied when the file is closed, and the entry is removed.
+	times sync.Map
+
+	// The limiters that reads and writes for the session must wait on.
+	limiters []*bandwidthLimiter
+
+	// Called with the path relative to the server's root and the number of bytes transferred
+	// for each file when it is closed.
+	onClose func(p string, read uint64, written uint64)
+}
+
+// Applies any times set by the client on the file at the given path while it was open.
+func (t *transferStats) applyTimes(p string) {
+	if v, ok := t.times.Load(p); ok {
+		t.times.Delete(p)
+		if times := v.([2]time.Time); !times[1].IsZero() {
+			os.Chtimes(p, times[0], times[1])
+		}
+	}
+}
+
+// Stores the times set by the client on the file at the given path, if it is open for writing,
+// so that they can be applied again once it has been closed.
+func (t *transferStats) storeTimes(p string, atime time.Time, mtime time.Time) {
+	if _, ok := t.times.Load(p); ok {
+		t.times.Store(p, [2]time.Time{atime, mtime})
+	}
+}
+
+// Wraps a file opened for writing so that the times set by the client while it is open are
+// tracked until it is closed.
+type timesFile struct {
+	backendFile
+	stats *transferStats
+	path  string
+}
+
+// Tracks the file at the given path as being open for writing. Any times previously set by the
+// client no longer apply once the file is written to again, so they are cleared.
+func (fs FileSystem) withTimes(f backendFile, p string) backendFile {
+	if fs.stats == nil {
+		return f
+	}
+	fs.stats.times.Store(p, [2]time.Time{})
+
+	return &timesFile{backendFile: f, stats: fs.stats, path: p}
+}
+
+// Closes the file and stops tracking it. Many clients set the times on a file before closing
+// it after an upload, which would be overwritten by any writes that happened in between or by
+// the file replacing it, so they are applied again once the upload has been completed.
+func (f *timesFile) Close() error {
+	err := f.backendFile.Close()
+	if err != nil {
+		f.stats.times.Delete(f.path)
+	} else {
+		f.stats.applyTimes(f.path)
+	}
+
+	return err
+}
+
+// Waits until the given number of bytes may be transferred without exceeding any of the
+// bandwidth limits that apply to the session.
+func (t *transferStats) throttle(n int) {
+	for _, l := range t.limiters {
+		l.wait(n)
+	}
+}
+
+// The number of bytes transferred for a single open file.
+type fileCounts struct {
+	read    uint64
+	written uint64
+}
+
+func newTransferStats() *transferStats {
+	return &transferStats{started: time.Now()}
+}
+
+// Returns the average throughput of the session in bytes per second.
+func (t *transferStats) Throughput() float64 {
+	elapsed := time.Since(t.started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(atomic.LoadUint64(&t.read)+atomic.LoadUint64(&t.written)) / elapsed
+}
+
+// Wraps a file opened for a session so that all of the data read from and written to it
+// is accounted for in the session's transfer stats.
+type countingFile struct {
+	backendFile
+	name   string
+	stats  *transferStats
+	counts *fileCounts
+}
+
+func (f countingFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.backendFile.ReadAt(b, off)
+	atomic.AddUint64(&f.stats.read, uint64(n))
+	atomic.AddUint64(&f.counts.read, uint64(n))
+	f.stats.throttle(n)
+
+	return n, err
+}
+
+func (f countingFile) WriteAt(b []byte, off int64) (int, error) {
+	f.stats.throttle(len(b))
+
+	n, err := f.backendFile.WriteAt(b, off)
+	atomic.AddUint64(&f.stats.written, uint64(n))
+	atomic.AddUint64(&f.counts.written, uint64(n))
+
+	return n, err
+}
+
+func (f countingFile) Close() error {
+	atomic.AddInt64(&f.stats.open, -1)
+
+	err := f.backendFile.Close()
+
+	if f.stats.onClose != nil {
+		f.stats.onClose(f.name, atomic.LoadUint64(&f.counts.read), atomic.LoadUint64(&f.counts.written))
+	}
+
+	return err
+}
@@ -0,0 +1,401 @@
+package sftp_server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"go.uber.org/zap"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The suffix of the sidecar files containing the expected checksum of an upload.
+const checksumSuffix = ".sha256"
+
+// Returned when the contents of an uploaded file do not match the checksum provided for it.
+var ErrChecksumMismatch = errors.New("sftp: uploaded file does not match its checksum")
+
+// Returned when closing an upload after the connection it was being sent over was lost.
+var errUploadAborted = errors.New("sftp: upload was aborted before it was completed")
+
+// Tracks whether the connection a filesystem is serving has been lost. Files that are still
+// open at that point are closed by the SFTP server without the client having finished with
+// them, so uploads being written to a temporary file are discarded rather than moved into
+// place or held in quarantine.
+type transport struct {
+	lost int32
+}
+
+func (t *transport) lose() {
+	if t != nil {
+		atomic.StoreInt32(&t.lost, 1)
+	}
+}
+
+func (t *transport) isLost() bool {
+	return t != nil && atomic.LoadInt32(&t.lost) == 1
+}
+
+// Wraps a file that is being uploaded so that its contents can be checked once the client has
+// finished writing it. Data is hashed as it is written so the file does not need to be read
+// back from the disk, unless the client writes to it out of order.
+type uploadFile struct {
+	backendFile
+	fs   FileSystem
+	path string
+	name string
+	// The temporary file the upload is being written to, which replaces the file at path once
+	// the upload is complete. Empty if the upload is being written to path directly.
+	tmp string
+	// Set if the temporary file is in the quarantine directory, in which case it is held there
+	// rather than replacing the file at path if it is larger than the QuarantineThreshold.
+	quarantine bool
+	// Set if the upload was discarded because it had the same contents as the existing file.
+	unchanged bool
+
+	mu     sync.Mutex
+	hash   hash.Hash
+	offset int64
+}
+
+// Wraps the file opened for an upload if any of the upload checks are enabled for the server,
+// if the upload is being written to a temporary file, or if the change journal needs to record
+// the upload once it is complete. The data is only hashed as it is written if the checksum
+// will be needed.
+func (fs FileSystem) withUpload(f backendFile, p string, name string, tmp string) backendFile {
+	if !fs.VerifyChecksums && !fs.normalizesLineEndings(p) && fs.validatorFor(name) == nil && tmp == "" && fs.journal == nil {
+		return f
+	}
+
+	u := &uploadFile{backendFile: f, fs: fs, path: p, name: name, tmp: tmp}
+	if fs.VerifyChecksums || tmp != "" {
+		u.hash = sha256.New()
+	}
+
+	return u
+}
+
+// Returns the path that the uploaded data is being written to.
+func (f *uploadFile) written() string {
+	if f.tmp != "" {
+		return f.tmp
+	}
+
+	return f.path
+}
+
+func (f *uploadFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.backendFile.WriteAt(b, off)
+
+	if f.hash == nil {
+		return n, err
+	}
+
+	f.mu.Lock()
+	if f.offset == off {
+		f.hash.Write(b[:n])
+		f.offset += int64(n)
+	} else {
+		f.offset = -1
+	}
+	f.mu.Unlock()
+
+	return n, err
+}
+
+func (f *uploadFile) Close() error {
+	if f.tmp != "" && f.fs.transport.isLost() {
+		f.fs.logger.Infow("discarding upload that was aborted", zap.String("file", f.name))
+		return f.discard(errUploadAborted)
+	}
+
+	if err := f.backendFile.Close(); err != nil {
+		return err
+	}
+
+	// Closing happens outside of the handlers, so the error kinds are converted here instead.
+	return statusError(f.fs.finishUpload(f))
+}
+
+// Implemented by files opened for writing that can be closed without finishing the upload,
+// discarding what was written.
+type discarder interface {
+	discard(err error) error
+}
+
+// Closes the file without finishing the upload, removing the temporary file it was being
+// written to, and returns the given error.
+func (f *uploadFile) discard(err error) error {
+	f.backendFile.Close()
+	if f.tmp != "" {
+		os.Remove(f.tmp)
+	}
+
+	return err
+}
+
+// Returns the SHA-256 checksum of the uploaded file, using the hash computed while it was
+// being written if possible.
+func (f *uploadFile) checksum() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.hash != nil && f.offset >= 0 {
+		if st, err := os.Stat(f.written()); err == nil && st.Size() == f.offset {
+			return hex.EncodeToString(f.hash.Sum(nil)), nil
+		}
+	}
+
+	return hashFile(f.written())
+}
+
+// The marker in the names of the temporary files that uploads replacing a file are written to,
+// which are named after the file they replace followed by this and a random number.
+const uploadTempMarker = ".upload-"
+
+// Returns the pattern for the name of the temporary file an upload replacing the file at p is
+// written to.
+func uploadTempPattern(p string) string {
+	return "." + filepath.Base(p) + uploadTempMarker
+}
+
+// Determines if the file name is that of a temporary file an upload is being written to.
+func isUploadTempFile(name string) bool {
+	i := strings.LastIndex(name, uploadTempMarker)
+	if i <= 0 || name[0] != '.' || i+len(uploadTempMarker) == len(name) {
+		return false
+	}
+
+	for _, c := range name[i+len(uploadTempMarker):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Removes the temporary files of uploads in progress from a directory listing, since they
+// replace the file they are named after once the upload is complete.
+func hideUploadTempFiles(files []os.FileInfo) []os.FileInfo {
+	visible := files[:0]
+	for _, f := range files {
+		if !isUploadTempFile(f.Name()) {
+			visible = append(visible, f)
+		}
+	}
+
+	return visible
+}
+
+// Runs the configured checks against a file once it has been uploaded.
+func (fs FileSystem) finishUpload(f *uploadFile) error {
+	if f.quarantine && fs.holds(f) {
+		return fs.holdUpload(f)
+	}
+
+	// Checksums are of the contents the client sent, so they are verified before the line
+	// endings are normalized. Uploads that do not match are still kept but left as they are.
+	var checksumErr error
+	if fs.VerifyChecksums {
+		checksumErr = fs.verifyChecksum(f)
+	}
+
+	// Uploads written to a temporary file are normalized before being compared with the
+	// existing file, so that uploading a file that only differs by its line endings leaves the
+	// existing file untouched.
+	if checksumErr == nil && fs.normalizesLineEndings(f.path) {
+		fs.normalizeLineEndings(f.written())
+	}
+
+	if f.tmp != "" {
+		if err := fs.replaceIfChanged(f); err != nil {
+			return err
+		}
+	}
+
+	if checksumErr != nil {
+		return checksumErr
+	}
+
+	fs.validateFile(f.name, f.path)
+
+	if !f.unchanged {
+		fs.journalChange(EventWrite, f.name, "")
+	}
+
+	return nil
+}
+
+// The largest file that line endings will be normalized in. Anything larger than this is very
+// unlikely to be a configuration file that someone has edited by hand.
+const maxNormalizeSize = 8 << 20
+
+// Determines if line endings should be normalized for the file at the given path based on its
+// extension.
+func (fs FileSystem) normalizesLineEndings(p string) bool {
+	ext := strings.ToLower(filepath.Ext(p))
+	if ext == "" {
+		return false
+	}
+
+	for _, e := range fs.LineEndingExtensions {
+		if strings.ToLower(strings.TrimPrefix(e, ".")) == ext[1:] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Converts the Windows line endings in the file to Unix line endings, leaving the modification
+// time of the file unchanged. Many games fail to parse configuration files that have been edited
+// on Windows, so this prevents a file uploaded from a Windows machine breaking the server.
+func (fs FileSystem) normalizeLineEndings(p string) {
+	st, err := os.Stat(p)
+	if err != nil || !st.Mode().IsRegular() || st.Size() > maxNormalizeSize {
+		return
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil || !bytes.Contains(b, []byte("\r\n")) {
+		return
+	}
+
+	n := bytes.Count(b, []byte("\r\n"))
+	if err := ioutil.WriteFile(p, bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), st.Mode().Perm()); err != nil {
+		fs.logger.Warnw("failed to normalize line endings in file", zap.String("file", p), zap.Error(err))
+		return
+	}
+
+	os.Chtimes(p, st.ModTime(), st.ModTime())
+	fs.logger.Infow("normalized line endings in uploaded file", zap.String("file", p), zap.Int("lines", n))
+}
+
+// Replaces the existing file with the uploaded one, unless the client uploaded exactly the same
+// contents, in which case the upload is discarded and the existing file is left untouched. This
+// avoids needless disk churn for users that repeatedly upload the same files.
+func (fs FileSystem) replaceIfChanged(f *uploadFile) error {
+	defer os.Remove(f.tmp)
+
+	existing, err := os.Stat(f.path)
+	if err == nil {
+		uploaded, err := os.Stat(f.tmp)
+		if err == nil && uploaded.Size() == existing.Size() {
+			a, aerr := f.checksum()
+			b, berr := hashFile(f.path)
+			if aerr == nil && berr == nil && a == b {
+				f.tmp = ""
+				f.unchanged = true
+				fs.logger.Debugw("uploaded file is unchanged, keeping existing file", zap.String("file", f.path))
+				if fs.metrics != nil {
+					fs.metrics.Inc("uploads_unchanged_total")
+				}
+
+				return nil
+			}
+		}
+
+		if err := fs.guardCriticalFile(f, existing); err != nil {
+			return err
+		}
+
+		os.Chmod(f.tmp, existing.Mode().Perm())
+	}
+
+	owner := fs.User
+	if fs.PreserveOwnership && existing != nil {
+		if o, ok := fileOwner(existing); ok {
+			owner = o
+		}
+	}
+
+	if err := os.Chown(f.tmp, owner.Uid, owner.Gid); err != nil {
+		fs.logger.Warnw("error chowning file", zap.String("file", f.tmp), zap.Error(err))
+	}
+
+	fs.relabel(f.tmp)
+
+	fs.saveVersion(f.name, f.path)
+
+	if err := os.Rename(f.tmp, f.path); err != nil {
+		fs.logger.Errorw("failed to replace file with upload", zap.String("file", f.path), zap.Error(err))
+		return err
+	}
+	f.tmp = ""
+
+	fs.recordModifiedBy(f.path)
+	if fs.stats != nil {
+		fs.stats.applyTimes(f.path)
+	}
+
+	return nil
+}
+
+// Compares an uploaded file against the checksum in its sidecar file, if one has been uploaded.
+// Clients may upload the checksum either before or after the file itself using the format
+// written by sha256sum, so uploading a sidecar also verifies the file it belongs to.
+func (fs FileSystem) verifyChecksum(f *uploadFile) error {
+	p, name := f.path, f.name
+	sidecar := p + checksumSuffix
+	var actual string
+	var err error
+	if strings.HasSuffix(p, checksumSuffix) {
+		// The new sidecar may still be in a temporary file rather than in place.
+		p, name, sidecar = strings.TrimSuffix(p, checksumSuffix), strings.TrimSuffix(name, checksumSuffix), f.written()
+		if _, err := os.Stat(p); err != nil {
+			return nil
+		}
+
+		actual, err = hashFile(p)
+	} else {
+		actual, err = f.checksum()
+	}
+
+	if err != nil {
+		fs.logger.Warnw("failed to compute checksum of uploaded file", zap.String("file", p), zap.Error(err))
+		return nil
+	}
+
+	expected, ok := readChecksum(sidecar)
+	if !ok {
+		return nil
+	}
+
+	if expected != actual {
+		fs.logger.Warnw("uploaded file does not match its checksum",
+			zap.String("file", p),
+			zap.String("expected", expected),
+			zap.String("actual", actual),
+		)
+		fs.emit(EventChecksumMismatch, name, "")
+		if fs.metrics != nil {
+			fs.metrics.Inc("upload_checksum_mismatches_total")
+		}
+
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// Reads the expected checksum from a sidecar file in the format written by sha256sum.
+func readChecksum(p string) (string, bool) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", false
+	}
+
+	fields := bytes.Fields(b)
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", false
+	}
+
+	return strings.ToLower(string(fields[0])), true
+}
@@ -0,0 +1,66 @@
+package sftp_server
+
+import (
+	"strings"
+)
+
+// The structured form of a username provided by a connecting client. The Panel has always
+// accepted usernames in the form "<username>.<server short id>", this additionally allows an
+// email address to be used in place of the username, and "#" to be used as the separator, so
+// that users with access to many servers can identify the one they want more easily.
+type UsernameIdentity struct {
+	// The Panel username, empty when the user identified themselves with an email address.
+	Username string `json:"username,omitempty"`
+	// The email address of the user, empty when a username was provided.
+	Email string `json:"email,omitempty"`
+	// The identifier of the server the user is connecting to. This is either the short
+	// identifier of the server or a longer prefix of its UUID.
+	Server string `json:"server"`
+}
+
+// Parses the username provided by a client into its structured form. The supported formats
+// are "<username or email>.<server id>" and "<username or email>#<server id>", where the server
+// id is at least the first eight characters of the server UUID. Usernames that do not match
+// either format return false and are passed to the Panel as is.
+func ParseUsername(user string) (*UsernameIdentity, bool) {
+	i := strings.LastIndex(user, "#")
+	if i == -1 {
+		i = strings.LastIndex(user, ".")
+	}
+
+	if i <= 0 || !isServerIdentifier(user[i+1:]) {
+		return nil, false
+	}
+
+	id := &UsernameIdentity{Server: strings.ToLower(user[i+1:])}
+	if name := user[:i]; strings.Contains(name, "@") {
+		id.Email = name
+	} else {
+		id.Username = name
+	}
+
+	return id, true
+}
+
+// Determines if the given string is a prefix of a server UUID that is long enough to be used
+// to identify the server, which is the case for both the short identifier and the full UUID.
+func isServerIdentifier(s string) bool {
+	if len(s) < 8 || len(s) > 36 {
+		return false
+	}
+
+	for i, r := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
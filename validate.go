@@ -0,0 +1,98 @@
+package sftp_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Checks the contents of a file once it has been uploaded, returning an error describing the
+// problem if the file is not valid.
+type FileValidator func(contents []byte) error
+
+// The suffix of the file written alongside an uploaded file that failed validation.
+const validationErrorSuffix = ".error.txt"
+
+// Validates that the contents of a file are valid JSON, such as ops.json or whitelist.json.
+func ValidateJSON(b []byte) error {
+	var v interface{}
+
+	return json.Unmarshal(b, &v)
+}
+
+// Validates that the contents of a file are valid YAML, such as a plugin's config.yml.
+func ValidateYAML(b []byte) error {
+	var v interface{}
+
+	return yaml.Unmarshal(b, &v)
+}
+
+// Determines if the path requested by the client matches the given pattern. Patterns without a
+// slash match the file name in any directory, while patterns with one are matched against the
+// full path from the server's root.
+func matchesFilePattern(pattern string, name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+
+	ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), name)
+
+	return ok
+}
+
+// Returns the validator that applies to the path requested by the client, if there is one.
+func (fs FileSystem) validatorFor(name string) FileValidator {
+	for pattern, v := range fs.FileValidators {
+		if matchesFilePattern(pattern, name) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// Runs the validator for an uploaded file, catching a broken configuration file before the game
+// server tries to load it and crashes. The upload is never rejected, but the failure is logged,
+// emitted as an event, and optionally written to a file next to the uploaded one so the user
+// sees it when browsing the directory.
+func (fs FileSystem) validateFile(name string, p string) {
+	v := fs.validatorFor(name)
+	if v == nil {
+		return
+	}
+
+	st, err := os.Stat(p)
+	if err != nil || !st.Mode().IsRegular() || st.Size() > maxNormalizeSize {
+		return
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return
+	}
+
+	verr := v(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")))
+	if verr == nil {
+		os.Remove(p + validationErrorSuffix)
+		return
+	}
+
+	fs.logger.Infow("uploaded file failed validation", zap.String("file", p), zap.Error(verr))
+	fs.emit(EventValidationFailed, name, verr.Error())
+	if fs.metrics != nil {
+		fs.metrics.Inc("file_validation_failures_total")
+	}
+
+	if fs.WriteValidationErrors {
+		msg := "This file was uploaded with the following error and may prevent the server from starting:\n\n" + verr.Error() + "\n"
+		if err := ioutil.WriteFile(p+validationErrorSuffix, []byte(msg), 0644); err == nil {
+			os.Chown(p+validationErrorSuffix, fs.User.Uid, fs.User.Gid)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package sftp_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A secret stored in HashiCorp Vault, such as the Panel token, allowing it to be kept out of
+// configuration files on the node. Both version 1 and version 2 of the KV secrets engine are
+// supported. Use Fetch as the TokenSource of a PanelClient to pick up rotated tokens.
+type VaultSecret struct {
+	// The address of the Vault server, such as "https://vault.example.com:8200".
+	Address string
+	// The token used to authenticate with Vault. This can be read using ReadToken so that it
+	// is not stored in a configuration file either.
+	Token string
+	// The Vault Enterprise namespace the secret is in, if any.
+	Namespace string
+	// The API path of the secret, such as "secret/data/pterodactyl/panel" for the KV version 2
+	// engine mounted at "secret".
+	Path string
+	// The key within the secret holding the value. Defaults to "token".
+	Field string
+
+	HTTPClient *http.Client
+}
+
+// Reads the current value of the secret from Vault.
+func (s VaultSecret) Fetch() (string, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(s.Address, "/")+"/v1/"+strings.TrimPrefix(s.Path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("X-Vault-Token", s.Token)
+	if s.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.Namespace)
+	}
+
+	client := s.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("sftp: failed to read secret from vault: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("sftp: vault returned status %d reading secret %s", res.StatusCode, s.Path)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+
+	if err := json.NewDecoder(&limitedReader{r: res.Body, n: 1 << 20}).Decode(&body); err != nil {
+		return "", fmt.Errorf("sftp: invalid response from vault: %w", err)
+	}
+
+	data := body.Data
+	// Secrets in the KV version 2 engine are nested within a second data object alongside
+	// the metadata of the secret.
+	if nested, ok := data["data"]; ok {
+		if _, meta := data["metadata"]; meta {
+			data = nil
+			if err := json.Unmarshal(nested, &data); err != nil {
+				return "", fmt.Errorf("sftp: invalid response from vault: %w", err)
+			}
+		}
+	}
+
+	field := s.Field
+	if field == "" {
+		field = "token"
+	}
+
+	var v string
+	if raw, ok := data[field]; !ok || json.Unmarshal(raw, &v) != nil || v == "" {
+		return "", fmt.Errorf("sftp: vault secret %s does not contain a \"%s\" string", s.Path, field)
+	}
+
+	return v, nil
+}
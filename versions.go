@@ -0,0 +1,575 @@
+package sftp_server
+
+import (
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The hidden directory within a server's root that previous revisions of files are kept in.
+// Users are able to browse and download from it, but not write to it.
+const versionsDir = ".versions"
+
+// The format used for the name of each revision, which sorts in chronological order.
+const versionTimeFormat = "20060102T150405.000000000Z"
+
+// Determines if the path requested by the client is within the versions directory.
+func isVersionsPath(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	return name == versionsDir || strings.HasPrefix(name, versionsDir+"/")
+}
+
+// Returns the directory containing the revisions of the file at the given path.
+func (fs FileSystem) versionsPath(name string) (string, error) {
+	root, err := fs.buildPath("/")
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(root, versionsDir, filepath.FromSlash(path.Clean("/"+name))), nil
+}
+
+// Saves a copy of the file at p, which the client knows as name, as a new revision before it is
+// overwritten or deleted. Copies are made using a reflink when supported so they are cheap to
+// create. Nothing is saved if versioning is disabled or the server is out of disk space, since
+// keeping a revision should never be the reason an upload fails.
+func (fs FileSystem) saveVersion(name string, p string) {
+	if fs.FileVersions <= 0 || isVersionsPath(name) {
+		return
+	}
+
+	st, err := os.Lstat(p)
+	if err != nil || !st.Mode().IsRegular() {
+		return
+	}
+
+	if fs.HasDiskSpace != nil && !fs.HasDiskSpace(fs) {
+		return
+	}
+
+	dir, err := fs.versionsPath(name)
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fs.logger.Warnw("failed to create versions directory", zap.String("path", dir), zap.Error(err))
+		return
+	}
+
+	dst := filepath.Join(dir, time.Now().UTC().Format(versionTimeFormat))
+	if err := copyFile(dst, p); err != nil {
+		fs.logger.Warnw("failed to save previous version of file", zap.String("file", p), zap.Error(err))
+		os.Remove(dst)
+		return
+	}
+
+	os.Chtimes(dst, st.ModTime(), st.ModTime())
+	fs.versions.add(fs.UUID, st.Size())
+	fs.pruneVersions(dir)
+}
+
+// Saves a revision of every file within a directory before it is deleted.
+func (fs FileSystem) saveDirectoryVersions(name string, p string) {
+	if fs.FileVersions <= 0 || isVersionsPath(name) {
+		return
+	}
+
+	walkFiles(p, nil, func(f string, _ os.FileInfo) error {
+		rel, err := filepath.Rel(p, f)
+		if err == nil {
+			fs.saveVersion(path.Join(name, filepath.ToSlash(rel)), f)
+		}
+
+		return nil
+	})
+}
+
+// Removes the oldest revisions of a file so that only the configured number are kept, then
+// removes the oldest revisions across the server if they use more than the configured size.
+func (fs FileSystem) pruneVersions(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	var revisions []string
+	for _, e := range entries {
+		if e.Mode().IsRegular() {
+			revisions = append(revisions, e.Name())
+		}
+	}
+	sort.Strings(revisions)
+
+	for len(revisions) > fs.FileVersions {
+		p := filepath.Join(dir, revisions[0])
+		if st, err := os.Lstat(p); err == nil && os.Remove(p) == nil {
+			fs.versions.add(fs.UUID, -st.Size())
+		}
+		revisions = revisions[1:]
+	}
+
+	if fs.MaxVersionsSize <= 0 {
+		return
+	}
+
+	root, err := fs.versionsPath("/")
+	if err != nil {
+		return
+	}
+
+	if total, ok := fs.versions.total(fs.UUID); ok && total <= fs.MaxVersionsSize {
+		return
+	}
+
+	// Pruning walks every revision of the server, so enough is removed that it is not needed
+	// again for every revision saved after this one.
+	fs.versions.set(fs.UUID, pruneVersionsBySize(root, fs.MaxVersionsSize, fs.MaxVersionsSize/10*9))
+}
+
+// Tracks the total size of the revisions kept for each server, so that it is only necessary to
+// walk the revisions of a server to find its total size once, and again when they need to be
+// pruned. Revisions removed by anything other than this package are accounted for the next time
+// the revisions are pruned.
+type versionUsage struct {
+	m sync.Map
+}
+
+type serverVersions struct {
+	mu    sync.Mutex
+	known bool
+	size  int64
+}
+
+func (u *versionUsage) get(uuid string) *serverVersions {
+	v, _ := u.m.LoadOrStore(uuid, &serverVersions{})
+
+	return v.(*serverVersions)
+}
+
+// Returns the total size of the revisions kept for the server, and false if it is not known.
+func (u *versionUsage) total(uuid string) (int64, bool) {
+	if u == nil {
+		return 0, false
+	}
+
+	s := u.get(uuid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size, s.known
+}
+
+// Adds to the total size of the revisions kept for the server, if it is known.
+func (u *versionUsage) add(uuid string, n int64) {
+	if u == nil {
+		return
+	}
+
+	s := u.get(uuid)
+	s.mu.Lock()
+	if s.known {
+		s.size += n
+	}
+	s.mu.Unlock()
+}
+
+func (u *versionUsage) set(uuid string, n int64) {
+	if u == nil {
+		return
+	}
+
+	s := u.get(uuid)
+	s.mu.Lock()
+	s.size, s.known = n, true
+	s.mu.Unlock()
+}
+
+// Removes the oldest revisions within the versions directory if the total size of them is above
+// the given limit, until it is below the target, returning the total size of the revisions left.
+func pruneVersionsBySize(root string, max int64, target int64) int64 {
+	type revision struct {
+		path string
+		name string
+		size int64
+	}
+
+	var total int64
+	var revisions []revision
+	walkFiles(root, nil, func(p string, info os.FileInfo) error {
+		total += info.Size()
+		revisions = append(revisions, revision{path: p, name: info.Name(), size: info.Size()})
+
+		return nil
+	})
+
+	if total <= max {
+		return total
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].name < revisions[j].name
+	})
+
+	for _, r := range revisions {
+		if total <= target {
+			break
+		}
+
+		if os.Remove(r.path) == nil {
+			total -= r.size
+		}
+	}
+
+	return total
+}
+
+// A previous revision of a file.
+type FileVersion struct {
+	// The identifier of the revision, used to restore it.
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// The time at which the revision was saved, which is when the file was overwritten or
+	// deleted.
+	Saved time.Time `json:"saved"`
+}
+
+// Returns the revisions saved for the file at the given path, most recent first. Revisions are
+// kept for deleted files as well, which DeletedFiles finds. The Panel reaches this through the
+// VersionsHandler, and SFTP clients through the "versions" exec command.
+func (fs FileSystem) Versions(name string) ([]FileVersion, error) {
+	if !fs.can(PermissionFileRead) {
+		return nil, ErrPermissionDenied
+	}
+
+	if fs.isIgnored(name) {
+		return []FileVersion{}, nil
+	}
+
+	if err := fs.runMiddleware("List", name, ""); err != nil {
+		return nil, err
+	}
+
+	dir, err := fs.versionsPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []FileVersion{}, nil
+		}
+
+		return nil, err
+	}
+
+	versions := []FileVersion{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		saved, err := time.Parse(versionTimeFormat, e.Name())
+		if err != nil || !e.Mode().IsRegular() {
+			continue
+		}
+
+		versions = append(versions, FileVersion{ID: e.Name(), Size: e.Size(), ModTime: e.ModTime(), Saved: saved})
+	}
+
+	return versions, nil
+}
+
+// The most deleted files returned by a single call to DeletedFiles.
+const maxDeletedFiles = 1000
+
+// A file that no longer exists but still has revisions that can be restored.
+type DeletedFile struct {
+	Path string `json:"path"`
+	// The number of revisions kept for the file.
+	Versions int `json:"versions"`
+	// The time the most recent revision was saved, which is when the file was deleted unless
+	// it was overwritten before that.
+	Deleted time.Time `json:"deleted"`
+}
+
+// Returns the files within the given directory, and every directory below it, that have been
+// deleted but still have revisions kept, most recently deleted first. Without this a deleted
+// file could only be restored by someone who already knew its path.
+func (fs FileSystem) DeletedFiles(dir string) ([]DeletedFile, error) {
+	if !fs.can(PermissionFileRead) {
+		return nil, ErrPermissionDenied
+	}
+
+	if fs.isIgnored(dir) || isVersionsPath(dir) {
+		return []DeletedFile{}, nil
+	}
+
+	if err := fs.runMiddleware("List", dir, ""); err != nil {
+		return nil, err
+	}
+
+	base, err := fs.versionsPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := fs.versionsPath("/")
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]*DeletedFile)
+	filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		saved, err := time.Parse(versionTimeFormat, info.Name())
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil {
+			return nil
+		}
+
+		name := path.Clean("/" + filepath.ToSlash(rel))
+		f, ok := found[name]
+		if !ok {
+			f = &DeletedFile{Path: name}
+			found[name] = f
+		}
+
+		f.Versions++
+		if saved.After(f.Deleted) {
+			f.Deleted = saved
+		}
+
+		return nil
+	})
+
+	files := []DeletedFile{}
+	for name, f := range found {
+		if fs.isIgnored(name) {
+			continue
+		}
+
+		if p, err := fs.buildPath(name); err != nil || fs.inQuarantine(p) {
+			continue
+		} else if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			continue
+		}
+
+		files = append(files, *f)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Deleted.After(files[j].Deleted)
+	})
+
+	if len(files) > maxDeletedFiles {
+		files = files[:maxDeletedFiles]
+	}
+
+	return files, nil
+}
+
+// Restores a previous revision of the file at the given path, replacing the current contents of
+// the file or recreating it if it was deleted. The current contents are saved as a new revision
+// first so that a restore can itself be undone.
+func (fs FileSystem) RestoreVersion(name string, id string) error {
+	if fs.isReadOnly() || !fs.can(PermissionFileCreate) || !fs.can(PermissionFileUpdate) || isVersionsPath(name) {
+		return ErrPermissionDenied
+	}
+
+	if _, err := time.Parse(versionTimeFormat, id); err != nil || fs.isIgnored(name) {
+		return os.ErrNotExist
+	}
+
+	done, ok := fs.locks.begin(fs.UUID)
+	if !ok {
+		return ErrServerLocked
+	}
+	defer done()
+
+	dir, err := fs.versionsPath(name)
+	if err != nil {
+		return err
+	}
+
+	p, err := fs.buildPath(name)
+	if err != nil {
+		return err
+	}
+
+	src := filepath.Join(dir, id)
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.runMiddlewareWithSize("Put", name, "", st.Size()); err != nil {
+		return err
+	}
+
+	if !fs.HasDiskSpace(fs) {
+		return ErrQuotaExceeded
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.saveVersion(name, p)
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	if err := copyFile(p, src); err != nil {
+		fs.logger.Errorw("failed to restore previous version of file", zap.String("file", p), zap.String("version", id), zap.Error(err))
+		return err
+	}
+
+	os.Chtimes(p, st.ModTime(), st.ModTime())
+	if err := os.Chown(p, fs.User.Uid, fs.User.Gid); err != nil {
+		fs.logger.Warnw("error chowning file", zap.String("file", p), zap.Error(err))
+	}
+
+	fs.relabel(p)
+	fs.recordModifiedBy(p)
+	fs.emit(EventRestore, name, id)
+
+	return nil
+}
+
+// Returns a HTTP handler for the revisions of the server given by the "server" parameter, so that
+// it can be mounted on the daemon's control API. GET requests list the revisions of the file
+// given by the "path" parameter, or the files deleted within it if the "deleted" parameter is
+// set, and POST requests restore the revision given by the "id" parameter.
+func (c *Server) VersionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server := r.URL.Query().Get("server")
+		if server == "" {
+			http.Error(w, "missing server parameter", http.StatusBadRequest)
+			return
+		}
+
+		name := r.URL.Query().Get("path")
+		fs := c.serverFileSystem(server)
+
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			var v interface{}
+			if r.URL.Query().Get("deleted") != "" {
+				if name == "" {
+					name = "/"
+				}
+				v, err = fs.DeletedFiles(name)
+			} else if name == "" {
+				http.Error(w, "missing path parameter", http.StatusBadRequest)
+				return
+			} else {
+				v, err = fs.Versions(name)
+			}
+
+			if err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(v)
+				return
+			}
+		case http.MethodPost:
+			if name == "" {
+				http.Error(w, "missing path parameter", http.StatusBadRequest)
+				return
+			}
+
+			err = fs.RestoreVersion(name, r.URL.Query().Get("id"))
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case os.IsNotExist(err):
+			http.Error(w, "version not found", http.StatusNotFound)
+		case errors.Is(err, ErrQuotaExceeded):
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		case errors.As(err, new(*DenialError)), errors.Is(err, ErrPermissionDenied), errors.Is(err, ErrServerLocked):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			c.logger.Errorw("failed to manage file versions", zap.String("server", server), zap.Error(err))
+			http.Error(w, "failed to manage file versions", http.StatusInternalServerError)
+		}
+	})
+}
+
+// Writes the revisions of a file to the client as one JSON object per line.
+func versionsCommand(fs FileSystem, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: versions <file>")
+	}
+
+	versions, err := fs.Versions(args[0])
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	for _, v := range versions {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes the files deleted within a directory, the root by default, to the client as one JSON
+// object per line.
+func deletedCommand(fs FileSystem, args []string, out io.Writer) error {
+	dir := "/"
+	if len(args) > 1 {
+		return errors.New("usage: deleted [directory]")
+	} else if len(args) == 1 {
+		dir = args[0]
+	}
+
+	files, err := fs.DeletedFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	for _, f := range files {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restores a revision of a file, as returned by the versions command.
+func restoreCommand(fs FileSystem, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: restore <file> <id>")
+	}
+
+	return fs.RestoreVersion(args[0], args[1])
+}
@@ -0,0 +1,179 @@
+package sftp_server
+
+import (
+	"go.uber.org/zap"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Walks every regular file below the given root directory and calls the provided function
+// for each of them, skipping any files or directories matching one of the exclusion patterns.
+// Patterns are matched in the same way as CriticalFiles, relative to the root. Symlinks are
+// never followed, and errors encountered while reading an individual entry are skipped rather
+// than aborting the entire walk since a single unreadable file should not prevent usage from
+// being calculated.
+func walkFiles(root string, exclude []string, fn func(p string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+
+			return nil
+		}
+
+		if p != root && len(exclude) > 0 {
+			rel, _ := filepath.Rel(root, p)
+			for _, pattern := range exclude {
+				if matchesFilePattern(pattern, filepath.ToSlash(rel)) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+
+					return nil
+				}
+			}
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return fn(p, info)
+	})
+}
+
+// Returns the total size in bytes of all of the regular files contained within the given
+// directory. This is intended to be used by DiskSpaceValidator implementations so that the
+// usage accounting matches what the rest of this package considers to be a file.
+func DiskUsage(dir string) (int64, error) {
+	return DiskUsageExcluding(dir, nil)
+}
+
+// Returns the total size in bytes of the regular files within the given directory, skipping
+// any files or directories matching one of the exclusion patterns. Patterns are matched in the
+// same way as CriticalFiles, relative to the directory. This allows copies retained by trash,
+// versioning or backups to be left out of a server's usage so users are not charged twice.
+func DiskUsageExcluding(dir string, exclude []string) (int64, error) {
+	var size int64
+
+	err := walkFiles(dir, exclude, func(p string, info os.FileInfo) error {
+		size += info.Size()
+
+		return nil
+	})
+
+	return size, err
+}
+
+// Returns the disk usage of the server in bytes, excluding any files matching the filesystem's
+// UsageExclusions. The usage is fetched from the filesystem's UsageSource when it has one,
+// only walking the server's directory if that fails. The exclusions only apply when the
+// directory is walked, the usage reported by a source is returned as it is, so a source must
+// leave out anything that should be excluded itself.
+func (fs FileSystem) DiskUsage() (int64, error) {
+	if fs.UsageSource != nil {
+		n, err := fs.UsageSource(fs.UUID)
+		if err == nil {
+			return n, nil
+		}
+
+		fs.logger.Warnw("failed to fetch disk usage for server, calculating it instead", zap.Error(err))
+	}
+
+	root, err := fs.buildPath("/")
+	if err != nil {
+		return 0, err
+	}
+
+	return DiskUsageExcluding(root, fs.UsageExclusions)
+}
+
+// A summary of the contents of a directory.
+type DirectorySummary struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// Returns the recursive number of files within a directory on the server and their total size,
+// allowing clients to display accurate folder sizes without needing to walk the tree themselves.
+// Summaries are cached for a short time since walking large directories is expensive. The daemon
+// calls this when the Panel's file manager shows folder sizes, and SFTP clients can get the same
+// totals from the "du" exec command.
+func (fs FileSystem) Summary(dir string) (*DirectorySummary, error) {
+	if !fs.can(PermissionFileRead) {
+		return nil, ErrPermissionDenied
+	}
+
+	if fs.isIgnored(dir) {
+		return nil, os.ErrNotExist
+	}
+
+	if err := fs.runMiddleware("List", dir, ""); err != nil {
+		return nil, err
+	}
+
+	p, err := fs.buildPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subusers are not told about the files hidden from them, so their summaries leave them
+	// out and are cached separately from the owner's.
+	var patterns, base []string
+	if !fs.isOwner() {
+		patterns = fs.ignorePatterns()
+		if base = fs.ignoreNames(dir); len(base) == 0 {
+			base = []string{""}
+		}
+	}
+
+	key := "summary:" + fs.UUID + ":" + p
+	if !fs.isOwner() {
+		key += ":ignored"
+	}
+
+	if fs.Cache != nil {
+		if s, ok := fs.Cache.Get(key); ok {
+			return s.(*DirectorySummary), nil
+		}
+	}
+
+	s := &DirectorySummary{}
+	err = walkFiles(p, nil, func(f string, info os.FileInfo) error {
+		// Symlinks are not followed while walking, so the names of the files below the
+		// directory only need to be added on to the names the directory was checked as.
+		if base != nil {
+			rel, err := filepath.Rel(p, f)
+			if err != nil {
+				return nil
+			}
+
+			names := make([]string, len(base))
+			for i, b := range base {
+				names[i] = path.Join(b, filepath.ToSlash(rel))
+			}
+
+			if ignoredNames(patterns, names) {
+				return nil
+			}
+		}
+
+		s.Files++
+		s.Size += info.Size()
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.Cache != nil {
+		fs.Cache.Set(key, s, 30*time.Second)
+	}
+
+	return s, nil
+}
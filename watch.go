@@ -0,0 +1,187 @@
+package sftp_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The most directories that are watched by a single watch command. Changes in directories
+// beyond this, or beyond the MaxWatchedDirectories of the server, are not reported.
+const maxWatchedDirectories = 1000
+
+// The interval at which a heartbeat is written to clients watching a directory, which keeps
+// idle connections open and detects clients that have gone away.
+const watchHeartbeatInterval = 30 * time.Second
+
+// Returned when watching directories is not supported on the platform.
+var errWatchUnsupported = errors.New("watching directories is not supported on this system")
+
+// Returned when the maximum number of watch commands are already running.
+var errTooManyWatchers = errors.New("too many directories are being watched, please try again later")
+
+// Limits the number of watch commands running at once, and the number of directories watched by
+// all of them, across every session of the process. Each watch command uses an inotify instance
+// and a watch per directory, which the kernel limits for each user. Exhausting them would break
+// every other process running as the same user, not just the watch commands.
+type watchLimits struct {
+	mu          sync.Mutex
+	watchers    int
+	watches     int
+	maxWatchers int
+	maxWatches  int
+}
+
+func newWatchLimits(watchers int, watches int) *watchLimits {
+	return &watchLimits{maxWatchers: watchers, maxWatches: watches}
+}
+
+// Reserves one of the watch commands that may run at once, returning false if they are all in
+// use. Negative limits allow any number.
+func (l *watchLimits) acquireWatcher() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxWatchers >= 0 && l.watchers >= l.maxWatchers {
+		return false
+	}
+	l.watchers++
+
+	return true
+}
+
+func (l *watchLimits) releaseWatcher() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.watchers--
+	l.mu.Unlock()
+}
+
+// Reserves a watch on a single directory, returning false if the limit has been reached.
+func (l *watchLimits) acquireWatch() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxWatches >= 0 && l.watches >= l.maxWatches {
+		return false
+	}
+	l.watches++
+
+	return true
+}
+
+func (l *watchLimits) releaseWatches(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.watches -= n
+	l.mu.Unlock()
+}
+
+// A change to a file or directory within a watched directory.
+type watchEvent struct {
+	// One of "create", "modify" or "delete". Renames are reported as a delete of the old path
+	// followed by a create of the new one.
+	Op   string `json:"op"`
+	Path string `json:"path"`
+}
+
+// Streams the changes made within a directory of the server, and every directory below it, to
+// the client as one JSON object per line until the client closes the channel. A line with the
+// "ping" op is written periodically while nothing changes. The SFTP library does not allow new
+// extended requests to be added, so live-updating file managers run this as an exec command on
+// another channel of their SFTP connection, for example "ssh -p 2022 user.server@node watch /plugins".
+func watchCommand(fs FileSystem, args []string, out io.Writer) error {
+	if !fs.can(PermissionFileRead) {
+		return ErrPermissionDenied
+	}
+
+	dir := "/"
+	if len(args) > 1 {
+		return errors.New("only a single directory may be watched")
+	} else if len(args) == 1 {
+		dir = args[0]
+	}
+
+	if fs.isIgnored(dir) {
+		return fmt.Errorf("%s: no such directory", dir)
+	}
+
+	if err := fs.runMiddleware("List", dir, ""); err != nil {
+		return err
+	}
+
+	root, err := fs.buildPath("/")
+	if err != nil {
+		return err
+	}
+
+	p, err := fs.buildPath(dir)
+	if err != nil {
+		return err
+	}
+
+	if st, err := os.Stat(p); err != nil || !st.IsDir() {
+		return fmt.Errorf("%s: no such directory", dir)
+	}
+
+	if !fs.watches.acquireWatcher() {
+		return errTooManyWatchers
+	}
+	defer fs.watches.releaseWatcher()
+
+	w, err := newDirWatcher(p, maxWatchedDirectories, fs.watches)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	enc := json.NewEncoder(out)
+	heartbeat := time.NewTicker(watchHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-w.events:
+			if !ok {
+				return nil
+			}
+
+			rel, err := filepath.Rel(root, e.Path)
+			if err != nil {
+				continue
+			}
+
+			e.Path = "/" + filepath.ToSlash(rel)
+			if fs.isIgnored(e.Path) || isVersionsPath(e.Path) || isQuarantinePath(e.Path) {
+				continue
+			}
+
+			if err := enc.Encode(e); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if err := enc.Encode(watchEvent{Op: "ping"}); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+//go:build linux
+// +build linux
+
+package sftp_server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The inotify events that are reported to clients.
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// Watches a directory and the directories below it for changes using inotify. Directories
+// created while watching are watched as well, up to the limit and as long as the limits shared
+// with every other watcher allow it.
+type dirWatcher struct {
+	f      *os.File
+	fd     int
+	limit  int
+	limits *watchLimits
+	events chan watchEvent
+	done   chan struct{}
+	once   sync.Once
+
+	mu   sync.Mutex
+	dirs map[int32]string
+}
+
+func newDirWatcher(root string, limit int, limits *watchLimits) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, errWatchUnsupported
+	}
+
+	// The descriptor is non-blocking, so reads use the runtime's poller and are interrupted
+	// when the file is closed.
+	w := &dirWatcher{
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		limit:  limit,
+		limits: limits,
+		events: make(chan watchEvent, 256),
+		done:   make(chan struct{}),
+		dirs:   make(map[int32]string),
+	}
+
+	if err := w.addTree(root); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	go w.read()
+
+	return w, nil
+}
+
+// Watches the directory and every directory below it.
+func (w *dirWatcher) addTree(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Directories that disappear or cannot be read while walking are skipped.
+			if p == root {
+				return err
+			}
+			return nil
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if !w.add(p) {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// Watches a single directory, returning false if the limit has been reached.
+func (w *dirWatcher) add(dir string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+
+	if len(w.dirs) >= w.limit || !w.limits.acquireWatch() {
+		return false
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask|syscall.IN_ONLYDIR|syscall.IN_DONT_FOLLOW)
+	if err != nil {
+		w.limits.releaseWatches(1)
+		return true
+	}
+
+	// Watching a directory that is already watched returns the same descriptor again.
+	if _, ok := w.dirs[int32(wd)]; ok {
+		w.limits.releaseWatches(1)
+	}
+	w.dirs[int32(wd)] = dir
+
+	return true
+}
+
+func (w *dirWatcher) read() {
+	defer close(w.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(raw.Len)]
+			off += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			if !w.handle(raw.Wd, raw.Mask, string(bytes.TrimRight(name, "\x00"))) {
+				return
+			}
+		}
+	}
+}
+
+// Passes an event on to the watcher's events, returning false once the watcher is closed.
+func (w *dirWatcher) handle(wd int32, mask uint32, name string) bool {
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if ok && mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		w.limits.releaseWatches(1)
+	}
+	w.mu.Unlock()
+
+	if !ok || name == "" {
+		return true
+	}
+
+	e := watchEvent{Path: filepath.Join(dir, name)}
+	switch {
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		e.Op = "create"
+		if mask&syscall.IN_ISDIR != 0 {
+			w.addTree(e.Path)
+		}
+	case mask&syscall.IN_CLOSE_WRITE != 0:
+		e.Op = "modify"
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		e.Op = "delete"
+	default:
+		return true
+	}
+
+	select {
+	case w.events <- e:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *dirWatcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		w.mu.Lock()
+		close(w.done)
+		w.limits.releaseWatches(len(w.dirs))
+		w.dirs = map[int32]string{}
+		w.mu.Unlock()
+
+		err = w.f.Close()
+	})
+
+	return err
+}
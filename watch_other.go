@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+type dirWatcher struct {
+	events chan watchEvent
+}
+
+func newDirWatcher(root string, limit int, limits *watchLimits) (*dirWatcher, error) {
+	return nil, errWatchUnsupported
+}
+
+func (w *dirWatcher) Close() error {
+	return nil
+}
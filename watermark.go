@@ -0,0 +1,117 @@
+package sftp_server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// The maximum number of bytes read from the start of a file when looking for a line, such as a
+// shebang, that the watermark must be placed after.
+const watermarkSniffSize = 4096
+
+// Returns the comment format used to watermark downloads of the file at the requested path,
+// and false if downloads of it are not watermarked.
+func (fs FileSystem) watermarkFormat(name string) (string, bool) {
+	for pattern, format := range fs.Watermarks {
+		if matchesFilePattern(pattern, name) {
+			return format, true
+		}
+	}
+
+	return "", false
+}
+
+// Builds the marker injected into a download, identifying the account that downloaded the file.
+// The format is a comment in the syntax of the file, containing "%s" where the marker should be
+// placed, such as "<!-- %s -->". A format without "%s" is treated as a line comment prefix.
+func (fs FileSystem) watermark(format string) []byte {
+	user := "unknown"
+	id := ""
+	if fs.session != nil {
+		user = fs.session.user
+		id = fs.session.id
+	}
+
+	text := fmt.Sprintf("Downloaded by %s from server %s at %s (session %s)", user, fs.UUID, time.Now().UTC().Format(time.RFC3339), id)
+	if !strings.Contains(format, "%s") {
+		format += " %s"
+	}
+
+	return []byte(strings.Replace(format, "%s", text, 1) + "\n")
+}
+
+// Wraps a file being downloaded so that the provenance marker is injected into its contents.
+// The marker is added as the first line of the file, unless the file begins with a line that
+// must remain first, such as a shebang or an XML declaration, in which case it follows it.
+func (fs FileSystem) withWatermark(f backendFile, file *os.File, format string) backendFile {
+	head := make([]byte, watermarkSniffSize)
+	n, _ := file.ReadAt(head, 0)
+	head = head[:n]
+
+	var at int64
+	if bytes.HasPrefix(head, []byte("#!")) || bytes.HasPrefix(head, []byte("<?xml")) {
+		i := bytes.IndexByte(head, '\n')
+		if i == -1 {
+			return f
+		}
+
+		at = int64(i + 1)
+	}
+
+	if fs.metrics != nil {
+		fs.metrics.Inc("downloads_watermarked_total")
+	}
+
+	return &watermarkedFile{backendFile: f, at: at, mark: fs.watermark(format)}
+}
+
+// A file with a marker inserted at a fixed offset in its contents. Reads are mapped onto the
+// underlying file so that the marker is returned in place, and everything after it is shifted.
+type watermarkedFile struct {
+	backendFile
+	at   int64
+	mark []byte
+}
+
+func (f *watermarkedFile) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	end := f.at + int64(len(f.mark))
+
+	if off < f.at {
+		want := b
+		if int64(len(want)) > f.at-off {
+			want = want[:f.at-off]
+		}
+
+		r, err := f.backendFile.ReadAt(want, off)
+		n += r
+		if err != nil || r < len(want) {
+			return n, err
+		}
+
+		off += int64(r)
+	}
+
+	if off >= f.at && off < end && n < len(b) {
+		n += copy(b[n:], f.mark[off-f.at:])
+		off = end
+	}
+
+	if n < len(b) {
+		r, err := f.backendFile.ReadAt(b[n:], off-int64(len(f.mark)))
+		n += r
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package sftp_server
+
+import (
+	"syscall"
+)
+
+// Extended attributes are only written on Linux.
+func setxattr(p string, name string, value []byte) error {
+	return syscall.ENOTSUP
+}